@@ -1,15 +1,18 @@
 package component
 
-import "github.com/kanosaki/go-pipenet/core"
+import (
+	"context"
+	"github.com/kanosaki/go-pipenet/core"
+)
 
 type DelegateController struct {
-	push func(port core.PortKey, data *core.Packet)
-	pull func(port core.PortKey, param *core.DrainRequest) *core.DrainResponse
+	push func(ctx context.Context, port core.PortKey, data *core.Packet) error
+	pull func(ctx context.Context, port core.PortKey, param *core.DrainRequest) (*core.DrainResponse, error)
 }
 
 func NewDelegateController(
-push func(port core.PortKey, data *core.Packet),
-pull func(port core.PortKey, param *core.DrainRequest) *core.DrainResponse) *DelegateController {
+push func(ctx context.Context, port core.PortKey, data *core.Packet) error,
+pull func(ctx context.Context, port core.PortKey, param *core.DrainRequest) (*core.DrainResponse, error)) *DelegateController {
 	return &DelegateController{
 		push,
 		pull,
@@ -19,10 +22,10 @@ pull func(port core.PortKey, param *core.DrainRequest) *core.DrainResponse) *Del
 func (self *DelegateController) Concrete(joint *core.MetaJoint, graph *core.MetaGraph) error {
 	return nil
 }
-func (self *DelegateController) Push(port core.PortKey, data *core.Packet) {
-	self.push(port, data)
+func (self *DelegateController) Push(ctx context.Context, port core.PortKey, data *core.Packet) error {
+	return self.push(ctx, port, data)
 }
-func (self *DelegateController) Pull(port core.PortKey, param *core.DrainRequest) *core.DrainResponse {
-	return self.pull(port, param)
+func (self *DelegateController) Pull(ctx context.Context, port core.PortKey, param *core.DrainRequest) (*core.DrainResponse, error) {
+	return self.pull(ctx, port, param)
 }
 
@@ -4,4 +4,5 @@ import "github.com/kanosaki/go-pipenet/core"
 
 var Builtins = []core.Component{
 	&Merge{},
+	&Subgraph{},
 }
@@ -1,10 +1,13 @@
 package component
 
 import (
+	"context"
 	"github.com/kanosaki/go-pipenet/core"
 	"encoding/json"
 	"github.com/ugorji/go/codec"
+	"github.com/pkg/errors"
 	"fmt"
+	"io"
 )
 
 const (
@@ -29,11 +32,26 @@ func (m *Merge) CreateController(metaJoint *core.MetaJoint, param interface{}, g
 	return &MergeController{}, nil
 }
 
-func (m *Merge) Save(joint *core.MetaJoint) {
-
+// State is the packets drained from upstream but not returned by Pull yet
+func (m *Merge) Save(joint *core.MetaJoint, writer io.Writer) error {
+	mc, ok := joint.Controller().(*MergeController)
+	if !ok {
+		return fmt.Errorf("Merge requires MergeController, but %T", joint.Controller())
+	}
+	return core.WritePackets(writer, mc.oddsEndsBuffer, core.PacketMsgpackHandle)
 }
-func (m *Merge) Restore() {
 
+func (m *Merge) Restore(joint *core.MetaJoint, reader io.Reader) error {
+	mc, ok := joint.Controller().(*MergeController)
+	if !ok {
+		return fmt.Errorf("Merge requires MergeController, but %T", joint.Controller())
+	}
+	packets, err := core.ReadPackets(reader, core.PacketMsgpackHandle)
+	if err != nil {
+		return err
+	}
+	mc.oddsEndsBuffer = packets
+	return nil
 }
 
 func (m *Merge) DecodeParam(decoder *codec.Decoder, data json.RawMessage) (core.ComponentParam, error) {
@@ -48,19 +66,48 @@ type MergeController struct {
 	currentOutput  int
 	currentInlet   int
 	oddsEndsBuffer []*core.Packet
+	// port of the only outlet bridge, empty if there are many
+	soleOutlet     core.PortKey
 }
 
-func (mc *MergeController) Push(port core.PortKey, data *core.Packet) {
+func (mc *MergeController) Push(ctx context.Context, port core.PortKey, data *core.Packet) error {
 	// Round robbin
 	// set next outlet
 	mc.currentOutput = (mc.currentOutput + 1) % len(mc.outlets)
-	mc.outlets[mc.currentOutput].Send(data)
+	return mc.outlets[mc.currentOutput].Send(ctx, data)
 }
 
-func (mc *MergeController) Pull(port core.PortKey, param *core.DrainRequest) *core.DrainResponse {
+// Whole batch goes to the outlet if there is only one, otherwise packets are distributed in round robin
+func (mc *MergeController) PushBatch(ctx context.Context, port core.PortKey, batch []*core.Packet) error {
+	if len(mc.outlets) == 1 {
+		return core.SendBatch(ctx, mc.outlets[0], batch)
+	}
+	branches := make([][]*core.Packet, len(mc.outlets))
+	for _, data := range batch {
+		mc.currentOutput = (mc.currentOutput + 1) % len(mc.outlets)
+		branches[mc.currentOutput] = append(branches[mc.currentOutput], data)
+	}
+	var firstErr error
+	for i, branch := range branches {
+		if len(branch) == 0 {
+			continue
+		}
+		if err := core.SendBatch(ctx, mc.outlets[i], branch); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (mc *MergeController) Pull(ctx context.Context, port core.PortKey, param *core.DrainRequest) (*core.DrainResponse, error) {
 	ret := mc.oddsEndsBuffer
+	mc.oddsEndsBuffer = nil
 	for len(ret) < param.Count && len(mc.inlets) > mc.currentInlet {
-		resFromUpstream := mc.inlets[mc.currentInlet].Drain(param)
+		if err := ctx.Err(); err != nil {
+			// stop draining upstreams, and return items gathered so far
+			return core.NewInterruptedResponse(ret), err
+		}
+		resFromUpstream, err := mc.inlets[mc.currentInlet].Drain(ctx, param)
 		if resFromUpstream != nil && len(resFromUpstream.Items) > 0 {
 			if len(resFromUpstream.Items) + len(ret) > param.Count {
 				cutAt := param.Count - len(ret)
@@ -69,13 +116,17 @@ func (mc *MergeController) Pull(port core.PortKey, param *core.DrainRequest) *co
 			} else {
 				ret = append(ret, resFromUpstream.Items...)
 			}
-		} else {
+		} else if err == nil {
 			mc.currentInlet += 1
 		}
+		if err != nil {
+			// return items gathered so far, caller can retry after recovering upstream
+			return core.NewInterruptedResponse(ret), errors.Wrapf(err, "Failed to drain from inlet #%d", mc.currentInlet)
+		}
 	}
 	return &core.DrainResponse{
 		Items: ret,
-	}
+	}, nil
 }
 
 func (mc *MergeController) Concrete(metaJoint *core.MetaJoint, graph *core.MetaGraph) error {
@@ -90,7 +141,23 @@ func (mc *MergeController) Concrete(metaJoint *core.MetaJoint, graph *core.MetaG
 	}
 	mc.inlets = inlets
 	mc.outlets = outlets
+	mc.soleOutlet = core.PORT_EMPTY
+	if bridges := graph.SelectBridges(metaJoint.Key, core.PORT_ANY, core.JOINT_ANY, core.PORT_ANY); len(bridges) == 1 {
+		mc.soleOutlet = bridges[0].Source.Port
+	}
 	mc.currentOutput = -1
 	mc.currentInlet = 0
 	return nil
 }
+
+func passThrough(data *core.Packet) (*core.Packet, error) {
+	return data, nil
+}
+
+// Merge with single outlet just passes packets, so that it can be inlined
+func (mc *MergeController) InlineFunc(port core.PortKey) (func(data *core.Packet) (*core.Packet, error), core.PortKey, bool) {
+	if len(mc.outlets) != 1 || mc.soleOutlet == core.PORT_EMPTY {
+		return nil, core.PORT_EMPTY, false
+	}
+	return passThrough, mc.soleOutlet, true
+}
@@ -0,0 +1,130 @@
+package component
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/kanosaki/go-pipenet/core"
+	"github.com/kanosaki/go-pipenet/storage"
+	"github.com/pkg/errors"
+	"github.com/ugorji/go/codec"
+	"io"
+)
+
+const (
+	KEY_SUBGRAPH core.ComponentKey = "subgraph"
+)
+
+// Uses a MetaGraph as a joint,
+// inlets and outlets of the joint are mapped onto the ones of the child graph which have same names.
+type Subgraph struct {
+}
+
+type SubgraphParam struct {
+	// key of the stored graph, loaded through Universe.Load
+	Graph  string `codec:"graph"`
+	// inline graph definition, used if Graph is empty
+	Inline *storage.GraphInfo `codec:"inline"`
+}
+
+func (p *SubgraphParam) Name() core.ComponentKey {
+	return KEY_SUBGRAPH
+}
+
+func (s *Subgraph) Name() core.ComponentKey {
+	return KEY_SUBGRAPH
+}
+
+func (s *Subgraph) CreateController(metaJoint *core.MetaJoint, param interface{}, graph *core.MetaGraph) (core.JointController, error) {
+	sp, ok := param.(*SubgraphParam)
+	if !ok {
+		return nil, fmt.Errorf("Subgraph requires graph key or inline graph")
+	}
+	var child *core.MetaGraph
+	var err error
+	switch {
+	case sp.Graph != "":
+		child, err = graph.Universe.Load(sp.Graph)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to load graph %s", sp.Graph)
+		}
+	case sp.Inline != nil:
+		child, err = storage.FromInfo(sp.Inline, graph.Universe)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to build inline graph")
+		}
+	default:
+		return nil, fmt.Errorf("Subgraph requires graph key or inline graph")
+	}
+	child.Flavor = graph.Flavor
+	child.CopyPolicy = graph.CopyPolicy
+	child.RecordHops = graph.RecordHops
+	return &SubgraphController{
+		child: child,
+	}, nil
+}
+
+// State of the child graph is not written, checkpoint it through Child() separately
+func (s *Subgraph) Save(joint *core.MetaJoint, writer io.Writer) error {
+	return nil
+}
+
+func (s *Subgraph) Restore(joint *core.MetaJoint, reader io.Reader) error {
+	return nil
+}
+
+func (s *Subgraph) DecodeParam(decoder *codec.Decoder, data json.RawMessage) (core.ComponentParam, error) {
+	// inline graph is kept raw, so that it is migrated as stored documents are
+	raw := &struct {
+		Graph  string `codec:"graph"`
+		Inline json.RawMessage `codec:"inline"`
+	}{}
+	if err := decoder.Decode(raw); err != nil {
+		return nil, err
+	}
+	ret := &SubgraphParam{Graph: raw.Graph}
+	if len(raw.Inline) != 0 && string(raw.Inline) != "null" {
+		inline, err := storage.DecodeInfoJson(raw.Inline)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid inline graph")
+		}
+		ret.Inline = inline
+	}
+	return ret, nil
+}
+
+type SubgraphController struct {
+	child *core.MetaGraph
+}
+
+func (sc *SubgraphController) Child() *core.MetaGraph {
+	return sc.child
+}
+
+func (sc *SubgraphController) Push(ctx context.Context, port core.PortKey, data *core.Packet) error {
+	return sc.child.PushContext(ctx, port, data)
+}
+
+func (sc *SubgraphController) PushBatch(ctx context.Context, port core.PortKey, batch []*core.Packet) error {
+	return sc.child.PushBatchContext(ctx, port, batch)
+}
+
+func (sc *SubgraphController) Pull(ctx context.Context, port core.PortKey, param *core.DrainRequest) (*core.DrainResponse, error) {
+	return sc.child.PullContext(ctx, port, param)
+}
+
+func (sc *SubgraphController) Concrete(metaJoint *core.MetaJoint, graph *core.MetaGraph) error {
+	// joints of the child keep state under the namespace of the joint
+	st := metaJoint.State()
+	sc.child.State = graph.State
+	sc.child.StateNamespace = st.Namespace()
+	// outlets of the joint become sinks of the child
+	for _, br := range graph.SelectBridges(metaJoint.Key, core.PORT_ANY, core.JOINT_ANY, core.PORT_ANY) {
+		sc.child.Sink(br.Source.Port, graph.PortOutlet(metaJoint.Key, br.Source.Port))
+	}
+	// inlets of the joint become sources of the child
+	for _, br := range graph.SelectBridges(core.JOINT_ANY, core.PORT_ANY, metaJoint.Key, core.PORT_ANY) {
+		sc.child.Source(br.Destination.Port, graph.PortInlet(metaJoint.Key, br.Destination.Port))
+	}
+	return errors.Wrapf(sc.child.Concrete(), "Failed to concrete subgraph at %s", metaJoint.Key)
+}
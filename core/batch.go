@@ -0,0 +1,185 @@
+package core
+
+import (
+	"context"
+)
+
+// Pipe which passes a batch of packets at once
+type BatchPipe interface {
+	Pipe
+	SendBatch(ctx context.Context, batch []*Packet) error
+}
+
+// Controller which handles a batch of packets at once
+type BatchController interface {
+	JointController
+	PushBatch(ctx context.Context, port PortKey, batch []*Packet) error
+}
+
+// Send the batch through the pipe, one by one if the pipe does not support batches.
+// Sending one by one stops at the first failure, returning BatchError.
+func SendBatch(ctx context.Context, pipe Pipe, batch []*Packet) error {
+	if bp, ok := pipe.(BatchPipe); ok {
+		return bp.SendBatch(ctx, batch)
+	}
+	for i, data := range batch {
+		if err := pipe.Send(ctx, data); err != nil {
+			return &BatchError{i, err}
+		}
+	}
+	return nil
+}
+
+// Adapts controllers which only handle single packets
+type batchAdapter struct {
+	JointController
+}
+
+func (self batchAdapter) PushBatch(ctx context.Context, port PortKey, batch []*Packet) error {
+	for i, data := range batch {
+		if err := self.Push(ctx, port, data); err != nil {
+			return &BatchError{i, err}
+		}
+	}
+	return nil
+}
+
+// The controller itself if it handles batches, otherwise an adapter pushing packets one by one
+func AsBatchController(controller JointController) BatchController {
+	if bc, ok := controller.(BatchController); ok {
+		return bc
+	}
+	return batchAdapter{controller}
+}
+
+// observed by MetaGraph.Metrics and Tracer if set
+func (self *MetaJoint) PushBatch(ctx context.Context, port PortKey, batch []*Packet) error {
+	if !self.graph.observed() {
+		return AsBatchController(self.controller).PushBatch(ctx, port, batch)
+	}
+	return self.graph.observePush(self.Key, port, batch, func() error {
+		return AsBatchController(self.controller).PushBatch(ctx, port, batch)
+	})
+}
+
+// for internal use
+func (mg *MetaGraph) SendBatchToNode(ctx context.Context, ep Endpoint, batch []*Packet) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ep.Joint == GRAPH {
+		if out, ok := mg.sinks[ep.Port]; ok {
+			return SendBatch(ctx, out, batch)
+		}
+		err := &UndefinedPort{"graph outlet", ep.Port}
+		mg.TellError(nil, err)
+		return err
+	}
+	downNode, ok := mg.Joints[ep.Joint]
+	if !ok {
+		err := &DispatchFailed{
+			Destination: ep.Joint,
+			Data: batch,
+		}
+		mg.TellError(nil, err)
+		return err
+	}
+	mg.recordHop(batch, ep.Joint)
+	return downNode.PushBatch(ctx, ep.Port, batch)
+}
+
+func (mg *MetaGraph) recordHop(batch []*Packet, key JointKey) {
+	if mg.RecordHops {
+		for _, data := range batch {
+			data.meta.Hops = append(data.meta.Hops, key)
+		}
+	}
+}
+
+// External -- push batch --> Internal
+func (mg *MetaGraph) PushBatch(inlet PortKey, batch []*Packet) error {
+	return mg.PushBatchContext(context.Background(), inlet, batch)
+}
+
+// Push packets at once, batches are kept together through fused and queued bridges.
+func (mg *MetaGraph) PushBatchContext(ctx context.Context, inlet PortKey, batch []*Packet) error {
+	mg.gate.enter(flowPush)
+	defer mg.gate.exit()
+	out, ok := mg.inletPipes[inlet]
+	if !ok {
+		out = mg.PortOutlet(GRAPH, inlet)
+	}
+	if out == nil {
+		err := &PacketUnreachable{DIRECTION_FORWARD, inlet}
+		mg.TellError(nil, err)
+		return err
+	}
+	for _, data := range batch {
+		data.meta.ingest(inlet)
+	}
+	return SendBatch(ctx, out, batch)
+}
+
+func (self *FanOutPipe) SendBatch(ctx context.Context, batch []*Packet) error {
+	branches := make([][]*Packet, len(self.pipes))
+	for i := range branches {
+		branches[i] = make([]*Packet, 0, len(batch))
+	}
+	for _, data := range batch {
+		for i, item := range self.graph.FanOut(data, len(self.pipes)) {
+			branches[i] = append(branches[i], item)
+		}
+	}
+	var firstErr error
+	for i, pipe := range self.pipes {
+		if err := SendBatch(ctx, pipe, branches[i]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (self *fusedPipe) SendBatch(ctx context.Context, batch []*Packet) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	self.graph.recordHop(batch, self.joint.Key)
+	return self.joint.PushBatch(ctx, self.port, batch)
+}
+
+func (self *inlinePipe) SendBatch(ctx context.Context, batch []*Packet) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	self.graph.recordHop(batch, self.key)
+	if !self.graph.observed() {
+		return self.applyBatch(ctx, batch)
+	}
+	return self.graph.observePush(self.key, self.port, batch, func() error {
+		return self.applyBatch(ctx, batch)
+	})
+}
+
+func (self *inlinePipe) applyBatch(ctx context.Context, batch []*Packet) error {
+	out := make([]*Packet, 0, len(batch))
+	for i, data := range batch {
+		result, err := self.fn(data)
+		if err != nil {
+			return &BatchError{i, err}
+		}
+		if result != nil {
+			out = append(out, result)
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return SendBatch(ctx, self.next, out)
+}
+
+func (self *BufferTerminator) SendBatch(ctx context.Context, batch []*Packet) error {
+	for _, data := range batch {
+		self.buf.PushBack(data)
+	}
+	return nil
+}
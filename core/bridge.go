@@ -0,0 +1,550 @@
+package core
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// queue capacity of channel and routine bridges without explicit buffer size
+	DEFAULT_PIPE_BUFFER = 64
+)
+
+var pipeModeNames = map[PipeMode]string{
+	PIPE_DIRECT: "direct",
+	PIPE_CHANNEL: "channel",
+	PIPE_ROUTINE: "routine",
+	PIPE_DEMAND: "demand",
+}
+
+// Name of the mode used in documents
+func (self PipeMode) Name() string {
+	return pipeModeNames[self]
+}
+
+func ParsePipeMode(name string) (PipeMode, error) {
+	for mode, n := range pipeModeNames {
+		if n == name {
+			return mode, nil
+		}
+	}
+	return PIPE_DIRECT, fmt.Errorf("Unknown pipe mode %q", name)
+}
+
+// What a bridge does when its queue is full
+type OverflowPolicy int
+
+const (
+	// wait until the queue has room, or the context is done
+	OVERFLOW_BLOCK OverflowPolicy = iota
+	// discard the oldest queued packet
+	OVERFLOW_DROP_OLDEST
+	// discard the packet being sent
+	OVERFLOW_DROP_NEWEST
+)
+
+var overflowPolicyNames = map[OverflowPolicy]string{
+	OVERFLOW_BLOCK: "block",
+	OVERFLOW_DROP_OLDEST: "drop-oldest",
+	OVERFLOW_DROP_NEWEST: "drop-newest",
+}
+
+func (self OverflowPolicy) String() string {
+	return overflowPolicyNames[self]
+}
+
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	for policy, n := range overflowPolicyNames {
+		if n == name {
+			return policy, nil
+		}
+	}
+	return OVERFLOW_BLOCK, fmt.Errorf("Unknown overflow policy %q", name)
+}
+
+// Queue of a channel or routine bridge.
+// Packets are delivered by a single goroutine in order for channel bridges,
+// and by GOMAXPROCS goroutines without ordering for routine bridges.
+// Deliveries run with a background context, since the sender has already returned.
+// Batches are queued as a whole but capacity is counted in packets, batches larger than the room are split.
+type bridgeQueue struct {
+	// batches queued or being delivered, accessed atomically
+	pending  int64
+	graph    *MetaGraph
+	bridge   *JointBridge
+	capacity int
+	lock     sync.Mutex
+	items    *list.List
+	// packets in items
+	queued   int
+	// signalled when a batch is queued or the queue is closed
+	ready    *sync.Cond
+	// closed and renewed whenever room is made in the queue
+	space    chan struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func newBridgeQueue(graph *MetaGraph, br *JointBridge) *bridgeQueue {
+	workers := 1
+	if br.Mode == PIPE_ROUTINE {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	q := &bridgeQueue{
+		graph: graph,
+		bridge: br,
+		capacity: br.capacity(),
+		items: list.New(),
+		space: make(chan struct{}),
+	}
+	q.ready = sync.NewCond(&q.lock)
+	q.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.run()
+	}
+	return q
+}
+
+type queuedBatch struct {
+	packets []*Packet
+	// seq of the first packet in the write-ahead log, 0 if not logged
+	seq     uint64
+}
+
+// packets of the batch from i on
+func (self queuedBatch) from(i int) queuedBatch {
+	if self.seq != 0 {
+		self.seq += uint64(i)
+	}
+	return queuedBatch{self.packets[i:], self.seq}
+}
+
+// wake senders waiting for room. requires lock
+func (self *bridgeQueue) notifySpace() {
+	close(self.space)
+	self.space = make(chan struct{})
+}
+
+// next batch to deliver, false if the queue is closed and empty
+func (self *bridgeQueue) take() (queuedBatch, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for self.items.Len() == 0 {
+		if self.closed {
+			return queuedBatch{}, false
+		}
+		self.ready.Wait()
+	}
+	item := self.items.Remove(self.items.Front()).(queuedBatch)
+	self.queued -= len(item.packets)
+	self.notifySpace()
+	return item, true
+}
+
+func (self *bridgeQueue) run() {
+	defer self.wg.Done()
+	for {
+		item, ok := self.take()
+		if !ok {
+			return
+		}
+		self.graph.gate.enter(flowInternal)
+		err := self.graph.deliverBatch(context.Background(), self.bridge, item.packets)
+		self.graph.ackDelivered(self.bridge, item.seq, len(item.packets), err)
+		atomic.AddInt64(&self.pending, -1)
+		self.graph.gate.exit()
+		if err != nil {
+			self.graph.TellError(nil, errors.Wrapf(err, "Delivery failed at %s", self.bridge.Repr()))
+		}
+	}
+}
+
+// Logged packets dropped by the overflow policy are acknowledged, since they are not to be delivered.
+// With OVERFLOW_BLOCK, packets queued before ctx is done stay in the queue.
+func (self *bridgeQueue) enqueue(ctx context.Context, batch []*Packet, seq uint64) error {
+	rest := queuedBatch{batch, seq}
+	for len(rest.packets) > 0 {
+		self.lock.Lock()
+		if self.closed {
+			self.lock.Unlock()
+			return &BridgeClosed{self.bridge.Repr()}
+		}
+		if room := self.capacity - self.queued; room > 0 {
+			n := len(rest.packets)
+			if n > room {
+				n = room
+			}
+			self.items.PushBack(queuedBatch{rest.packets[:n], rest.seq})
+			self.queued += n
+			atomic.AddInt64(&self.pending, 1)
+			self.ready.Signal()
+			self.lock.Unlock()
+			rest = rest.from(n)
+			continue
+		}
+		switch self.bridge.Overflow {
+		case OVERFLOW_DROP_NEWEST:
+			self.lock.Unlock()
+			self.drop(rest)
+			return nil
+		case OVERFLOW_DROP_OLDEST:
+			dropped := self.dropOldest(len(rest.packets))
+			self.lock.Unlock()
+			for _, item := range dropped {
+				self.drop(item)
+			}
+			continue
+		}
+		space := self.space
+		self.lock.Unlock()
+		select {
+		case <-space:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// remove up to n packets from the head of the queue. requires lock
+func (self *bridgeQueue) dropOldest(n int) []queuedBatch {
+	var ret []queuedBatch
+	for n > 0 && self.items.Len() > 0 {
+		front := self.items.Front()
+		item := front.Value.(queuedBatch)
+		if len(item.packets) <= n {
+			self.items.Remove(front)
+			atomic.AddInt64(&self.pending, -1)
+			ret = append(ret, item)
+			n -= len(item.packets)
+			self.queued -= len(item.packets)
+			continue
+		}
+		ret = append(ret, queuedBatch{item.packets[:n], item.seq})
+		front.Value = item.from(n)
+		self.queued -= n
+		n = 0
+	}
+	return ret
+}
+
+func (self *bridgeQueue) drop(item queuedBatch) {
+	self.bridge.countDropped(len(item.packets))
+	self.graph.ackLogged(self.bridge, item.seq, len(item.packets))
+}
+
+// Packets waiting in the queue of channel, routine and demand bridges, 0 for direct bridges
+func (self *JointBridge) QueueDepth() int {
+	switch {
+	case self.queue != nil:
+		self.queue.lock.Lock()
+		defer self.queue.lock.Unlock()
+		return self.queue.queued
+	case self.demand != nil:
+		self.demand.lock.Lock()
+		defer self.demand.lock.Unlock()
+		return self.demand.items.Len()
+	default:
+		return 0
+	}
+}
+
+func (self *bridgeQueue) idle() bool {
+	return atomic.LoadInt64(&self.pending) == 0
+}
+
+// stop accepting packets and wait for queued ones to be delivered
+func (self *bridgeQueue) close(ctx context.Context) error {
+	self.lock.Lock()
+	if !self.closed {
+		self.closed = true
+		self.ready.Broadcast()
+		self.notifySpace()
+	}
+	self.lock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		self.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Start queues of channel and routine bridges and buffers of demand bridges,
+// and open logs of durable bridges, called by Concrete
+func (mg *MetaGraph) startBridges() error {
+	for _, br := range mg.Pipes {
+		if br.Durable && br.wal == nil {
+			if br.Mode == PIPE_DEMAND {
+				return fmt.Errorf("Demand bridge can not be durable at %s", br.Repr())
+			}
+			if mg.Wal == nil {
+				return fmt.Errorf("Durable bridge %s requires MetaGraph.Wal", br.Repr())
+			}
+			wal, err := openBridgeLog(filepath.Join(mg.Wal.Dir, br.Name), *mg.Wal)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to open log of %s", br.Repr())
+			}
+			br.wal = wal
+		}
+		switch {
+		case br.queue != nil || br.demand != nil:
+		case br.Mode == PIPE_DEMAND:
+			br.demand = newDemandBuffer(mg, br)
+		case br.Mode != PIPE_DIRECT:
+			br.queue = newBridgeQueue(mg, br)
+		}
+	}
+	return nil
+}
+
+// Stop channel and routine bridges after delivering queued packets, and close logs of durable bridges.
+// Bridges are closed from upstream to downstream, so packets flushed from a bridge reach the next one before it closes.
+// Demand bridges stop accepting packets, packets buffered there can still be pulled.
+func (mg *MetaGraph) Shutdown(ctx context.Context) error {
+	for _, br := range mg.bridgesUpstreamFirst() {
+		if br.demand != nil {
+			br.demand.close()
+		}
+		if br.queue != nil {
+			if err := br.queue.close(ctx); err != nil {
+				return errors.Wrapf(err, "Failed to flush %s", br.Repr())
+			}
+		}
+		if err := br.closeLog(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bridges ordered topologically by their source joints, bridges on cycles come last
+func (mg *MetaGraph) bridgesUpstreamFirst() []*JointBridge {
+	inDegree := make(map[JointKey]int, len(mg.Joints))
+	for _, br := range mg.Pipes {
+		if br.Destination.Joint != GRAPH && br.Source.Joint != GRAPH {
+			inDegree[br.Destination.Joint] += 1
+		}
+	}
+	ret := make([]*JointBridge, 0, len(mg.Pipes))
+	visited := make(map[*JointBridge]bool, len(mg.Pipes))
+	ready := []JointKey{GRAPH}
+	for key := range mg.Joints {
+		if inDegree[key] == 0 {
+			ready = append(ready, key)
+		}
+	}
+	for len(ready) > 0 {
+		key := ready[0]
+		ready = ready[1:]
+		for _, br := range mg.Pipes {
+			if br.Source.Joint != key || visited[br] {
+				continue
+			}
+			visited[br] = true
+			ret = append(ret, br)
+			if br.Destination.Joint != GRAPH && key != GRAPH {
+				inDegree[br.Destination.Joint] -= 1
+				if inDegree[br.Destination.Joint] == 0 {
+					ready = append(ready, br.Destination.Joint)
+				}
+			}
+		}
+	}
+	for _, br := range mg.Pipes {
+		if !visited[br] {
+			ret = append(ret, br)
+		}
+	}
+	return ret
+}
+
+// Bridge which has the name, nil if not found
+func (mg *MetaGraph) Bridge(name string) *JointBridge {
+	for _, br := range mg.Pipes {
+		if br.Name == name {
+			return br
+		}
+	}
+	return nil
+}
+
+// validate and route the packet to the destination of the bridge
+func (mg *MetaGraph) deliver(ctx context.Context, br *JointBridge, data *Packet) error {
+	if err := mg.validateBridge(br.Source, br.Destination, data); err != nil {
+		return err
+	}
+	return mg.SendToNode(ctx, br.Destination, data)
+}
+
+// Packets before the first one violating schemas are delivered, and the violation is returned as *BatchError
+func (mg *MetaGraph) deliverBatch(ctx context.Context, br *JointBridge, batch []*Packet) error {
+	for i, data := range batch {
+		if err := mg.validateBridge(br.Source, br.Destination, data); err != nil {
+			if i > 0 {
+				if sendErr := mg.SendBatchToNode(ctx, br.Destination, batch[:i]); sendErr != nil {
+					return sendErr
+				}
+			}
+			return &BatchError{i, err}
+		}
+	}
+	return mg.SendBatchToNode(ctx, br.Destination, batch)
+}
+
+// Pipe through the bridge, honouring its mode and filter
+type BridgePipe struct {
+	graph  *MetaGraph
+	bridge *JointBridge
+}
+
+func NewBridgePipe(graph *MetaGraph, br *JointBridge) *BridgePipe {
+	return &BridgePipe{
+		graph: graph,
+		bridge: br,
+	}
+}
+
+// Packets not matching the filter are discarded without error.
+// The packet is queued if the bridge is channel or routine mode and has been started by Concrete,
+// waits for credit if the bridge is demand mode, and goes through the fused call path if the bridge is direct and has been fused by Concrete.
+func (self *BridgePipe) Send(ctx context.Context, data *Packet) error {
+	br := self.bridge
+	if br.Filter != nil && !br.Filter.Match(data) {
+		atomic.AddUint64(&br.filtered, 1)
+		return nil
+	}
+	err := self.send(ctx, data)
+	if metrics := self.graph.Metrics; metrics != nil {
+		metrics.ObserveSend(br, 1, err)
+	}
+	return err
+}
+
+func (self *BridgePipe) send(ctx context.Context, data *Packet) error {
+	br := self.bridge
+	if br.wal != nil {
+		return self.graph.sendLogged(ctx, br, []*Packet{data})
+	}
+	if br.queue != nil {
+		return br.queue.enqueue(ctx, []*Packet{data}, 0)
+	}
+	if br.demand != nil {
+		return br.demand.send(ctx, []*Packet{data})
+	}
+	if br.fused != nil {
+		return br.fused.Send(ctx, data)
+	}
+	return self.graph.deliver(ctx, br, data)
+}
+
+// The batch is passed on as a whole, except packets not matching the filter
+func (self *BridgePipe) SendBatch(ctx context.Context, batch []*Packet) error {
+	br := self.bridge
+	if br.Filter != nil {
+		matched := make([]*Packet, 0, len(batch))
+		for _, data := range batch {
+			if br.Filter.Match(data) {
+				matched = append(matched, data)
+			}
+		}
+		atomic.AddUint64(&br.filtered, uint64(len(batch) - len(matched)))
+		batch = matched
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	err := self.sendBatch(ctx, batch)
+	if metrics := self.graph.Metrics; metrics != nil {
+		metrics.ObserveSend(br, len(batch), err)
+	}
+	return err
+}
+
+func (self *BridgePipe) sendBatch(ctx context.Context, batch []*Packet) error {
+	br := self.bridge
+	if br.wal != nil {
+		return self.graph.sendLogged(ctx, br, batch)
+	}
+	if br.queue != nil {
+		return br.queue.enqueue(ctx, batch, 0)
+	}
+	if br.demand != nil {
+		return br.demand.send(ctx, batch)
+	}
+	if br.fused != nil {
+		return SendBatch(ctx, br.fused, batch)
+	}
+	return self.graph.deliverBatch(ctx, br, batch)
+}
+
+// Drained packets not matching the filter are discarded.
+// Demand bridges serve packets from their buffer, without draining upstream.
+func (self *BridgePipe) Drain(ctx context.Context, param *DrainRequest) (*DrainResponse, error) {
+	res, err := self.drain(ctx, param)
+	if metrics := self.graph.Metrics; metrics != nil {
+		returned := 0
+		if res != nil {
+			returned = len(res.Items)
+		}
+		metrics.ObserveDrain(self.bridge, param.Count, returned, err)
+	}
+	return res, err
+}
+
+func (self *BridgePipe) drain(ctx context.Context, param *DrainRequest) (*DrainResponse, error) {
+	br := self.bridge
+	if br.demand != nil {
+		// validated as packets released by credit are
+		items, err := self.admit(br.demand.drain(param.Count))
+		return &DrainResponse{
+			Items: items,
+		}, err
+	}
+	res, err := self.graph.DrainFromNode(ctx, br.Source, param)
+	if res == nil {
+		return res, err
+	}
+	items, invalid := self.admit(res.Items)
+	if err == nil {
+		err = invalid
+	}
+	// a new response, items of res may be kept by upstream
+	return &DrainResponse{
+		Items: items,
+		Interrupted: res.Interrupted,
+	}, err
+}
+
+// Drained packets which pass the filter and schemas of the bridge, in a new slice.
+// Packets violating schemas are dropped, and the first violation is returned.
+func (self *BridgePipe) admit(drained []*Packet) ([]*Packet, error) {
+	br := self.bridge
+	var err error
+	items := make([]*Packet, 0, len(drained))
+	for _, item := range drained {
+		if br.Filter != nil && !br.Filter.Match(item) {
+			atomic.AddUint64(&br.filtered, 1)
+			continue
+		}
+		if invalid := self.graph.validateBridge(br.Source, br.Destination, item); invalid != nil {
+			if err == nil {
+				err = invalid
+			}
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, err
+}
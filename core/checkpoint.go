@@ -0,0 +1,246 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// State of a joint written by Component.Save
+type JointState struct {
+	Component ComponentKey `codec:"component"`
+	State     []byte `codec:"state"`
+}
+
+// Snapshot of a running graph, taken while no packet is moving in it
+type Checkpoint struct {
+	Taken   time.Time `codec:"taken"`
+	// joints which wrote their state
+	Joints  map[JointKey]*JointState `codec:"joints"`
+	// packets waiting in demand bridges, written by WritePackets, keyed by Repr of the bridge
+	Bridges map[string][]byte `codec:"bridges,omitempty"`
+	// epoch committed with this checkpoint, 0 unless taken by CommitEpoch
+	Epoch   uint64 `codec:"epoch,omitempty"`
+	// positions of graph sources implementing OffsetSource
+	Offsets map[PortKey][]byte `codec:"offsets,omitempty"`
+	// entries in state stores of joints, see MetaGraph.JointState
+	States  map[JointKey][]byte `codec:"states,omitempty"`
+}
+
+// Write state of every joint and packets waiting in demand bridges.
+// New Push and Pull wait while packets already inside the graph settle,
+// then the state is written at once, so the checkpoint is consistent across joints.
+func (mg *MetaGraph) TakeCheckpoint(ctx context.Context) (*Checkpoint, error) {
+	if mg.placement == nil {
+		return nil, fmt.Errorf("Checkpoint requires concreted graph")
+	}
+	if err := mg.gate.quiesce(ctx, mg.bridgesIdle); err != nil {
+		return nil, err
+	}
+	defer mg.gate.release()
+	return mg.snapshot()
+}
+
+// requires gate
+func (mg *MetaGraph) snapshot() (*Checkpoint, error) {
+	cp := &Checkpoint{
+		Taken: time.Now(),
+		Joints: make(map[JointKey]*JointState),
+	}
+	for key, joint := range mg.Joints {
+		comp, ok := mg.Universe.Components[joint.Component]
+		if !ok {
+			return nil, fmt.Errorf("Undefined component %s", joint.Component)
+		}
+		var buf bytes.Buffer
+		if err := comp.Save(joint, &buf); err != nil {
+			return nil, errors.Wrapf(err, "Failed to save state of %s", key)
+		}
+		if buf.Len() > 0 {
+			cp.Joints[key] = &JointState{joint.Component, buf.Bytes()}
+		}
+		state, err := mg.saveJointState(key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to save state store of %s", key)
+		}
+		if state != nil {
+			if cp.States == nil {
+				cp.States = make(map[JointKey][]byte)
+			}
+			cp.States[key] = state
+		}
+	}
+	for _, br := range mg.Pipes {
+		if br.demand == nil {
+			continue
+		}
+		br.demand.lock.Lock()
+		packets := make([]*Packet, 0, br.demand.items.Len())
+		for e := br.demand.items.Front(); e != nil; e = e.Next() {
+			packets = append(packets, e.Value.(*Packet))
+		}
+		br.demand.lock.Unlock()
+		if len(packets) == 0 {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := WritePackets(&buf, packets, PacketMsgpackHandle); err != nil {
+			return nil, errors.Wrapf(err, "Failed to save packets in %s", br.Repr())
+		}
+		if cp.Bridges == nil {
+			cp.Bridges = make(map[string][]byte)
+		}
+		cp.Bridges[br.Repr()] = buf.Bytes()
+	}
+	for port, pool := range mg.pools {
+		if src, ok := pool.(OffsetSource); ok {
+			offset, err := src.Offset()
+			if err != nil {
+				return nil, errors.Wrapf(err, "Failed to get offset of source %s", port)
+			}
+			if cp.Offsets == nil {
+				cp.Offsets = make(map[PortKey][]byte)
+			}
+			cp.Offsets[port] = offset
+		}
+	}
+	return cp, nil
+}
+
+// queues of channel and routine bridges are empty. requires gate lock
+func (mg *MetaGraph) bridgesIdle() bool {
+	for _, br := range mg.Pipes {
+		if br.queue != nil && !br.queue.idle() {
+			return false
+		}
+	}
+	return true
+}
+
+// Restore state of joints, packets of demand bridges and offsets of sources from the checkpoint.
+// Joints missing in the graph or built from other components are skipped,
+// so a checkpoint can be restored into a revised graph.
+// State stores of joints are replaced by the checkpoint, emptied if it has no entries of them.
+func (mg *MetaGraph) RestoreCheckpoint(ctx context.Context, cp *Checkpoint) error {
+	if mg.placement == nil {
+		return fmt.Errorf("Restoring checkpoint requires concreted graph")
+	}
+	if err := mg.gate.quiesce(ctx, nil); err != nil {
+		return err
+	}
+	defer mg.gate.release()
+	return mg.restore(cp)
+}
+
+// requires gate
+func (mg *MetaGraph) restore(cp *Checkpoint) error {
+	for key, state := range cp.Joints {
+		joint, ok := mg.Joints[key]
+		if !ok || joint.Component != state.Component {
+			continue
+		}
+		comp, ok := mg.Universe.Components[joint.Component]
+		if !ok {
+			return fmt.Errorf("Undefined component %s", joint.Component)
+		}
+		if err := comp.Restore(joint, bytes.NewReader(state.State)); err != nil {
+			return errors.Wrapf(err, "Failed to restore state of %s", key)
+		}
+	}
+	for key := range mg.Joints {
+		if err := mg.restoreJointState(key, cp.States[key]); err != nil {
+			return errors.Wrapf(err, "Failed to restore state store of %s", key)
+		}
+	}
+	// buffers hold only packets of the checkpoint, emptied if it has none of them
+	for _, br := range mg.Pipes {
+		if br.demand == nil {
+			continue
+		}
+		var packets []*Packet
+		if data, ok := cp.Bridges[br.Repr()]; ok {
+			var err error
+			packets, err = ReadPackets(bytes.NewReader(data), PacketMsgpackHandle)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to restore packets in %s", br.Repr())
+			}
+		}
+		br.demand.reset(packets)
+	}
+	for port, offset := range cp.Offsets {
+		if src, ok := mg.pools[port].(OffsetSource); ok {
+			if err := src.Seek(offset); err != nil {
+				return errors.Wrapf(err, "Failed to seek source %s", port)
+			}
+		}
+	}
+	return nil
+}
+
+func (mg *MetaGraph) checkpointStorage() (CheckpointStorage, error) {
+	if mg.Universe == nil {
+		return nil, &UnsupportedOperation{"graph without universe", "checkpoints"}
+	}
+	cs, ok := mg.Universe.Storage.(CheckpointStorage)
+	if !ok {
+		return nil, &UnsupportedOperation{fmt.Sprintf("%T", mg.Universe.Storage), "checkpoints"}
+	}
+	return cs, nil
+}
+
+// Take a checkpoint and store it under the key through the storage of the universe
+func (mg *MetaGraph) SaveCheckpoint(ctx context.Context, key string) error {
+	cs, err := mg.checkpointStorage()
+	if err != nil {
+		return err
+	}
+	cp, err := mg.TakeCheckpoint(ctx)
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(cs.SaveCheckpoint(key, cp), "Failed to store checkpoint %s", key)
+}
+
+// Restore the checkpoint stored under the key, false if nothing is stored.
+// Call after Concrete of the loaded graph.
+func (mg *MetaGraph) LoadCheckpoint(ctx context.Context, key string) (bool, error) {
+	cs, err := mg.checkpointStorage()
+	if err != nil {
+		return false, err
+	}
+	cp, err := cs.LoadCheckpoint(key)
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to read checkpoint %s", key)
+	}
+	if cp == nil {
+		return false, nil
+	}
+	return true, mg.RestoreCheckpoint(ctx, cp)
+}
+
+// Save a checkpoint under the key every interval until ctx is done.
+// Failures are reported by TellError, later checkpoints are still taken.
+func (mg *MetaGraph) RunCheckpoints(ctx context.Context, key string, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		if err := mg.SaveCheckpoint(ctx, key); err != nil && ctx.Err() == nil {
+			mg.TellError(nil, err)
+		}
+	}
+}
+
+// Shutdown, then save a checkpoint of the stopped graph under the key
+func (mg *MetaGraph) ShutdownWithCheckpoint(ctx context.Context, key string) error {
+	if err := mg.Shutdown(ctx); err != nil {
+		return err
+	}
+	return mg.SaveCheckpoint(ctx, key)
+}
@@ -1,8 +1,10 @@
 package core
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/ugorji/go/codec"
+	"io"
 )
 
 type ComponentKey string
@@ -23,12 +25,18 @@ type Component interface {
 	DecodeParam(decoder *codec.Decoder, data json.RawMessage) (ComponentParam, error)
 	Name() ComponentKey
 	CreateController(metaJoint *MetaJoint, param interface{}, graph *MetaGraph) (JointController, error)
-	Save(joint *MetaJoint)
-	Restore()
+	// Write state of the controller of the joint, see MetaGraph.TakeCheckpoint.
+	// Stateless components write nothing. Called while no packet is moving in the graph.
+	Save(joint *MetaJoint, writer io.Writer) error
+	// Read state written by Save into the controller of the joint, after the controller is concreted
+	Restore(joint *MetaJoint, reader io.Reader) error
 }
 
+// JointController does actual work of a joint.
+// Errors returned from Push and Pull travel back to the caller of MetaGraph.Push/Pull,
+// so that the caller can know whether its packet was delivered.
 type JointController interface {
-	Push(port PortKey, data *Packet)
-	Pull(port PortKey, param *DrainRequest) *DrainResponse
+	Push(ctx context.Context, port PortKey, data *Packet) error
+	Pull(ctx context.Context, port PortKey, param *DrainRequest) (*DrainResponse, error)
 	Concrete(self *MetaJoint, graph *MetaGraph) error
 }
@@ -4,9 +4,9 @@ package core
 
 import "fmt"
 
-const _PipeMode_name = "PIPE_DIRECTPIPE_CHANNELPIPE_ROUTINE"
+const _PipeMode_name = "PIPE_DIRECTPIPE_CHANNELPIPE_ROUTINEPIPE_DEMAND"
 
-var _PipeMode_index = [...]uint8{0, 11, 23, 35}
+var _PipeMode_index = [...]uint8{0, 11, 23, 35, 46}
 
 func (i PipeMode) String() string {
 	if i < 0 || i >= PipeMode(len(_PipeMode_index)-1) {
@@ -0,0 +1,232 @@
+package core
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// Controller which decides how credit given at its outlet propagates upstream.
+// Credit to controllers without this interface is passed to every inlet of the joint.
+type DemandController interface {
+	JointController
+	// downstream of the outlet port is ready to receive n more packets
+	Request(ctx context.Context, port PortKey, n int) error
+}
+
+// Boundary buffer of a demand bridge.
+// Pushed packets wait here until downstream gives credit or pulls them.
+type demandBuffer struct {
+	graph    *MetaGraph
+	bridge   *JointBridge
+	lock     sync.Mutex
+	items    *list.List
+	credit   int
+	capacity int
+	closed   bool
+	// true while a goroutine is pushing packets downstream, keeps them in order
+	flushing bool
+	// closed and renewed whenever room is made in the buffer
+	space    chan struct{}
+}
+
+func newDemandBuffer(graph *MetaGraph, br *JointBridge) *demandBuffer {
+	return &demandBuffer{
+		graph: graph,
+		bridge: br,
+		items: list.New(),
+		capacity: br.capacity(),
+		space: make(chan struct{}),
+	}
+}
+
+// Buffer the batch according to the overflow policy, then pass as many as credit allows downstream
+func (self *demandBuffer) send(ctx context.Context, batch []*Packet) error {
+	for _, data := range batch {
+		if err := self.put(ctx, data); err != nil {
+			return err
+		}
+	}
+	return self.flush(ctx)
+}
+
+func (self *demandBuffer) put(ctx context.Context, data *Packet) error {
+	for {
+		self.lock.Lock()
+		if self.closed {
+			self.lock.Unlock()
+			return &BridgeClosed{self.bridge.Repr()}
+		}
+		if self.items.Len() < self.capacity {
+			self.items.PushBack(data)
+			self.lock.Unlock()
+			return nil
+		}
+		switch self.bridge.Overflow {
+		case OVERFLOW_DROP_NEWEST:
+			self.lock.Unlock()
+			self.bridge.countDropped(1)
+			return nil
+		case OVERFLOW_DROP_OLDEST:
+			self.items.Remove(self.items.Front())
+			self.items.PushBack(data)
+			self.lock.Unlock()
+			self.bridge.countDropped(1)
+			return nil
+		}
+		space := self.space
+		self.lock.Unlock()
+		// the buffer is full and nobody has given credit, wait for pull or credit
+		self.graph.gate.stall()
+		select {
+		case <-space:
+		case <-ctx.Done():
+		}
+		self.graph.gate.unstall()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// take up to n packets, 0 --> all. requires lock
+func (self *demandBuffer) take(n int) []*Packet {
+	if n <= 0 || n > self.items.Len() {
+		n = self.items.Len()
+	}
+	ret := make([]*Packet, 0, n)
+	for i := 0; i < n; i++ {
+		ret = append(ret, self.items.Remove(self.items.Front()).(*Packet))
+	}
+	if n > 0 {
+		close(self.space)
+		self.space = make(chan struct{})
+	}
+	return ret
+}
+
+// push buffered packets downstream while there is credit
+func (self *demandBuffer) flush(ctx context.Context) error {
+	self.lock.Lock()
+	if self.flushing {
+		// the running flush picks up the packets
+		self.lock.Unlock()
+		return nil
+	}
+	self.flushing = true
+	for self.credit > 0 && self.items.Len() > 0 {
+		batch := self.take(self.credit)
+		self.credit -= len(batch)
+		self.lock.Unlock()
+		err := self.graph.deliverBatch(ctx, self.bridge, batch)
+		self.lock.Lock()
+		if err != nil {
+			self.flushing = false
+			self.lock.Unlock()
+			return err
+		}
+	}
+	self.flushing = false
+	self.lock.Unlock()
+	return nil
+}
+
+func (self *demandBuffer) request(ctx context.Context, n int) error {
+	self.lock.Lock()
+	self.credit += n
+	self.lock.Unlock()
+	return self.flush(ctx)
+}
+
+func (self *demandBuffer) drain(n int) []*Packet {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.take(n)
+}
+
+// replace buffered packets by the ones restored from a checkpoint
+func (self *demandBuffer) reset(packets []*Packet) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.items.Init()
+	for _, pkt := range packets {
+		self.items.PushBack(pkt)
+	}
+	close(self.space)
+	self.space = make(chan struct{})
+}
+
+func (self *demandBuffer) close() {
+	self.lock.Lock()
+	self.closed = true
+	self.lock.Unlock()
+}
+
+// number of packets waiting in the boundary buffer of demand bridge
+func (self *JointBridge) Pending() int {
+	if self.demand == nil {
+		return 0
+	}
+	self.demand.lock.Lock()
+	defer self.demand.lock.Unlock()
+	return self.demand.items.Len()
+}
+
+// credit given to demand bridge and not used yet
+func (self *JointBridge) Credit() int {
+	if self.demand == nil {
+		return 0
+	}
+	self.demand.lock.Lock()
+	defer self.demand.lock.Unlock()
+	return self.demand.credit
+}
+
+// Consumer of the graph outlet is ready to receive n more packets.
+func (mg *MetaGraph) Request(ctx context.Context, outlet PortKey, n int) error {
+	mg.gate.enter(flowDrain)
+	defer mg.gate.exit()
+	return mg.request(ctx, Endpoint{GRAPH, outlet}, n, make(map[Endpoint]bool))
+}
+
+// Give credit of n packets to bridges into the endpoint, for controllers.
+// Credit reaching a demand bridge releases packets buffered there,
+// credit reaching a joint goes on to its inlets, see DemandController.
+func (mg *MetaGraph) RequestAt(ctx context.Context, ep Endpoint, n int) error {
+	mg.gate.enter(flowInternal)
+	defer mg.gate.exit()
+	return mg.request(ctx, ep, n, make(map[Endpoint]bool))
+}
+
+func (mg *MetaGraph) request(ctx context.Context, ep Endpoint, n int, visited map[Endpoint]bool) error {
+	if visited[ep] {
+		// cycle
+		return nil
+	}
+	visited[ep] = true
+	for _, br := range mg.SelectBridges(JOINT_ANY, PORT_ANY, ep.Joint, ep.Port) {
+		if br.demand != nil {
+			if err := br.demand.request(ctx, n); err != nil {
+				return err
+			}
+			continue
+		}
+		if br.Source.Joint == GRAPH {
+			continue
+		}
+		joint, ok := mg.Joints[br.Source.Joint]
+		if !ok || joint.controller == nil {
+			continue
+		}
+		if dc, ok := joint.controller.(DemandController); ok {
+			if err := dc.Request(ctx, br.Source.Port, n); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := mg.request(ctx, Endpoint{joint.Key, PORT_ANY}, n, visited); err != nil {
+			return err
+		}
+	}
+	return nil
+}
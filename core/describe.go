@@ -0,0 +1,249 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/ugorji/go/codec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Structure of a graph for tooling, see MetaGraph.Describe
+type GraphDescription struct {
+	// graph ports which packets enter from, and leave to
+	Inlets  []PortKey
+	Outlets []PortKey
+	// ordered by key
+	Joints  []*JointDescription
+	// in order of MetaGraph.Pipes
+	Bridges []*BridgeDescription
+}
+
+type JointDescription struct {
+	Key       JointKey
+	Component ComponentKey
+	Param     ComponentParam
+	// Param in JSON, empty if the component takes no param
+	ParamJson string
+	// ports which have bridges
+	Inlets    []PortKey
+	Outlets   []PortKey
+}
+
+type BridgeDescription struct {
+	Name        string
+	Source      Endpoint
+	Destination Endpoint
+	// mode decided by the planner if AutoMode and the graph is concreted
+	Mode        PipeMode
+	AutoMode    bool
+	Buffer      int
+	Overflow    OverflowPolicy
+	// expression of the filter, empty if every packet passes
+	Filter      string
+	Durable     bool
+	Filtered    uint64
+	Dropped     uint64
+}
+
+func appendPortOnce(ports []PortKey, port PortKey) []PortKey {
+	for _, p := range ports {
+		if p == port {
+			return ports
+		}
+	}
+	return append(ports, port)
+}
+
+func sortPorts(ports []PortKey) {
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i] < ports[j]
+	})
+}
+
+// Joints with ports resolved from bridges, and bridges with their modes and counters.
+// Not safe against concurrent Mutate.
+func (mg *MetaGraph) Describe() (*GraphDescription, error) {
+	ret := &GraphDescription{}
+	joints := make(map[JointKey]*JointDescription, len(mg.Joints))
+	for key, joint := range mg.Joints {
+		jd := &JointDescription{
+			Key: key,
+			Component: joint.Component,
+			Param: joint.Param,
+		}
+		if _, empty := joint.Param.(*EmptyComponentParam); joint.Param != nil && !empty {
+			var buf bytes.Buffer
+			if err := codec.NewEncoder(&buf, PacketJsonHandle).Encode(joint.Param); err != nil {
+				return nil, errors.Wrapf(err, "Failed to encode param of joint %s", key)
+			}
+			jd.ParamJson = strings.TrimSpace(buf.String())
+		}
+		joints[key] = jd
+		ret.Joints = append(ret.Joints, jd)
+	}
+	sort.Slice(ret.Joints, func(i, j int) bool {
+		return ret.Joints[i].Key < ret.Joints[j].Key
+	})
+	for _, br := range mg.Pipes {
+		bd := &BridgeDescription{
+			Name: br.Name,
+			Source: br.Source,
+			Destination: br.Destination,
+			Mode: br.Mode,
+			AutoMode: br.AutoMode,
+			Buffer: br.Buffer,
+			Overflow: br.Overflow,
+			Durable: br.Durable,
+			Filtered: br.Filtered(),
+			Dropped: br.Dropped(),
+		}
+		if br.Filter != nil {
+			bd.Filter = br.Filter.String()
+		}
+		ret.Bridges = append(ret.Bridges, bd)
+		if br.Source.Joint == GRAPH {
+			ret.Inlets = appendPortOnce(ret.Inlets, br.Source.Port)
+		} else if jd, ok := joints[br.Source.Joint]; ok {
+			jd.Outlets = appendPortOnce(jd.Outlets, br.Source.Port)
+		}
+		if br.Destination.Joint == GRAPH {
+			ret.Outlets = appendPortOnce(ret.Outlets, br.Destination.Port)
+		} else if jd, ok := joints[br.Destination.Joint]; ok {
+			jd.Inlets = appendPortOnce(jd.Inlets, br.Destination.Port)
+		}
+	}
+	sortPorts(ret.Inlets)
+	sortPorts(ret.Outlets)
+	for _, jd := range ret.Joints {
+		sortPorts(jd.Inlets)
+		sortPorts(jd.Outlets)
+	}
+	return ret, nil
+}
+
+// node of a drawn graph, a joint or a graph port
+type describeNode struct {
+	joint  JointKey
+	port   PortKey
+	outlet bool
+}
+
+// node IDs of joints and graph ports, in order of inlets, joints and outlets
+func (self *GraphDescription) nodeIDs() (map[describeNode]string, []describeNode) {
+	ids := make(map[describeNode]string)
+	var order []describeNode
+	add := func(node describeNode) {
+		ids[node] = fmt.Sprintf("n%d", len(order))
+		order = append(order, node)
+	}
+	for _, port := range self.Inlets {
+		add(describeNode{GRAPH, port, false})
+	}
+	for _, jd := range self.Joints {
+		add(describeNode{jd.Key, PORT_EMPTY, false})
+	}
+	for _, port := range self.Outlets {
+		add(describeNode{GRAPH, port, true})
+	}
+	return ids, order
+}
+
+// nodes at both ends of the bridge
+func (self *BridgeDescription) nodes() (describeNode, describeNode) {
+	src := describeNode{self.Source.Joint, PORT_EMPTY, false}
+	if self.Source.Joint == GRAPH {
+		src.port = self.Source.Port
+	}
+	dst := describeNode{self.Destination.Joint, PORT_EMPTY, false}
+	if self.Destination.Joint == GRAPH {
+		dst = describeNode{GRAPH, self.Destination.Port, true}
+	}
+	return src, dst
+}
+
+// ports and mode of the bridge, ports of graph boundaries are left out
+func (self *BridgeDescription) label() string {
+	var ports []string
+	if self.Source.Joint != GRAPH {
+		ports = append(ports, string(self.Source.Port))
+	}
+	if self.Destination.Joint != GRAPH {
+		ports = append(ports, string(self.Destination.Port))
+	}
+	label := strings.Join(ports, " -> ")
+	if self.Name != "" {
+		label = self.Name + " " + label
+	}
+	mode := self.Mode.Name()
+	if self.Durable {
+		mode += ", durable"
+	}
+	if self.Filter != "" {
+		mode += ", " + self.Filter
+	}
+	return strings.TrimSpace(label + " (" + mode + ")")
+}
+
+func (self *GraphDescription) jointLabel(key JointKey) string {
+	for _, jd := range self.Joints {
+		if jd.Key == key {
+			return fmt.Sprintf("%s\n%s", jd.Key, jd.Component)
+		}
+	}
+	return string(key)
+}
+
+// Graphviz DOT, graph inlets and outlets are drawn as boundary nodes
+func (self *GraphDescription) Dot() string {
+	var buf bytes.Buffer
+	ids, order := self.nodeIDs()
+	buf.WriteString("digraph pipenet {\n")
+	buf.WriteString("  rankdir=LR;\n")
+	for _, node := range order {
+		if node.joint == GRAPH {
+			fmt.Fprintf(&buf, "  %s [shape=cds, label=%s];\n", ids[node], strconv.Quote(string(node.port)))
+			continue
+		}
+		attrs := fmt.Sprintf("shape=box, label=%s", strconv.Quote(self.jointLabel(node.joint)))
+		for _, jd := range self.Joints {
+			if jd.Key == node.joint && jd.ParamJson != "" {
+				attrs += fmt.Sprintf(", tooltip=%s", strconv.Quote(jd.ParamJson))
+			}
+		}
+		fmt.Fprintf(&buf, "  %s [%s];\n", ids[node], attrs)
+	}
+	for _, bd := range self.Bridges {
+		src, dst := bd.nodes()
+		fmt.Fprintf(&buf, "  %s -> %s [label=%s];\n", ids[src], ids[dst], strconv.Quote(bd.label()))
+	}
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
+// text in double quotes of mermaid
+func mermaidQuote(s string) string {
+	s = strings.Replace(s, "\"", "#quot;", -1)
+	return "\"" + strings.Replace(s, "\n", "<br/>", -1) + "\""
+}
+
+// Mermaid flowchart, graph inlets and outlets are drawn as boundary nodes
+func (self *GraphDescription) Mermaid() string {
+	var buf bytes.Buffer
+	ids, order := self.nodeIDs()
+	buf.WriteString("flowchart LR\n")
+	for _, node := range order {
+		if node.joint == GRAPH {
+			fmt.Fprintf(&buf, "  %s([%s])\n", ids[node], mermaidQuote(string(node.port)))
+		} else {
+			fmt.Fprintf(&buf, "  %s[%s]\n", ids[node], mermaidQuote(self.jointLabel(node.joint)))
+		}
+	}
+	for _, bd := range self.Bridges {
+		src, dst := bd.nodes()
+		fmt.Fprintf(&buf, "  %s -->|%s| %s\n", ids[src], mermaidQuote(bd.label()), ids[dst])
+	}
+	return buf.String()
+}
@@ -19,10 +19,17 @@ func (self *DispatchFailed) Error() string {
 // Packet routing fail
 // caused by graph topology or port missing
 type PacketUnreachable struct {
+	Direction PortDirection
+	Port      PortKey
 }
 
 func (self *PacketUnreachable) Error() string {
-	return fmt.Sprintf("Unreachable: ") // TODO: decide spec of this error
+	switch self.Direction {
+	case DIRECTION_BACKWARD:
+		return fmt.Sprintf("Unreachable: no bridge to graph outlet %s", self.Port)
+	default:
+		return fmt.Sprintf("Unreachable: no bridge from graph inlet %s", self.Port)
+	}
 }
 
 type UndefinedPort struct {
@@ -33,3 +40,59 @@ type UndefinedPort struct {
 func (self *UndefinedPort) Error() string {
 	return fmt.Sprintf("Port %s undefined at %s", self.Port, self.At)
 }
+
+// Operation which the pipe does not support
+// e.g. Drain from output only pipe
+type UnsupportedOperation struct {
+	At        string
+	Operation string
+}
+
+func (self *UnsupportedOperation) Error() string {
+	return fmt.Sprintf("%s does not support %s", self.At, self.Operation)
+}
+
+// Packet does not satisfy the schema declared at the port
+type SchemaViolation struct {
+	At     Endpoint
+	Path   string
+	Reason string
+}
+
+func (self *SchemaViolation) Error() string {
+	return fmt.Sprintf("Schema violation at %s, field %s: %s", self.At, self.Path, self.Reason)
+}
+
+// Schemas at both ends of a bridge do not match
+type SchemaIncompatible struct {
+	Bridge string
+	Path   string
+	Reason string
+}
+
+func (self *SchemaIncompatible) Error() string {
+	return fmt.Sprintf("Incompatible schema at %s, field %s: %s", self.Bridge, self.Path, self.Reason)
+}
+
+// Packet sent to a bridge after the graph was shut down
+type BridgeClosed struct {
+	Bridge string
+}
+
+func (self *BridgeClosed) Error() string {
+	return fmt.Sprintf("Bridge %s is closed", self.Bridge)
+}
+
+// Failure in the middle of a batch, packets before Index were delivered
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (self *BatchError) Error() string {
+	return fmt.Sprintf("Failed at packet #%d of batch: %v", self.Index, self.Err)
+}
+
+func (self *BatchError) Cause() error {
+	return self.Err
+}
@@ -0,0 +1,407 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Boolean expression on fields of packets, used to filter packets passing a bridge.
+//
+//   expr    := or
+//   or      := and ("||" and)*
+//   and     := unary ("&&" unary)*
+//   unary   := "!" unary | compare
+//   compare := operand (("==" | "!=" | "<" | "<=" | ">" | ">=") operand)?
+//   operand := literal | field | "(" expr ")"
+//
+// Fields are dotted paths into the payload (e.g. attr.count), missing fields are null.
+// Literals are numbers, quoted strings, true, false and null.
+// An operand without comparison is true unless it is null, false, zero or empty.
+type Filter struct {
+	source string
+	root   filterNode
+}
+
+func ParseFilter(source string) (*Filter, error) {
+	p := &filterParser{
+		source: source,
+	}
+	if err := p.tokenize(); err != nil {
+		return nil, err
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, p.errorf("unexpected %s", p.tokens[p.pos].text)
+	}
+	return &Filter{
+		source: source,
+		root: root,
+	}, nil
+}
+
+func (self *Filter) String() string {
+	return self.source
+}
+
+func (self *Filter) Match(data *Packet) bool {
+	return truthy(self.root.eval(data))
+}
+
+type filterNode interface {
+	eval(data *Packet) interface{}
+}
+
+type filterLiteral struct {
+	value interface{}
+}
+
+func (self *filterLiteral) eval(data *Packet) interface{} {
+	return self.value
+}
+
+type filterField struct {
+	path []string
+}
+
+func (self *filterField) eval(data *Packet) interface{} {
+	value, ok := data.Get(self.path[0])
+	if !ok {
+		return nil
+	}
+	for _, key := range self.path[1:] {
+		rv := reflect.ValueOf(value)
+		if rv.Kind() != reflect.Map || rv.Type().Key().Kind() != reflect.String {
+			return nil
+		}
+		child := rv.MapIndex(reflect.ValueOf(key).Convert(rv.Type().Key()))
+		if !child.IsValid() {
+			return nil
+		}
+		value = child.Interface()
+	}
+	return value
+}
+
+type filterNot struct {
+	operand filterNode
+}
+
+func (self *filterNot) eval(data *Packet) interface{} {
+	return !truthy(self.operand.eval(data))
+}
+
+type filterLogical struct {
+	and         bool
+	left, right filterNode
+}
+
+func (self *filterLogical) eval(data *Packet) interface{} {
+	left := truthy(self.left.eval(data))
+	if left != self.and {
+		// short circuit
+		return left
+	}
+	return truthy(self.right.eval(data))
+}
+
+type filterCompare struct {
+	op          string
+	left, right filterNode
+}
+
+func (self *filterCompare) eval(data *Packet) interface{} {
+	left, right := self.left.eval(data), self.right.eval(data)
+	lf, lNum := toFloat(left)
+	rf, rNum := toFloat(right)
+	switch {
+	case lNum && rNum:
+		return compareOrdered(self.op, lf < rf, lf == rf)
+	case isString(left) && isString(right):
+		ls, rs := reflect.ValueOf(left).String(), reflect.ValueOf(right).String()
+		return compareOrdered(self.op, ls < rs, ls == rs)
+	default:
+		// values of different kinds are only equal if they are deeply equal
+		equal := reflect.DeepEqual(left, right)
+		switch self.op {
+		case "==":
+			return equal
+		case "!=":
+			return !equal
+		default:
+			return false
+		}
+	}
+}
+
+func compareOrdered(op string, less, equal bool) bool {
+	switch op {
+	case "==":
+		return equal
+	case "!=":
+		return !equal
+	case "<":
+		return less
+	case "<=":
+		return less || equal
+	case ">":
+		return !less && !equal
+	default:
+		return !less
+	}
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch {
+	case !rv.IsValid():
+		return 0, false
+	case reflect.Int <= rv.Kind() && rv.Kind() <= reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint <= rv.Kind() && rv.Kind() <= reflect.Uint64:
+		return float64(rv.Uint()), true
+	case rv.Kind() == reflect.Float32 || rv.Kind() == reflect.Float64:
+		return rv.Float(), true
+	default:
+		return 0, false
+	}
+}
+
+func isString(v interface{}) bool {
+	return v != nil && reflect.ValueOf(v).Kind() == reflect.String
+}
+
+func truthy(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+	if f, ok := toFloat(v); ok {
+		return f != 0
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool:
+		return rv.Bool()
+	case reflect.String, reflect.Map, reflect.Slice, reflect.Array:
+		return rv.Len() != 0
+	case reflect.Ptr, reflect.Interface:
+		return !rv.IsNil()
+	default:
+		return true
+	}
+}
+
+type filterTokenKind int
+
+const (
+	tokenOperator filterTokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+	// string literal without quotes
+	value string
+	pos  int
+}
+
+type filterParser struct {
+	source string
+	tokens []filterToken
+	pos    int
+}
+
+func (self *filterParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Invalid filter %q: %s", self.source, fmt.Sprintf(format, args...))
+}
+
+var filterOperators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")"}
+
+func (self *filterParser) tokenize() error {
+	s := self.source
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '\'':
+			end := i + 1
+			escaped := false
+			for ; end < len(s); end++ {
+				if escaped {
+					escaped = false
+				} else if s[end] == '\\' {
+					escaped = true
+				} else if rune(s[end]) == c {
+					break
+				}
+			}
+			if end >= len(s) {
+				return self.errorf("unterminated string at %d", i)
+			}
+			text := s[i:end + 1]
+			quoted := text
+			if c == '\'' {
+				quoted = `"` + strings.Replace(strings.Replace(text[1:len(text) - 1], `\'`, `'`, -1), `"`, `\"`, -1) + `"`
+			}
+			value, err := strconv.Unquote(quoted)
+			if err != nil {
+				return self.errorf("invalid string %s", text)
+			}
+			self.tokens = append(self.tokens, filterToken{tokenString, text, value, i})
+			i = end + 1
+		case unicode.IsDigit(c) || (c == '-' && i + 1 < len(s) && unicode.IsDigit(rune(s[i + 1]))):
+			end := i + 1
+			for end < len(s) && (unicode.IsDigit(rune(s[end])) || strings.ContainsRune(".eE+-", rune(s[end]))) {
+				end++
+			}
+			self.tokens = append(self.tokens, filterToken{tokenNumber, s[i:end], "", i})
+			i = end
+		case unicode.IsLetter(c) || c == '_':
+			end := i + 1
+			for end < len(s) && (unicode.IsLetter(rune(s[end])) || unicode.IsDigit(rune(s[end])) || s[end] == '_' || s[end] == '.') {
+				end++
+			}
+			self.tokens = append(self.tokens, filterToken{tokenIdent, s[i:end], "", i})
+			i = end
+		default:
+			matched := false
+			for _, op := range filterOperators {
+				if strings.HasPrefix(s[i:], op) {
+					self.tokens = append(self.tokens, filterToken{tokenOperator, op, "", i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return self.errorf("unexpected character %q at %d", c, i)
+			}
+		}
+	}
+	return nil
+}
+
+// consume the operator if it comes next
+func (self *filterParser) accept(ops ...string) (string, bool) {
+	if self.pos >= len(self.tokens) || self.tokens[self.pos].kind != tokenOperator {
+		return "", false
+	}
+	for _, op := range ops {
+		if self.tokens[self.pos].text == op {
+			self.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (self *filterParser) parseOr() (filterNode, error) {
+	left, err := self.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := self.accept("||"); !ok {
+			return left, nil
+		}
+		right, err := self.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterLogical{false, left, right}
+	}
+}
+
+func (self *filterParser) parseAnd() (filterNode, error) {
+	left, err := self.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := self.accept("&&"); !ok {
+			return left, nil
+		}
+		right, err := self.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterLogical{true, left, right}
+	}
+}
+
+func (self *filterParser) parseUnary() (filterNode, error) {
+	if _, ok := self.accept("!"); ok {
+		operand, err := self.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &filterNot{operand}, nil
+	}
+	return self.parseCompare()
+}
+
+func (self *filterParser) parseCompare() (filterNode, error) {
+	left, err := self.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := self.accept("==", "!=", "<=", ">=", "<", ">")
+	if !ok {
+		return left, nil
+	}
+	right, err := self.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return &filterCompare{op, left, right}, nil
+}
+
+func (self *filterParser) parseOperand() (filterNode, error) {
+	if self.pos >= len(self.tokens) {
+		return nil, self.errorf("unexpected end")
+	}
+	if _, ok := self.accept("("); ok {
+		inner, err := self.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := self.accept(")"); !ok {
+			return nil, self.errorf("missing )")
+		}
+		return inner, nil
+	}
+	tok := self.tokens[self.pos]
+	self.pos++
+	switch tok.kind {
+	case tokenString:
+		return &filterLiteral{tok.value}, nil
+	case tokenNumber:
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, self.errorf("invalid number %s", tok.text)
+		}
+		return &filterLiteral{f}, nil
+	case tokenIdent:
+		switch tok.text {
+		case "true":
+			return &filterLiteral{true}, nil
+		case "false":
+			return &filterLiteral{false}, nil
+		case "null":
+			return &filterLiteral{nil}, nil
+		default:
+			return &filterField{strings.Split(tok.text, ".")}, nil
+		}
+	default:
+		return nil, self.errorf("unexpected %s at %d", tok.text, tok.pos)
+	}
+}
@@ -0,0 +1,38 @@
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	assert := assert.New(t)
+	pkt := NewPacket()
+	pkt.Set("level", "error")
+	pkt.Set("count", 3)
+	pkt.Set("attr", map[string]interface{}{"ratio": 0.5, "tags": []interface{}{}})
+	exprAndExpected := map[string]bool{
+		`level == "error"`: true,
+		`level == 'warn' || count >= 3`: true,
+		`count > 3`: false,
+		`count != 3.0`: false,
+		`attr.ratio < 1 && !attr.tags`: true,
+		`missing == null`: true,
+		`missing`: false,
+		`!(level == "error" && count == 3)`: false,
+		`level < 3`: false,
+		`attr.ratio.deep == null`: true,
+		`count > -1`: true,
+	}
+	for expr, expected := range exprAndExpected {
+		filter, err := ParseFilter(expr)
+		if assert.NoError(err, expr) {
+			assert.Equal(expected, filter.Match(pkt), expr)
+			assert.Equal(expr, filter.String())
+		}
+	}
+	for _, expr := range []string{"", "level ==", "(count > 1", "level = 'x'", `"unterminated`, "count > 1 2"} {
+		_, err := ParseFilter(expr)
+		assert.Error(err, expr)
+	}
+}
@@ -0,0 +1,129 @@
+package core
+
+import (
+	"context"
+)
+
+// Controller of a stage which maps each packet independently, without state.
+// Fused call paths call the function directly instead of Push,
+// and send its result to the outlet port of the stage without going through the controller.
+type InlineController interface {
+	JointController
+	// Function applied to packets pushed into the port, and the port its results go out from.
+	// Returning nil packet discards it. ok is false if the port can not be inlined in current configuration.
+	// Called after Concrete of the controller.
+	InlineFunc(port PortKey) (fn func(data *Packet) (*Packet, error), outlet PortKey, ok bool)
+}
+
+// Pipe bound straight to the destination joint
+type fusedPipe struct {
+	graph *MetaGraph
+	joint *MetaJoint
+	port  PortKey
+}
+
+func (self *fusedPipe) Send(ctx context.Context, data *Packet) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if self.graph.RecordHops {
+		data.meta.Hops = append(data.meta.Hops, self.joint.Key)
+	}
+	return self.joint.Push(ctx, self.port, data)
+}
+
+func (self *fusedPipe) Drain(ctx context.Context, param *DrainRequest) (*DrainResponse, error) {
+	return nil, &UnsupportedOperation{"fusedPipe", "Drain"}
+}
+
+// Pipe applying the function of the inlined stage, then sending the result to the outlet of the stage
+type inlinePipe struct {
+	graph *MetaGraph
+	key   JointKey
+	port  PortKey
+	fn    func(data *Packet) (*Packet, error)
+	next  Pipe
+}
+
+func (self *inlinePipe) Send(ctx context.Context, data *Packet) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if self.graph.RecordHops {
+		data.meta.Hops = append(data.meta.Hops, self.key)
+	}
+	if !self.graph.observed() {
+		return self.apply(ctx, data)
+	}
+	return self.graph.observePush(self.key, self.port, []*Packet{data}, func() error {
+		return self.apply(ctx, data)
+	})
+}
+
+func (self *inlinePipe) apply(ctx context.Context, data *Packet) error {
+	out, err := self.fn(data)
+	if err != nil || out == nil {
+		return err
+	}
+	return self.next.Send(ctx, out)
+}
+
+func (self *inlinePipe) Drain(ctx context.Context, param *DrainRequest) (*DrainResponse, error) {
+	return nil, &UnsupportedOperation{"inlinePipe", "Drain"}
+}
+
+// Resolve direct bridges into call paths bound to destination controllers or sinks,
+// skipping routing by SendToNode. Bridges with schemas are left as is, since packets on them are validated.
+// Called by Concrete after controllers are concreted.
+func (mg *MetaGraph) fuseBridges() {
+	for _, br := range mg.Pipes {
+		br.fused = mg.fusedPipe(br)
+	}
+	mg.inletPipes = make(map[PortKey]Pipe)
+	for _, br := range mg.Pipes {
+		if br.Source.Joint == GRAPH {
+			if _, ok := mg.inletPipes[br.Source.Port]; !ok {
+				mg.inletPipes[br.Source.Port] = mg.PortOutlet(GRAPH, br.Source.Port)
+			}
+		}
+	}
+}
+
+// nil if the bridge can not be fused
+func (mg *MetaGraph) fusedPipe(br *JointBridge) Pipe {
+	if br.Mode != PIPE_DIRECT {
+		return nil
+	}
+	if _, ok := mg.schemas[br.Source]; ok {
+		return nil
+	}
+	if _, ok := mg.schemas[br.Destination]; ok {
+		return nil
+	}
+	if br.Destination.Joint == GRAPH {
+		// nil if the sink is not set yet
+		return mg.sinks[br.Destination.Port]
+	}
+	joint, ok := mg.Joints[br.Destination.Joint]
+	if !ok || joint.controller == nil {
+		return nil
+	}
+	if inline, ok := joint.controller.(InlineController); ok {
+		if fn, outlet, ok := inline.InlineFunc(br.Destination.Port); ok {
+			if next := mg.PortOutlet(joint.Key, outlet); next != nil {
+				return &inlinePipe{
+					graph: mg,
+					key: joint.Key,
+					port: br.Destination.Port,
+					fn: fn,
+					next: next,
+				}
+			}
+		}
+	}
+	return &fusedPipe{
+		graph: mg,
+		joint: joint,
+		port: br.Destination.Port,
+	}
+}
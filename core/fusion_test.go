@@ -0,0 +1,115 @@
+package core
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// controller sending every packet to its outlet
+type passController struct {
+	out Pipe
+}
+
+func (self *passController) Push(ctx context.Context, port PortKey, data *Packet) error {
+	return self.out.Send(ctx, data)
+}
+
+func (self *passController) Pull(ctx context.Context, port PortKey, param *DrainRequest) (*DrainResponse, error) {
+	return self.out.Drain(ctx, param)
+}
+
+func (self *passController) Concrete(joint *MetaJoint, graph *MetaGraph) error {
+	self.out = graph.PortOutlet(joint.Key, "out")
+	return nil
+}
+
+type passComponent struct {
+	planComponent
+}
+
+func (self *passComponent) CreateController(metaJoint *MetaJoint, param interface{}, graph *MetaGraph) (JointController, error) {
+	return &passController{}, nil
+}
+
+type countSink struct {
+	count int
+}
+
+func (self *countSink) Send(ctx context.Context, data *Packet) error {
+	self.count += 1
+	return nil
+}
+
+func (self *countSink) Drain(ctx context.Context, param *DrainRequest) (*DrainResponse, error) {
+	return &DrainResponse{}, nil
+}
+
+// in -> a -> b -> c -> out, every bridge is direct
+func chainGraph(sink Pipe) *MetaGraph {
+	univ := NewUniverse([]Component{&passComponent{planComponent{key: "pass"}}}, nil)
+	mg := NewMetaGraph(univ)
+	mg.Flavor = FlavorBetterLatency
+	for _, key := range []JointKey{"a", "b", "c"} {
+		mg.AddJointByComponent(key, &EmptyComponentParam{"pass"})
+	}
+	mg.AddBridge(GRAPH, "in", "a", "in")
+	mg.AddBridge("a", "out", "b", "in")
+	mg.AddBridge("b", "out", "c", "in")
+	mg.AddBridge("c", "out", GRAPH, "out")
+	mg.Sink("out", sink)
+	return mg
+}
+
+// route every bridge through SendToNode, as before fusion
+func unfuse(mg *MetaGraph) {
+	for _, br := range mg.Pipes {
+		br.fused = nil
+	}
+}
+
+func TestFusionOverhead(t *testing.T) {
+	assert := assert.New(t)
+	sink := &countSink{}
+	mg := chainGraph(sink)
+	if !assert.NoError(mg.Concrete()) {
+		t.FailNow()
+	}
+	for _, br := range mg.Pipes {
+		assert.NotNil(br.fused, br.Repr())
+	}
+	data := NewPacket()
+	push := func() {
+		mg.Push("in", data)
+	}
+	// fused path allocates nothing per hop, compare time with BenchmarkChainFused and BenchmarkChainUnfused
+	assert.Equal(float64(0), testing.AllocsPerRun(100, push))
+	assert.Equal(101, sink.count)
+	unfuse(mg)
+	push()
+	assert.Equal(102, sink.count)
+}
+
+func benchmarkChain(b *testing.B, fused bool) {
+	mg := chainGraph(&countSink{})
+	if mg.Concrete() != nil {
+		b.FailNow()
+	}
+	if !fused {
+		unfuse(mg)
+	}
+	data := NewPacket()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mg.Push("in", data)
+	}
+}
+
+func BenchmarkChainFused(b *testing.B) {
+	benchmarkChain(b, true)
+}
+
+func BenchmarkChainUnfused(b *testing.B) {
+	benchmarkChain(b, false)
+}
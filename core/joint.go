@@ -2,6 +2,7 @@ package core
 
 import (
 	"fmt"
+	"context"
 )
 
 type JointKey string
@@ -19,8 +20,8 @@ const (
 )
 
 type Node interface {
-	Push(port PortKey, data *Packet)
-	Pull(port PortKey, param *DrainRequest) *DrainResponse
+	Push(ctx context.Context, port PortKey, data *Packet) error
+	Pull(ctx context.Context, port PortKey, param *DrainRequest) (*DrainResponse, error)
 }
 
 type PacketHandler func(from PortKey, data *Packet)
@@ -47,6 +48,8 @@ var (
 type MetaJoint struct {
 	Component  ComponentKey
 	Key        JointKey
+	// param which the controller was created with
+	Param      ComponentParam
 	graph      *MetaGraph
 	controller JointController
 }
@@ -64,12 +67,28 @@ func (self *MetaJoint) String() string {
 	return fmt.Sprintf("<%s(%s)>", self.Component, self.Key)
 }
 
-func (self *MetaJoint) Push(port PortKey, data *Packet) {
-	self.controller.Push(port, data)
+// observed by MetaGraph.Metrics and Tracer if set
+func (self *MetaJoint) Push(ctx context.Context, port PortKey, data *Packet) error {
+	if !self.graph.observed() {
+		return self.controller.Push(ctx, port, data)
+	}
+	return self.graph.observePush(self.Key, port, []*Packet{data}, func() error {
+		return self.controller.Push(ctx, port, data)
+	})
+}
+
+// observed by MetaGraph.Metrics and Tracer if set
+func (self *MetaJoint) Pull(ctx context.Context, port PortKey, param *DrainRequest) (*DrainResponse, error) {
+	if !self.graph.observed() {
+		return self.controller.Pull(ctx, port, param)
+	}
+	return self.graph.observePull(ctx, self.Key, port, param, func(ctx context.Context) (*DrainResponse, error) {
+		return self.controller.Pull(ctx, port, param)
+	})
 }
 
-func (self *MetaJoint) Pull(port PortKey, param *DrainRequest) *DrainResponse {
-	return self.controller.Pull(port, param)
+func (self *MetaJoint) Controller() JointController {
+	return self.controller
 }
 
 func (self *MetaJoint) Concrete(graph *MetaGraph) error {
@@ -1,9 +1,11 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"github.com/pkg/errors"
 	"os"
+	"strings"
 )
 
 type PortKey string
@@ -42,7 +44,29 @@ type MetaGraph struct {
 	Joints   map[JointKey]*MetaJoint
 	sinks    map[PortKey]Pipe
 	pools    map[PortKey]Pipe
+	schemas  map[Endpoint]*Schema
 	IdGen    func() JointKey
+	// record joints which each packet went through in its Metadata.Hops
+	RecordHops bool
+	// how packets are copied at fan-out points
+	CopyPolicy CopyPolicy
+	placement  *PlacementPlan
+	// pipes from graph inlets, resolved by Concrete
+	inletPipes map[PortKey]Pipe
+	// excludes flows of packets during Mutate
+	gate       topologyGate
+	// where durable bridges keep their logs, required if there are durable bridges
+	Wal        *WalOptions
+	// last epoch committed by CommitEpoch
+	epoch      uint64
+	// where joints keep their state, in memory if nil
+	State      StateBackend
+	// prefix of namespaces in State, so that graphs can share it
+	StateNamespace string
+	// receives measurements of joints and bridges if set, see MetricsCollector
+	Metrics    Metrics
+	// records spans of packets through joints if set
+	Tracer     *Tracer
 }
 
 func NewMetaGraph(univ *Universe) *MetaGraph {
@@ -51,6 +75,7 @@ func NewMetaGraph(univ *Universe) *MetaGraph {
 		Flavor: FlavorBetterLatency,
 		sinks: make(map[PortKey]Pipe),
 		pools: make(map[PortKey]Pipe),
+		schemas: make(map[Endpoint]*Schema),
 		Universe: univ,
 	}
 }
@@ -95,6 +120,7 @@ func (mg *MetaGraph) AddJointByComponent(key JointKey, param ComponentParam) (*M
 		return nil, fmt.Errorf("Undefined component %s", component)
 	} else {
 		joint := mg.NewJoint(component, key)
+		joint.Param = param
 		jc, err := comp.CreateController(joint, param, mg)
 		if err != nil {
 			return nil, errors.Wrap(err, "Failed to create joint!")
@@ -106,11 +132,32 @@ func (mg *MetaGraph) AddJointByComponent(key JointKey, param ComponentParam) (*M
 }
 
 func (mg *MetaGraph) AddPipeBridge(from Endpoint, to Endpoint) error {
-	mg.Pipes = append(mg.Pipes, &JointBridge{
+	return mg.AddJointBridge(&JointBridge{
 		Source: from,
 		Destination: to,
 		Mode: FlavorToMode(mg.Flavor),
+		AutoMode: true,
 	})
+}
+
+// Add the bridge configured by caller
+func (mg *MetaGraph) AddJointBridge(br *JointBridge) error {
+	if br.Buffer < 0 {
+		return fmt.Errorf("Negative buffer size %d at %s", br.Buffer, br.Repr())
+	}
+	if br.Name != "" && mg.Bridge(br.Name) != nil {
+		return fmt.Errorf("Duplicate bridge name %s", br.Name)
+	}
+	if br.Durable {
+		if br.Name == "" || strings.ContainsAny(br.Name, `/\`) || br.Name == "." || br.Name == ".." {
+			return fmt.Errorf("Durable bridge requires name usable as directory name, but %q at %s", br.Name, br.Repr())
+		}
+		if !br.AutoMode && br.Mode == PIPE_DEMAND {
+			return fmt.Errorf("Demand bridge can not be durable at %s", br.Repr())
+		}
+	}
+	mg.Pipes = append(mg.Pipes, br)
+	mg.inletPipes = nil
 	return nil
 }
 
@@ -124,60 +171,143 @@ func (mg *MetaGraph) SinkHandler(port PortKey, handler func(*Packet)) {
 
 func (mg *MetaGraph) Sink(port PortKey, handler Pipe) {
 	mg.sinks[port] = handler
+	if mg.placement == nil {
+		// not concreted yet, bridges are fused by Concrete
+		return
+	}
+	for _, br := range mg.Pipes {
+		if br.Destination == (Endpoint{GRAPH, port}) {
+			br.fused = mg.fusedPipe(br)
+		}
+	}
 }
 
 func (mg *MetaGraph) Source(port PortKey, handler Pipe) {
 	mg.pools[port] = handler
 }
 
+// Declare schema of packets passing the port.
+// Use Endpoint{GRAPH, port} for graph inlets and outlets.
+func (mg *MetaGraph) SetSchema(ep Endpoint, schema *Schema) {
+	mg.schemas[ep] = schema
+}
+
+func (mg *MetaGraph) Schema(ep Endpoint) (*Schema, bool) {
+	schema, ok := mg.schemas[ep]
+	return schema, ok
+}
+
+// all declared schemas
+func (mg *MetaGraph) Schemas() map[Endpoint]*Schema {
+	ret := make(map[Endpoint]*Schema, len(mg.schemas))
+	for ep, schema := range mg.schemas {
+		ret[ep] = schema
+	}
+	return ret
+}
+
+// Static compatibility check of schemas at both ends of each bridge
+func (mg *MetaGraph) CheckSchemas() error {
+	for _, br := range mg.Pipes {
+		up, upOk := mg.schemas[br.Source]
+		down, downOk := mg.schemas[br.Destination]
+		if !upOk || !downOk {
+			continue
+		}
+		if err := up.CompatibleWith(down); err != nil {
+			err.(*SchemaIncompatible).Bridge = br.Repr()
+			return err
+		}
+	}
+	return nil
+}
+
+// validate packet against schemas of both ends of the bridge
+func (mg *MetaGraph) validateBridge(src, dst Endpoint, data *Packet) error {
+	if len(mg.schemas) == 0 {
+		return nil
+	}
+	for _, ep := range [...]Endpoint{src, dst} {
+		if schema, ok := mg.schemas[ep]; ok {
+			if err := schema.Validate(data); err != nil {
+				err.(*SchemaViolation).At = ep
+				mg.TellError(nil, err)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // dynamic routing
 // for internal use
-func (mg *MetaGraph) SendToNode(ep Endpoint, data *Packet) {
+func (mg *MetaGraph) SendToNode(ctx context.Context, ep Endpoint, data *Packet) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if ep.Joint == GRAPH {
-		mg.dispatchOutlet(ep.Port, data)
+		return mg.dispatchOutlet(ctx, ep.Port, data)
 	} else {
 		if downNode, ok := mg.Joints[ep.Joint]; !ok {
-			mg.TellError(nil, &DispatchFailed{
+			err := &DispatchFailed{
 				Destination: ep.Joint,
 				Data: data,
-			})
+			}
+			mg.TellError(nil, err)
+			return err
 		} else {
-			downNode.Push(ep.Port, data)
+			if mg.RecordHops {
+				data.meta.Hops = append(data.meta.Hops, ep.Joint)
+			}
+			return downNode.Push(ctx, ep.Port, data)
 		}
 	}
 }
 
 // for internal use
-func (mg *MetaGraph) DrainFromNode(ep Endpoint, data *DrainRequest) *DrainResponse {
+func (mg *MetaGraph) DrainFromNode(ctx context.Context, ep Endpoint, data *DrainRequest) (*DrainResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return NewInterruptedResponse(nil), err
+	}
 	if ep.Joint == GRAPH {
-		return mg.pullPool(ep.Port, data)
+		return mg.pullPool(ctx, ep.Port, data)
 	} else {
 		if upNode, ok := mg.Joints[ep.Joint]; !ok {
-			mg.TellError(nil, &DispatchFailed{
+			err := &DispatchFailed{
 				Destination: ep.Joint,
 				Data: data,
-			})
-			return nil // TODO return error object
+			}
+			mg.TellError(nil, err)
+			return nil, err
 		} else {
-			return upNode.Pull(ep.Port, data)
+			return upNode.Pull(ctx, ep.Port, data)
 		}
 	}
 }
 
-func (mg *MetaGraph) dispatchOutlet(port PortKey, data *Packet) {
+func (mg *MetaGraph) dispatchOutlet(ctx context.Context, port PortKey, data *Packet) error {
 	if out, ok := mg.sinks[port]; ok {
-		out.Send(data)
+		return out.Send(ctx, data)
 	} else {
-		mg.TellError(nil, fmt.Errorf("Undefined outlet! %s", port))
+		err := &UndefinedPort{"graph outlet", port}
+		mg.TellError(nil, err)
+		return err
 	}
 }
 
-func (mg *MetaGraph) pullPool(port PortKey, param *DrainRequest) *DrainResponse {
+func (mg *MetaGraph) pullPool(ctx context.Context, port PortKey, param *DrainRequest) (*DrainResponse, error) {
 	if pool, ok := mg.pools[port]; ok {
-		return pool.Drain(param)
+		res, err := pool.Drain(ctx, param)
+		if res != nil {
+			for _, item := range res.Items {
+				item.meta.ingest(port)
+			}
+		}
+		return res, err
 	} else {
-		mg.TellError(nil, fmt.Errorf("Missing pool! %s", port))
-		return nil
+		err := &UndefinedPort{"graph inlet", port}
+		mg.TellError(nil, err)
+		return nil, err
 	}
 }
 
@@ -190,25 +320,49 @@ func (mg *MetaGraph) TellError(on Node, err error) {
 }
 
 // External -- push --> Internal
-func (mg *MetaGraph) Push(inlet PortKey, data *Packet) {
-	initBridges := mg.SelectBridges(GRAPH, inlet, JOINT_ANY, PORT_ANY)
-	if len(initBridges) > 0 {
-		mg.SendToNode(initBridges[0].Destination, data)
+// Returned error tells whether the packet was delivered.
+func (mg *MetaGraph) Push(inlet PortKey, data *Packet) error {
+	return mg.PushContext(context.Background(), inlet, data)
+}
+
+// Push with the context, cancellation or deadline of ctx stops the packet at the next hop.
+// The packet is sent to every bridge from the inlet.
+func (mg *MetaGraph) PushContext(ctx context.Context, inlet PortKey, data *Packet) error {
+	mg.gate.enter(flowPush)
+	defer mg.gate.exit()
+	out, ok := mg.inletPipes[inlet]
+	if !ok {
+		out = mg.PortOutlet(GRAPH, inlet)
+	}
+	if out != nil {
+		data.meta.ingest(inlet)
+		return out.Send(ctx, data)
 	} else {
-		mg.TellError(nil, fmt.Errorf("Destination unreachable %s", inlet))
+		err := &PacketUnreachable{DIRECTION_FORWARD, inlet}
+		mg.TellError(nil, err)
+		return err
 	}
 }
 
 // This API basically for sending control messages.
 // 1 Internal <-- request -- External
 // 2 Internal -- response --> External
-func (mg *MetaGraph) Pull(outlet PortKey, param *DrainRequest) *DrainResponse {
+func (mg *MetaGraph) Pull(outlet PortKey, param *DrainRequest) (*DrainResponse, error) {
+	return mg.PullContext(context.Background(), outlet, param)
+}
+
+// Pull with the context, cancellation or deadline of ctx stops upstream drains early.
+// In that case, the response holds packets drained so far and is marked as Interrupted.
+func (mg *MetaGraph) PullContext(ctx context.Context, outlet PortKey, param *DrainRequest) (*DrainResponse, error) {
+	mg.gate.enter(flowDrain)
+	defer mg.gate.exit()
 	initBridges := mg.SelectBridges(JOINT_ANY, PORT_ANY, GRAPH, outlet)
 	if len(initBridges) > 0 {
-		return mg.DrainFromNode(initBridges[0].Source, param)
+		return NewBridgePipe(mg, initBridges[0]).Drain(ctx, param)
 	} else {
-		mg.TellError(nil, fmt.Errorf("Destination unreachable %s", outlet))
-		return nil
+		err := &PacketUnreachable{DIRECTION_BACKWARD, outlet}
+		mg.TellError(nil, err)
+		return nil, err
 	}
 }
 
@@ -229,7 +383,57 @@ func (mg *MetaGraph) JointOutlets(jointKey JointKey) []Pipe {
 	bridges := mg.SelectBridges(jointKey, PORT_ANY, JOINT_ANY, PORT_ANY)
 	ret := make([]Pipe, 0, len(bridges))
 	for _, br := range bridges {
-		ret = append(ret, NewDelegatePipe(mg, br.Source, br.Destination))
+		ret = append(ret, NewBridgePipe(mg, br))
+	}
+	return ret
+}
+
+// Pipe to every bridge from the port, packets are copied according to CopyPolicy if there are many of them.
+// returns nil if the port has no bridge.
+func (mg *MetaGraph) PortOutlet(jointKey JointKey, port PortKey) Pipe {
+	bridges := mg.SelectBridges(jointKey, port, JOINT_ANY, PORT_ANY)
+	switch len(bridges) {
+	case 0:
+		return nil
+	case 1:
+		return NewBridgePipe(mg, bridges[0])
+	default:
+		pipes := make([]Pipe, 0, len(bridges))
+		for _, br := range bridges {
+			pipes = append(pipes, NewBridgePipe(mg, br))
+		}
+		return NewFanOutPipe(mg, pipes)
+	}
+}
+
+// Pipe to drain from the bridge into the port, returns nil if the port has no bridge.
+func (mg *MetaGraph) PortInlet(jointKey JointKey, port PortKey) Pipe {
+	bridges := mg.SelectBridges(JOINT_ANY, PORT_ANY, jointKey, port)
+	if len(bridges) == 0 {
+		return nil
+	}
+	return NewBridgePipe(mg, bridges[0])
+}
+
+// Copies of the packet for n branches of fan-out, according to CopyPolicy.
+// The first branch always receives the packet itself.
+// Copies are taken before any branch runs, so each of them continues from the hops and span before the fan-out.
+func (mg *MetaGraph) FanOut(data *Packet, n int) []*Packet {
+	ret := make([]*Packet, n)
+	for i := range ret {
+		switch {
+		case i == 0:
+			ret[i] = data
+		case mg.CopyPolicy == COPY_SHARE && (mg.RecordHops || mg.Tracer != nil):
+			// hops and spans are recorded in metadata, which must not be written by other branches
+			ret[i] = data.sharePayload()
+		case mg.CopyPolicy == COPY_SHARE:
+			ret[i] = data
+		case mg.CopyPolicy == COPY_CLONE:
+			ret[i] = data.Clone()
+		default:
+			ret[i] = data.CopyOnWrite()
+		}
 	}
 	return ret
 }
@@ -238,17 +442,27 @@ func (mg *MetaGraph) JointInlets(jointKey JointKey) []Pipe {
 	bridges := mg.SelectBridges(JOINT_ANY, PORT_ANY, jointKey, PORT_ANY)
 	ret := make([]Pipe, 0, len(bridges))
 	for _, br := range bridges {
-		ret = append(ret, NewDelegatePipe(mg, br.Source, br.Destination))
+		ret = append(ret, NewBridgePipe(mg, br))
 	}
 	return ret
 }
 
 func (mg *MetaGraph) Concrete() error {
+	if err := mg.CheckSchemas(); err != nil {
+		return err
+	}
+	mg.ApplyPlan(mg.PlanPlacement())
+	mg.stateBackend()
 	for _, j := range mg.Joints {
 		err := j.Concrete(mg)
 		if err != nil {
 			return err
 		}
 	}
+	mg.fuseBridges()
+	if err := mg.startBridges(); err != nil {
+		return err
+	}
+	mg.replayLogs(context.Background())
 	return nil
 }
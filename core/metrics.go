@@ -0,0 +1,332 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Receives measurements of a graph, set to MetaGraph.Metrics. Called concurrently from every path packets take.
+type Metrics interface {
+	// packets pushed into the joint, elapsed is the time spent in the controller,
+	// including downstream joints reached by direct bridges
+	ObservePush(joint JointKey, n int, elapsed time.Duration, err error)
+	// drain request for requested packets answered by the joint with returned ones
+	ObservePull(joint JointKey, requested, returned int, elapsed time.Duration, err error)
+	// packets sent into the bridge after its filter
+	ObserveSend(bridge *JointBridge, n int, err error)
+	// drain request for requested packets through the bridge, returned after its filter
+	ObserveDrain(bridge *JointBridge, requested, returned int, err error)
+	// bridge taken out of the graph by Mutate, measurements kept for it can be forgotten
+	RemoveBridge(bridge *JointBridge)
+}
+
+var (
+	// upper bounds of buckets of push latency, in seconds
+	DEFAULT_LATENCY_BUCKETS = []float64{.00001, .0001, .001, .01, .1, 1, 10}
+)
+
+type histogram struct {
+	// count of observations in each bucket, not cumulative
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (self *histogram) observe(bounds []float64, v float64) {
+	if self.counts == nil {
+		self.counts = make([]uint64, len(bounds))
+	}
+	for i, bound := range bounds {
+		if v <= bound {
+			self.counts[i] += 1
+			break
+		}
+	}
+	self.count += 1
+	self.sum += v
+}
+
+type jointMetrics struct {
+	in        uint64
+	out       uint64
+	errors    uint64
+	requested uint64
+	returned  uint64
+	push      histogram
+}
+
+type jointID struct {
+	graph string
+	joint JointKey
+}
+
+// bridges are told apart by their labels, so that a bridge replaced by an equal one continues its series
+type bridgeID struct {
+	graph  string
+	bridge string
+}
+
+type bridgeMetrics struct {
+	id        bridgeID
+	// last bridge observed with the labels, read for queue depth, filtered and dropped counts
+	bridge    *JointBridge
+	packets   uint64
+	errors    uint64
+	requested uint64
+	returned  uint64
+}
+
+// Metrics counting packets, errors and drains of every joint and bridge, with histograms of push latency.
+// Serves them in Prometheus text format as http.Handler.
+// Queue depths, filtered and dropped counts are read from bridges seen so far when served.
+// Every series has a graph label, empty unless the graph observes through Graph,
+// so give each graph sharing a collector its own name.
+type MetricsCollector struct {
+	// upper bounds of latency buckets, DEFAULT_LATENCY_BUCKETS if nil
+	Buckets []float64
+	lock    sync.Mutex
+	joints  map[jointID]*jointMetrics
+	bridges map[bridgeID]*bridgeMetrics
+}
+
+func NewMetricsCollector() *MetricsCollector {
+	return &MetricsCollector{
+		joints: make(map[jointID]*jointMetrics),
+		bridges: make(map[bridgeID]*bridgeMetrics),
+	}
+}
+
+// Metrics of a graph in the collector, set to MetaGraph.Metrics
+type GraphMetrics struct {
+	collector *MetricsCollector
+	name      string
+}
+
+// Metrics for the graph, measurements are labelled with the name
+func (self *MetricsCollector) Graph(name string) *GraphMetrics {
+	return &GraphMetrics{self, name}
+}
+
+func (self *GraphMetrics) ObservePush(joint JointKey, n int, elapsed time.Duration, err error) {
+	self.collector.observePush(jointID{self.name, joint}, n, elapsed, err)
+}
+
+func (self *GraphMetrics) ObservePull(joint JointKey, requested, returned int, elapsed time.Duration, err error) {
+	self.collector.observePull(jointID{self.name, joint}, requested, returned, elapsed, err)
+}
+
+func (self *GraphMetrics) ObserveSend(bridge *JointBridge, n int, err error) {
+	self.collector.observeSend(self.name, bridge, n, err)
+}
+
+func (self *GraphMetrics) ObserveDrain(bridge *JointBridge, requested, returned int, err error) {
+	self.collector.observeDrain(self.name, bridge, requested, returned, err)
+}
+
+func (self *GraphMetrics) RemoveBridge(bridge *JointBridge) {
+	self.collector.removeBridge(self.name, bridge)
+}
+
+func (self *MetricsCollector) buckets() []float64 {
+	if self.Buckets == nil {
+		return DEFAULT_LATENCY_BUCKETS
+	}
+	return self.Buckets
+}
+
+// requires lock
+func (self *MetricsCollector) joint(id jointID) *jointMetrics {
+	jm, ok := self.joints[id]
+	if !ok {
+		jm = &jointMetrics{}
+		self.joints[id] = jm
+	}
+	return jm
+}
+
+// requires lock
+func (self *MetricsCollector) bridge(graph string, br *JointBridge) *bridgeMetrics {
+	id := bridgeID{graph, br.Repr()}
+	bm, ok := self.bridges[id]
+	if !ok {
+		bm = &bridgeMetrics{id: id}
+		self.bridges[id] = bm
+	}
+	bm.bridge = br
+	return bm
+}
+
+// Measurements of a graph without name
+func (self *MetricsCollector) ObservePush(joint JointKey, n int, elapsed time.Duration, err error) {
+	self.observePush(jointID{"", joint}, n, elapsed, err)
+}
+
+func (self *MetricsCollector) ObservePull(joint JointKey, requested, returned int, elapsed time.Duration, err error) {
+	self.observePull(jointID{"", joint}, requested, returned, elapsed, err)
+}
+
+func (self *MetricsCollector) ObserveSend(bridge *JointBridge, n int, err error) {
+	self.observeSend("", bridge, n, err)
+}
+
+func (self *MetricsCollector) ObserveDrain(bridge *JointBridge, requested, returned int, err error) {
+	self.observeDrain("", bridge, requested, returned, err)
+}
+
+func (self *MetricsCollector) RemoveBridge(bridge *JointBridge) {
+	self.removeBridge("", bridge)
+}
+
+func (self *MetricsCollector) observePush(joint jointID, n int, elapsed time.Duration, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	jm := self.joint(joint)
+	jm.in += uint64(n)
+	if err != nil {
+		jm.errors += 1
+	}
+	jm.push.observe(self.buckets(), elapsed.Seconds())
+}
+
+func (self *MetricsCollector) observePull(joint jointID, requested, returned int, elapsed time.Duration, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	jm := self.joint(joint)
+	jm.requested += uint64(requested)
+	jm.returned += uint64(returned)
+	jm.out += uint64(returned)
+	if err != nil {
+		jm.errors += 1
+	}
+}
+
+// Packets sent from a joint count as its output
+func (self *MetricsCollector) observeSend(graph string, bridge *JointBridge, n int, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	bm := self.bridge(graph, bridge)
+	bm.packets += uint64(n)
+	if err != nil {
+		bm.errors += 1
+	}
+	if bridge.Source.Joint != GRAPH {
+		self.joint(jointID{graph, bridge.Source.Joint}).out += uint64(n)
+	}
+}
+
+func (self *MetricsCollector) observeDrain(graph string, bridge *JointBridge, requested, returned int, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	bm := self.bridge(graph, bridge)
+	bm.requested += uint64(requested)
+	bm.returned += uint64(returned)
+	bm.packets += uint64(returned)
+	if err != nil {
+		bm.errors += 1
+	}
+}
+
+// series of the bridge are dropped, unless a bridge with the same labels was observed after it
+func (self *MetricsCollector) removeBridge(graph string, bridge *JointBridge) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	id := bridgeID{graph, bridge.Repr()}
+	if bm, ok := self.bridges[id]; ok && bm.bridge == bridge {
+		delete(self.bridges, id)
+	}
+}
+
+// escape label value of Prometheus text format
+func promLabel(v string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(v)
+}
+
+// Write every metric in Prometheus text format
+func (self *MetricsCollector) WritePrometheus(writer io.Writer) error {
+	// buffered, so that slow writers do not hold the lock
+	w := &bytes.Buffer{}
+	self.lock.Lock()
+	joints := make([]jointID, 0, len(self.joints))
+	for id := range self.joints {
+		joints = append(joints, id)
+	}
+	sort.Slice(joints, func(i, j int) bool {
+		if joints[i].graph != joints[j].graph {
+			return joints[i].graph < joints[j].graph
+		}
+		return joints[i].joint < joints[j].joint
+	})
+	bridges := make([]*bridgeMetrics, 0, len(self.bridges))
+	for _, bm := range self.bridges {
+		copied := *bm
+		bridges = append(bridges, &copied)
+	}
+	sort.Slice(bridges, func(i, j int) bool {
+		if bridges[i].id.graph != bridges[j].id.graph {
+			return bridges[i].id.graph < bridges[j].id.graph
+		}
+		return bridges[i].id.bridge < bridges[j].id.bridge
+	})
+	jointLabels := func(id jointID) string {
+		return fmt.Sprintf("graph=\"%s\",joint=\"%s\"", promLabel(id.graph), promLabel(string(id.joint)))
+	}
+	jointCounter := func(name, help string, value func(jm *jointMetrics) uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, id := range joints {
+			fmt.Fprintf(w, "%s{%s} %d\n", name, jointLabels(id), value(self.joints[id]))
+		}
+	}
+	jointCounter("pipenet_joint_packets_in_total", "Packets pushed into the joint.", func(jm *jointMetrics) uint64 { return jm.in })
+	jointCounter("pipenet_joint_packets_out_total", "Packets sent or returned by the joint.", func(jm *jointMetrics) uint64 { return jm.out })
+	jointCounter("pipenet_joint_errors_total", "Pushes and pulls of the joint which failed.", func(jm *jointMetrics) uint64 { return jm.errors })
+	jointCounter("pipenet_joint_drain_requested_total", "Packets requested from the joint by drains.", func(jm *jointMetrics) uint64 { return jm.requested })
+	jointCounter("pipenet_joint_drain_returned_total", "Packets returned from the joint by drains.", func(jm *jointMetrics) uint64 { return jm.returned })
+	bounds := self.buckets()
+	name := "pipenet_joint_push_seconds"
+	fmt.Fprintf(w, "# HELP %s Time spent in Push of the controller.\n# TYPE %s histogram\n", name, name)
+	for _, id := range joints {
+		h := &self.joints[id].push
+		labels := jointLabels(id)
+		var cumulative uint64
+		for i, bound := range bounds {
+			if h.counts != nil {
+				cumulative += h.counts[i]
+			}
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bound, cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+	}
+	self.lock.Unlock()
+
+	bridgeMetric := func(name, kind, help string, value func(bm *bridgeMetrics) uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, bm := range bridges {
+			fmt.Fprintf(w, "%s{graph=\"%s\",bridge=\"%s\",mode=\"%s\"} %d\n", name, promLabel(bm.id.graph), promLabel(bm.id.bridge), bm.bridge.Mode.Name(), value(bm))
+		}
+	}
+	bridgeMetric("pipenet_bridge_packets_total", "counter", "Packets sent into or drained through the bridge.", func(bm *bridgeMetrics) uint64 { return bm.packets })
+	bridgeMetric("pipenet_bridge_errors_total", "counter", "Sends and drains through the bridge which failed.", func(bm *bridgeMetrics) uint64 { return bm.errors })
+	bridgeMetric("pipenet_bridge_drain_requested_total", "counter", "Packets requested through the bridge by drains.", func(bm *bridgeMetrics) uint64 { return bm.requested })
+	bridgeMetric("pipenet_bridge_drain_returned_total", "counter", "Packets returned through the bridge by drains.", func(bm *bridgeMetrics) uint64 { return bm.returned })
+	bridgeMetric("pipenet_bridge_filtered_total", "counter", "Packets discarded by the filter of the bridge.", func(bm *bridgeMetrics) uint64 { return bm.bridge.Filtered() })
+	bridgeMetric("pipenet_bridge_dropped_total", "counter", "Packets discarded by the overflow policy of the bridge.", func(bm *bridgeMetrics) uint64 { return bm.bridge.Dropped() })
+	bridgeMetric("pipenet_bridge_queue_depth", "gauge", "Packets waiting in the queue of the bridge.", func(bm *bridgeMetrics) uint64 { return uint64(bm.bridge.QueueDepth()) })
+	_, err := writer.Write(w.Bytes())
+	return err
+}
+
+// Serve metrics in Prometheus text format, mount it on a local listener such as localhost:9100/metrics
+func (self *MetricsCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := self.WritePrometheus(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,419 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Excludes packet flows while the topology of a running graph is changed.
+//
+// External flows (Push, Pull, Request by callers of the graph) wait for a pending mutation,
+// so that mutations are not starved. Internal flows (deliveries by queue workers, calls from controllers)
+// only wait for a running mutation, since flows blocked on a full queue need the worker of the queue to proceed.
+// Likewise, Pull and Request are let in while a flow is stalled on a full demand buffer, since only they make room there.
+// Without mutations, flows only touch the atomic counters.
+type topologyGate struct {
+	// accessed atomically
+	flows   int64
+	// non zero while a mutation is pending or running, accessed atomically
+	blocked int32
+	lock    sync.Mutex
+	cond    *sync.Cond
+	waiting int
+	writing bool
+	// flows waiting for room in demand buffers
+	stalled int
+}
+
+type flowKind int
+
+const (
+	// deliveries by queue workers and calls from controllers
+	flowInternal flowKind = iota
+	// Push by callers of the graph
+	flowPush
+	// Pull and Request by callers of the graph
+	flowDrain
+)
+
+func (self *topologyGate) init() {
+	if self.cond == nil {
+		self.cond = sync.NewCond(&self.lock)
+	}
+}
+
+func (self *topologyGate) enter(kind flowKind) {
+	if atomic.LoadInt32(&self.blocked) == 0 {
+		atomic.AddInt64(&self.flows, 1)
+		if atomic.LoadInt32(&self.blocked) == 0 {
+			return
+		}
+		// raced with a mutation, take the slow path
+		self.exit()
+	}
+	self.lock.Lock()
+	self.init()
+	for self.writing || (kind == flowPush && self.waiting > 0) || (kind == flowDrain && self.waiting > 0 && self.stalled == 0) {
+		self.cond.Wait()
+	}
+	atomic.AddInt64(&self.flows, 1)
+	self.lock.Unlock()
+}
+
+func (self *topologyGate) exit() {
+	if atomic.AddInt64(&self.flows, -1) == 0 && atomic.LoadInt32(&self.blocked) != 0 {
+		self.lock.Lock()
+		self.init()
+		self.cond.Broadcast()
+		self.lock.Unlock()
+	}
+}
+
+// the flow waits for room in a demand buffer, which Pull or Request by callers makes
+func (self *topologyGate) stall() {
+	self.lock.Lock()
+	self.init()
+	self.stalled++
+	self.cond.Broadcast()
+	self.lock.Unlock()
+}
+
+func (self *topologyGate) unstall() {
+	self.lock.Lock()
+	self.stalled--
+	self.lock.Unlock()
+}
+
+func (self *topologyGate) acquire() {
+	self.quiesce(context.Background(), nil)
+}
+
+// Acquire the gate once idle also holds, idle is checked whenever flows reach zero.
+// Flows entering meanwhile keep the graph moving, so that packets already inside it can settle.
+func (self *topologyGate) quiesce(ctx context.Context, idle func() bool) error {
+	self.lock.Lock()
+	self.init()
+	self.waiting++
+	atomic.StoreInt32(&self.blocked, 1)
+	if done := ctx.Done(); done != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-done:
+				self.lock.Lock()
+				self.cond.Broadcast()
+				self.lock.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+	for self.writing || atomic.LoadInt64(&self.flows) > 0 || (idle != nil && !idle()) {
+		if err := ctx.Err(); err != nil {
+			self.waiting--
+			if self.waiting == 0 && !self.writing {
+				atomic.StoreInt32(&self.blocked, 0)
+			}
+			self.cond.Broadcast()
+			self.lock.Unlock()
+			return err
+		}
+		self.cond.Wait()
+	}
+	self.waiting--
+	self.writing = true
+	self.lock.Unlock()
+	return nil
+}
+
+func (self *topologyGate) release() {
+	self.lock.Lock()
+	self.writing = false
+	if self.waiting == 0 {
+		atomic.StoreInt32(&self.blocked, 0)
+	}
+	self.cond.Broadcast()
+	self.lock.Unlock()
+}
+
+// Set of changes applied to a running graph at once, see MetaGraph.Mutate
+type Mutation struct {
+	graph          *MetaGraph
+	addedJoints    []*MetaJoint
+	removedJoints  map[JointKey]bool
+	addedBridges   []*JointBridge
+	removedBridges map[*JointBridge]bool
+	// nil --> removed
+	schemas        map[Endpoint]*Schema
+}
+
+// Joint to be added, its controller is created now and concreted when the mutation is applied
+func (self *Mutation) AddJoint(key JointKey, param ComponentParam) (*MetaJoint, error) {
+	mg := self.graph
+	if key == "" {
+		key = mg.nextID()
+	}
+	if _, ok := mg.Joints[key]; ok && !self.removedJoints[key] {
+		return nil, fmt.Errorf("Duplicate JointKey! %s", key)
+	}
+	for _, joint := range self.addedJoints {
+		if joint.Key == key {
+			return nil, fmt.Errorf("Duplicate JointKey! %s", key)
+		}
+	}
+	comp, ok := mg.Universe.Components[param.Name()]
+	if !ok {
+		return nil, fmt.Errorf("Undefined component %s", param.Name())
+	}
+	joint := mg.NewJoint(param.Name(), key)
+	joint.Param = param
+	jc, err := comp.CreateController(joint, param, mg)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create joint!")
+	}
+	joint.controller = jc
+	self.addedJoints = append(self.addedJoints, joint)
+	return joint, nil
+}
+
+// Remove the joint and every bridge from or to it
+func (self *Mutation) RemoveJoint(key JointKey) error {
+	if _, ok := self.graph.Joints[key]; !ok {
+		return fmt.Errorf("Undefined joint %s", key)
+	}
+	self.removedJoints[key] = true
+	return nil
+}
+
+func (self *Mutation) AddBridge(br *JointBridge) error {
+	if br.Buffer < 0 {
+		return fmt.Errorf("Negative buffer size %d at %s", br.Buffer, br.Repr())
+	}
+	self.addedBridges = append(self.addedBridges, br)
+	return nil
+}
+
+func (self *Mutation) RemoveBridge(br *JointBridge) error {
+	for _, p := range self.graph.Pipes {
+		if p == br {
+			self.removedBridges[br] = true
+			return nil
+		}
+	}
+	return fmt.Errorf("Bridge %s is not in the graph", br.Repr())
+}
+
+// Declare the schema of the endpoint, nil removes it.
+// Schemas of removed joints are dropped without this.
+func (self *Mutation) SetSchema(ep Endpoint, schema *Schema) {
+	self.schemas[ep] = schema
+}
+
+// Change topology of the graph atomically with respect to concurrent Push and Pull.
+//
+// Changes collected by fn are applied at once, then only controllers of joints at ends of changed bridges are concreted again.
+// If fn or concreting fails, the graph is left as it was.
+// Packets queued on removed bridges are delivered to their destinations before Mutate returns,
+// packets for removed joints are reported by TellError and discarded.
+// The graph must have been concreted, use AddJoint and AddBridge to build graphs before Concrete.
+func (mg *MetaGraph) Mutate(ctx context.Context, fn func(m *Mutation) error) error {
+	if mg.placement == nil {
+		return fmt.Errorf("Mutate requires concreted graph")
+	}
+	m := &Mutation{
+		graph: mg,
+		removedJoints: make(map[JointKey]bool),
+		removedBridges: make(map[*JointBridge]bool),
+		schemas: make(map[Endpoint]*Schema),
+	}
+	mg.gate.acquire()
+	detached, err := mg.applyMutation(m, fn)
+	mg.gate.release()
+	if err != nil {
+		return err
+	}
+	if err := mg.flushDetached(ctx, detached); err != nil {
+		return err
+	}
+	mg.gate.enter(flowInternal)
+	mg.replayLogs(ctx)
+	mg.gate.exit()
+	return nil
+}
+
+// returns bridges taken out of the graph. requires gate
+func (mg *MetaGraph) applyMutation(m *Mutation, fn func(m *Mutation) error) ([]*JointBridge, error) {
+	if err := fn(m); err != nil {
+		return nil, err
+	}
+	oldPipes := mg.Pipes
+	oldJoints := make(map[JointKey]*MetaJoint, len(mg.Joints))
+	for key, joint := range mg.Joints {
+		oldJoints[key] = joint
+	}
+	oldSchemas := mg.Schemas()
+	affected := make(map[JointKey]bool)
+	touch := func(br *JointBridge) {
+		affected[br.Source.Joint] = true
+		affected[br.Destination.Joint] = true
+	}
+	var detached []*JointBridge
+	pipes := make([]*JointBridge, 0, len(mg.Pipes) + len(m.addedBridges))
+	for _, br := range mg.Pipes {
+		if m.removedBridges[br] || m.removedJoints[br.Source.Joint] || m.removedJoints[br.Destination.Joint] {
+			detached = append(detached, br)
+			touch(br)
+			continue
+		}
+		pipes = append(pipes, br)
+	}
+	for key := range m.removedJoints {
+		delete(mg.Joints, key)
+	}
+	for ep := range oldSchemas {
+		if m.removedJoints[ep.Joint] {
+			delete(mg.schemas, ep)
+		}
+	}
+	for ep, schema := range m.schemas {
+		if schema == nil {
+			delete(mg.schemas, ep)
+		} else {
+			mg.schemas[ep] = schema
+		}
+		affected[ep.Joint] = true
+	}
+	for _, joint := range m.addedJoints {
+		mg.Joints[joint.Key] = joint
+		affected[joint.Key] = true
+	}
+	mg.Pipes = pipes
+	for _, br := range m.addedBridges {
+		if err := mg.AddJointBridge(br); err != nil {
+			mg.rollback(oldPipes, oldJoints, oldSchemas, affected)
+			return nil, err
+		}
+		touch(br)
+	}
+	if err := mg.reconcrete(affected); err != nil {
+		mg.rollback(oldPipes, oldJoints, oldSchemas, affected)
+		return nil, err
+	}
+	return detached, nil
+}
+
+// concrete controllers of affected joints, then bridges of the whole graph again
+func (mg *MetaGraph) reconcrete(affected map[JointKey]bool) error {
+	if err := mg.CheckSchemas(); err != nil {
+		return err
+	}
+	mg.ApplyPlan(mg.PlanPlacement())
+	for key := range affected {
+		joint, ok := mg.Joints[key]
+		if !ok {
+			continue
+		}
+		if err := joint.Concrete(mg); err != nil {
+			return errors.Wrapf(err, "Failed to concrete %s", key)
+		}
+	}
+	mg.fuseBridges()
+	return mg.startBridges()
+}
+
+func (mg *MetaGraph) rollback(pipes []*JointBridge, joints map[JointKey]*MetaJoint, schemas map[Endpoint]*Schema, affected map[JointKey]bool) {
+	kept := make(map[*JointBridge]bool, len(pipes))
+	for _, br := range pipes {
+		kept[br] = true
+	}
+	for _, br := range mg.Pipes {
+		if kept[br] {
+			continue
+		}
+		// added bridges may have been started, nothing is sent to them yet
+		if br.queue != nil {
+			br.queue.close(context.Background())
+			br.queue = nil
+		}
+		br.closeLog()
+		br.wal = nil
+	}
+	mg.Pipes = pipes
+	mg.Joints = joints
+	mg.schemas = schemas
+	mg.inletPipes = nil
+	if err := mg.reconcrete(affected); err != nil {
+		mg.TellError(nil, errors.Wrap(err, "Failed to restore graph after failed mutation"))
+	}
+}
+
+// deliver packets left in bridges taken out of the graph
+func (mg *MetaGraph) flushDetached(ctx context.Context, detached []*JointBridge) error {
+	for _, br := range detached {
+		switch {
+		case br.queue != nil:
+			if err := br.queue.close(ctx); err != nil {
+				return errors.Wrapf(err, "Failed to drain removed %s", br.Repr())
+			}
+		case br.demand != nil:
+			br.demand.close()
+			if pending := br.demand.drain(0); len(pending) > 0 {
+				mg.gate.enter(flowInternal)
+				err := mg.deliverBatch(ctx, br, pending)
+				mg.gate.exit()
+				if err != nil {
+					mg.TellError(nil, errors.Wrapf(err, "Failed to drain removed %s", br.Repr()))
+				}
+			}
+		}
+		if err := br.closeLog(); err != nil {
+			mg.TellError(nil, err)
+		}
+		if metrics := mg.Metrics; metrics != nil {
+			metrics.RemoveBridge(br)
+		}
+	}
+	return nil
+}
+
+// Remove the joint and its bridges, while running if the graph is concreted
+func (mg *MetaGraph) RemoveJoint(ctx context.Context, key JointKey) error {
+	if mg.placement != nil {
+		return mg.Mutate(ctx, func(m *Mutation) error {
+			return m.RemoveJoint(key)
+		})
+	}
+	if _, ok := mg.Joints[key]; !ok {
+		return fmt.Errorf("Undefined joint %s", key)
+	}
+	delete(mg.Joints, key)
+	pipes := mg.Pipes[:0]
+	for _, br := range mg.Pipes {
+		if br.Source.Joint != key && br.Destination.Joint != key {
+			pipes = append(pipes, br)
+		}
+	}
+	mg.Pipes = pipes
+	mg.inletPipes = nil
+	return nil
+}
+
+// Remove the bridge, while running if the graph is concreted
+func (mg *MetaGraph) RemoveBridge(ctx context.Context, br *JointBridge) error {
+	if mg.placement != nil {
+		return mg.Mutate(ctx, func(m *Mutation) error {
+			return m.RemoveBridge(br)
+		})
+	}
+	for i, p := range mg.Pipes {
+		if p == br {
+			mg.Pipes = append(mg.Pipes[:i], mg.Pipes[i + 1:]...)
+			mg.inletPipes = nil
+			return nil
+		}
+	}
+	return fmt.Errorf("Bridge %s is not in the graph", br.Repr())
+}
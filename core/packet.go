@@ -1,16 +1,100 @@
 package core
 
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"reflect"
+	"time"
+)
+
+const (
+	HEADER_STATUS  = "status"
+	HEADER_MESSAGE = "message"
+)
+
+// Metadata of a packet, kept apart from its payload
+type Metadata struct {
+	// unique for each packet
+	ID       string `codec:"id"`
+	Created  time.Time `codec:"created"`
+	// when the packet entered a graph
+	Ingested time.Time `codec:"ingested,omitempty"`
+	// graph inlet which the packet entered from
+	Inlet    PortKey `codec:"inlet,omitempty"`
+	// joints which the packet went through, recorded only if MetaGraph.RecordHops is set
+	Hops     []JointKey `codec:"hops,omitempty"`
+	Headers  map[string]string `codec:"headers,omitempty"`
+	// span of the last hop, recorded only if MetaGraph.Tracer is set. replaced on each hop, never modified.
+	// set it before Push to continue a trace from outside
+	Trace    *SpanContext `codec:"trace,omitempty"`
+}
+
+func (self *Metadata) Header(key string) (string, bool) {
+	v, ok := self.Headers[key]
+	return v, ok
+}
+
+func (self *Metadata) SetHeader(key, value string) {
+	if self.Headers == nil {
+		self.Headers = make(map[string]string)
+	}
+	self.Headers[key] = value
+}
+
+func (self Metadata) clone() Metadata {
+	if self.Hops != nil {
+		self.Hops = append([]JointKey(nil), self.Hops...)
+	}
+	if self.Headers != nil {
+		headers := make(map[string]string, len(self.Headers))
+		for k, v := range self.Headers {
+			headers[k] = v
+		}
+		self.Headers = headers
+	}
+	return self
+}
+
+// stamp when and where the packet entered a graph, the first graph wins
+func (self *Metadata) ingest(inlet PortKey) {
+	if self.Ingested.IsZero() {
+		self.Ingested = time.Now()
+		self.Inlet = inlet
+	}
+}
+
 type Packet struct {
-	value map[string]interface{}
+	value  map[string]interface{}
+	meta   Metadata
+	// payload is shared with other packets, and copied before the first write
+	shared bool
 }
 
 func NewPacket() *Packet {
 	return &Packet{
 		value: make(map[string]interface{}),
+		meta: Metadata{
+			ID: newPacketID(),
+			Created: time.Now(),
+		},
+	}
+}
+
+func newPacketID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
 	}
+	return hex.EncodeToString(buf)
 }
 
+// Nested values got from Get must not be modified in place, Set modified copy of them instead,
+// or they will leak into packets sharing payload.
 func (self *Packet) Set(key string, value interface{}) {
+	if self.shared {
+		self.value = deepCopyMap(self.value)
+		self.shared = false
+	}
 	self.value[key] = value
 }
 
@@ -19,6 +103,54 @@ func (self *Packet) Get(key string) (interface{}, bool) {
 	return v, ok
 }
 
+// copy of payload fields
+func (self *Packet) Fields() map[string]interface{} {
+	ret := make(map[string]interface{}, len(self.value))
+	for k, v := range self.value {
+		ret[k] = v
+	}
+	return ret
+}
+
+// Deep copy of payload and metadata, ID is kept as clone is the same packet for other branch.
+func (self *Packet) Clone() *Packet {
+	return &Packet{
+		value: deepCopyMap(self.value),
+		meta: self.meta.clone(),
+	}
+}
+
+// Packet sharing payload with self as it is, with a copy of metadata
+func (self *Packet) sharePayload() *Packet {
+	return &Packet{
+		value: self.value,
+		meta: self.meta.clone(),
+		shared: self.shared,
+	}
+}
+
+// Copy which shares payload with self until either of them is modified
+func (self *Packet) CopyOnWrite() *Packet {
+	self.shared = true
+	return &Packet{
+		value: self.value,
+		meta: self.meta.clone(),
+		shared: true,
+	}
+}
+
+func (self *Packet) View() PacketView {
+	return PacketView{self}
+}
+
+func (self *Packet) Meta() *Metadata {
+	return &self.meta
+}
+
+func (self *Packet) ID() string {
+	return self.meta.ID
+}
+
 func NewPacket_Single(data interface{}) *Packet {
 	pkt := NewPacket()
 	pkt.Set("data", data)
@@ -27,13 +159,93 @@ func NewPacket_Single(data interface{}) *Packet {
 
 func NewPacket_OK() *Packet {
 	pkt := NewPacket()
-	pkt.Set("status", "ok")
+	pkt.meta.SetHeader(HEADER_STATUS, "ok")
 	return pkt
 }
 
 func NewPacket_Error(message string) *Packet {
 	pkt := NewPacket()
-	pkt.Set("status", "error")
-	pkt.Set("message", message)
+	pkt.meta.SetHeader(HEADER_STATUS, "error")
+	pkt.meta.SetHeader(HEADER_MESSAGE, message)
 	return pkt
 }
+
+// Read-only view of a packet
+type PacketView struct {
+	pkt *Packet
+}
+
+func (self PacketView) Get(key string) (interface{}, bool) {
+	return self.pkt.Get(key)
+}
+
+func (self PacketView) Fields() map[string]interface{} {
+	return self.pkt.Fields()
+}
+
+func (self PacketView) ID() string {
+	return self.pkt.ID()
+}
+
+// copy of metadata
+func (self PacketView) Meta() Metadata {
+	return self.pkt.meta.clone()
+}
+
+// writable copy
+func (self PacketView) Clone() *Packet {
+	return self.pkt.Clone()
+}
+
+func deepCopyMap(src map[string]interface{}) map[string]interface{} {
+	ret := make(map[string]interface{}, len(src))
+	for k, v := range src {
+		ret[k] = deepCopy(v)
+	}
+	return ret
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch x := v.(type) {
+	case nil, string, bool, int, int64, uint64, float64:
+		return x
+	case map[string]interface{}:
+		return deepCopyMap(x)
+	case []interface{}:
+		ret := make([]interface{}, len(x))
+		for i, item := range x {
+			ret[i] = deepCopy(item)
+		}
+		return ret
+	case []byte:
+		return append([]byte(nil), x...)
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Map:
+		ret := reflect.MakeMapWithSize(rv.Type(), rv.Len())
+		for _, key := range rv.MapKeys() {
+			ret.SetMapIndex(key, deepCopyValue(rv.MapIndex(key), rv.Type().Elem()))
+		}
+		return ret.Interface()
+	case reflect.Slice:
+		if rv.IsNil() {
+			return v
+		}
+		ret := reflect.MakeSlice(rv.Type(), rv.Len(), rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			ret.Index(i).Set(deepCopyValue(rv.Index(i), rv.Type().Elem()))
+		}
+		return ret.Interface()
+	default:
+		// scalars, and values the packet does not own (e.g. pointers)
+		return v
+	}
+}
+
+func deepCopyValue(v reflect.Value, typ reflect.Type) reflect.Value {
+	if !v.IsValid() || (v.Kind() == reflect.Interface && v.IsNil()) {
+		return reflect.Zero(typ)
+	}
+	return reflect.ValueOf(deepCopy(v.Interface())).Convert(typ)
+}
@@ -0,0 +1,136 @@
+package core
+
+import (
+	"github.com/pkg/errors"
+	"github.com/ugorji/go/codec"
+	"io"
+	"reflect"
+)
+
+// Handles for packet wire format,
+// integers are decoded as int64, floats as float64 and objects as map[string]interface{}
+var (
+	PacketJsonHandle    *codec.JsonHandle = &codec.JsonHandle{}
+	PacketMsgpackHandle *codec.MsgpackHandle = &codec.MsgpackHandle{}
+	PacketCborHandle    *codec.CborHandle = &codec.CborHandle{}
+)
+
+func init() {
+	mapType := reflect.TypeOf(map[string]interface{}(nil))
+	PacketJsonHandle.MapType = mapType
+	PacketJsonHandle.SignedInteger = true
+	PacketJsonHandle.HTMLCharsAsIs = true
+	// newline after each packet
+	PacketJsonHandle.TermWhitespace = true
+
+	PacketMsgpackHandle.MapType = mapType
+	PacketMsgpackHandle.SignedInteger = true
+	PacketMsgpackHandle.RawToString = true
+	PacketMsgpackHandle.WriteExt = true
+
+	PacketCborHandle.MapType = mapType
+	// NOTE: timestamps are rounded to microseconds in cbor
+	PacketCborHandle.SignedInteger = true
+}
+
+// Stable wire representation of a packet
+type wirePacket struct {
+	Meta  Metadata `codec:"meta"`
+	Value map[string]interface{} `codec:"value"`
+}
+
+func toWire(pkt *Packet) *wirePacket {
+	return &wirePacket{
+		Meta: pkt.meta,
+		Value: pkt.value,
+	}
+}
+
+func (self *wirePacket) packet() *Packet {
+	if self.Value == nil {
+		self.Value = make(map[string]interface{})
+	}
+	return &Packet{
+		value: self.Value,
+		meta: self.Meta,
+	}
+}
+
+// Writes packets one after another into a stream
+type PacketEncoder struct {
+	enc *codec.Encoder
+}
+
+func NewPacketEncoder(writer io.Writer, handle codec.Handle) *PacketEncoder {
+	return &PacketEncoder{
+		enc: codec.NewEncoder(writer, handle),
+	}
+}
+
+func (self *PacketEncoder) Encode(pkt *Packet) error {
+	return self.enc.Encode(toWire(pkt))
+}
+
+// Reads packets written by PacketEncoder from a stream
+type PacketDecoder struct {
+	dec *codec.Decoder
+}
+
+func NewPacketDecoder(reader io.Reader, handle codec.Handle) *PacketDecoder {
+	return &PacketDecoder{
+		dec: codec.NewDecoder(reader, handle),
+	}
+}
+
+// returns io.EOF at the end of the stream
+func (self *PacketDecoder) Decode() (*Packet, error) {
+	wire := &wirePacket{}
+	if err := self.dec.Decode(wire); err != nil {
+		if errors.Cause(err) == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return wire.packet(), nil
+}
+
+func EncodePacket(pkt *Packet, handle codec.Handle) ([]byte, error) {
+	var buf []byte
+	err := codec.NewEncoderBytes(&buf, handle).Encode(toWire(pkt))
+	return buf, err
+}
+
+func DecodePacket(data []byte, handle codec.Handle) (*Packet, error) {
+	wire := &wirePacket{}
+	if err := codec.NewDecoderBytes(data, handle).Decode(wire); err != nil {
+		return nil, err
+	}
+	return wire.packet(), nil
+}
+
+// Write packets one after another, for states of controllers
+func WritePackets(writer io.Writer, packets []*Packet, handle codec.Handle) error {
+	enc := NewPacketEncoder(writer, handle)
+	for _, pkt := range packets {
+		if err := enc.Encode(pkt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read packets written by WritePackets until the end of the stream
+func ReadPackets(reader io.Reader, handle codec.Handle) ([]*Packet, error) {
+	dec := NewPacketDecoder(reader, handle)
+	var ret []*Packet
+	for {
+		pkt, err := dec.Decode()
+		if err == io.EOF {
+			return ret, nil
+		}
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, pkt)
+	}
+}
@@ -0,0 +1,58 @@
+package core
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/ugorji/go/codec"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	handles := map[string]codec.Handle{
+		"json": PacketJsonHandle,
+		"msgpack": PacketMsgpackHandle,
+		"cbor": PacketCborHandle,
+	}
+	for name, handle := range handles {
+		assert := assert.New(t)
+		packets := make([]*Packet, 0, 3)
+		for i := 0; i < 3; i++ {
+			pkt := NewPacket()
+			pkt.Set("int", i)
+			pkt.Set("float", 1.0)
+			pkt.Set("string", "foo")
+			pkt.Set("nested", map[string]interface{}{"list": []interface{}{int64(1), "bar", 2.5}})
+			pkt.Meta().SetHeader("h", "v")
+			pkt.meta.ingest("in")
+			pkt.meta.Hops = []JointKey{"j1", "j2"}
+			packets = append(packets, pkt)
+		}
+		buf := &bytes.Buffer{}
+		enc := NewPacketEncoder(buf, handle)
+		for _, pkt := range packets {
+			assert.NoError(enc.Encode(pkt), name)
+		}
+		dec := NewPacketDecoder(buf, handle)
+		for i, expected := range packets {
+			actual, err := dec.Decode()
+			if !assert.NoError(err, name) {
+				t.FailNow()
+			}
+			assert.Equal(int64(i), actual.value["int"], name)
+			assert.Equal(1.0, actual.value["float"], name)
+			assert.Equal("foo", actual.value["string"], name)
+			assert.Equal(map[string]interface{}{"list": []interface{}{int64(1), "bar", 2.5}}, actual.value["nested"], name)
+			assert.Equal(expected.ID(), actual.ID(), name)
+			// cbor rounds timestamps to microseconds
+			assert.WithinDuration(expected.meta.Created, actual.meta.Created, time.Microsecond, name)
+			assert.WithinDuration(expected.meta.Ingested, actual.meta.Ingested, time.Microsecond, name)
+			assert.Equal(expected.meta.Inlet, actual.meta.Inlet, name)
+			assert.Equal(expected.meta.Hops, actual.meta.Hops, name)
+			assert.Equal(expected.meta.Headers, actual.meta.Headers, name)
+		}
+		_, err := dec.Decode()
+		assert.Equal(io.EOF, err, name)
+	}
+}
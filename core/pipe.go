@@ -3,6 +3,8 @@ package core
 import (
 	"fmt"
 	"container/list"
+	"context"
+	"sync/atomic"
 )
 
 type PipeMode int
@@ -11,11 +13,25 @@ const (
 	PIPE_DIRECT PipeMode = iota
 	PIPE_CHANNEL
 	PIPE_ROUTINE
+	// pushed packets are buffered until downstream gives credit or pulls them
+	PIPE_DEMAND
+)
+
+type CopyPolicy int
+
+const (
+	// every branch receives the same packet,
+	// or the same payload with its own metadata if MetaGraph.RecordHops or Tracer is set
+	COPY_SHARE CopyPolicy = iota
+	// every branch receives a deep copy
+	COPY_CLONE
+	// branches share payload until one of them modifies it
+	COPY_ON_WRITE
 )
 
 type Pipe interface {
-	Send(data *Packet)
-	Drain(param *DrainRequest) *DrainResponse
+	Send(ctx context.Context, data *Packet) error
+	Drain(ctx context.Context, param *DrainRequest) (*DrainResponse, error)
 }
 
 type DrainRequest struct {
@@ -23,7 +39,18 @@ type DrainRequest struct {
 }
 
 type DrainResponse struct {
-	Items []*Packet
+	Items       []*Packet
+	// true if the drain was cut short (e.g. by cancellation of the context),
+	// Items holds packets gathered until then.
+	Interrupted bool
+}
+
+// Partial response for the drain cut short
+func NewInterruptedResponse(items []*Packet) *DrainResponse {
+	return &DrainResponse{
+		Items: items,
+		Interrupted: true,
+	}
 }
 
 type PipeSpace map[PortKey]Pipe
@@ -53,36 +80,89 @@ func (self PipeSpace) Define(key PortKey) error {
 	}
 }
 
+// Mode for the whole graph, ignoring its topology. See PlanPlacement for per bridge decision.
 func FlavorToMode(flavor PerformanceFlavor) PipeMode {
-	throughput := flavor & FlavorBetterLatency != 0
+	throughput := flavor & FlavorBetterThroughput != 0
 	latency := flavor & FlavorBetterLatency != 0
 	footprint := flavor & FlavorBetterFootprint != 0
 	switch {
-	// more intelligent flow control?
 	case latency:
 		return PIPE_DIRECT
-	case footprint:
-		return PIPE_CHANNEL
 	case throughput:
 		return PIPE_ROUTINE
+	case footprint:
+		return PIPE_CHANNEL
 	default:
 		return PIPE_CHANNEL
 	}
 }
 
 type JointBridge struct {
+	// counters, accessed atomically
+	filtered    uint64
+	dropped     uint64
 	Source      Endpoint
 	Destination Endpoint
 	Mode        PipeMode
+	// true --> Mode is decided by the placement planner at Concrete
+	AutoMode    bool
+	// optional, to look up the bridge
+	Name        string
+	// queue capacity of channel, routine and demand modes in packets, batches count as their sizes.
+	// decided by the planner or DEFAULT_PIPE_BUFFER if 0
+	Buffer      int
+	// what to do when the queue is full, for channel, routine and demand modes
+	Overflow    OverflowPolicy
+	// nil --> every packet passes
+	Filter      *Filter
+	// log packets to disk until the destination accepts them, see WalOptions. requires Name
+	Durable     bool
+	queue       *bridgeQueue
+	demand      *demandBuffer
+	// call path bound to the destination, see fuseBridges
+	fused       Pipe
+	wal         *bridgeLog
+	// capacity decided by the planner for AutoMode bridges without Buffer, kept apart so that Buffer stays as declared
+	planned     int
 }
 
 func (self *JointBridge) Repr() string {
+	if self.Name != "" {
+		return fmt.Sprintf("%s[%s:%s-%s:%s]", self.Name, self.Source.Joint, self.Source.Port, self.Destination.Joint, self.Destination.Port)
+	}
 	return fmt.Sprintf("[%s:%s-%s:%s]", self.Source.Joint, self.Source.Port, self.Destination.Joint, self.Destination.Port)
 }
 
+// queue capacity in effect
+func (self *JointBridge) capacity() int {
+	switch {
+	case self.Buffer != 0:
+		return self.Buffer
+	case self.planned != 0:
+		return self.planned
+	default:
+		return DEFAULT_PIPE_BUFFER
+	}
+}
+
+// number of packets discarded by the filter
+func (self *JointBridge) Filtered() uint64 {
+	return atomic.LoadUint64(&self.filtered)
+}
+
+// number of packets discarded by the overflow policy
+func (self *JointBridge) Dropped() uint64 {
+	return atomic.LoadUint64(&self.dropped)
+}
+
+func (self *JointBridge) countDropped(n int) {
+	atomic.AddUint64(&self.dropped, uint64(n))
+}
+
 func NewMetaPipe(flavor PerformanceFlavor) *JointBridge {
 	return &JointBridge{
 		Mode: FlavorToMode(flavor),
+		AutoMode: true,
 	}
 }
 
@@ -100,12 +180,51 @@ func NewDelegatePipe(graph *MetaGraph, src, dst Endpoint) *DelegatePipe {
 	}
 }
 
-func (dp *DelegatePipe) Send(data *Packet) {
-	dp.delegate.SendToNode(dp.destination, data)
+func (dp *DelegatePipe) Send(ctx context.Context, data *Packet) error {
+	if err := dp.delegate.validateBridge(dp.source, dp.destination, data); err != nil {
+		return err
+	}
+	return dp.delegate.SendToNode(ctx, dp.destination, data)
+}
+
+func (dp *DelegatePipe) Drain(ctx context.Context, param *DrainRequest) (*DrainResponse, error) {
+	res, err := dp.delegate.DrainFromNode(ctx, dp.source, param)
+	if err == nil && res != nil {
+		for _, item := range res.Items {
+			if err := dp.delegate.validateBridge(dp.source, dp.destination, item); err != nil {
+				return res, err
+			}
+		}
+	}
+	return res, err
+}
+
+// sends a packet to every pipe, copying it according to CopyPolicy of the graph
+type FanOutPipe struct {
+	graph *MetaGraph
+	pipes []Pipe
+}
+
+func NewFanOutPipe(graph *MetaGraph, pipes []Pipe) *FanOutPipe {
+	return &FanOutPipe{
+		graph: graph,
+		pipes: pipes,
+	}
+}
+
+// Every branch is tried even if some of them fail, returns the first error.
+func (self *FanOutPipe) Send(ctx context.Context, data *Packet) error {
+	var firstErr error
+	for i, item := range self.graph.FanOut(data, len(self.pipes)) {
+		if err := self.pipes[i].Send(ctx, item); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
-func (dp *DelegatePipe) Drain(param *DrainRequest) *DrainResponse {
-	return dp.delegate.DrainFromNode(dp.source, param)
+func (self *FanOutPipe) Drain(ctx context.Context, param *DrainRequest) (*DrainResponse, error) {
+	return nil, &UnsupportedOperation{"FanOutPipe", "Drain"}
 }
 
 // call destination's method directly
@@ -121,12 +240,12 @@ func NewDirectPipe(target Node, port PortKey) DirectPipe {
 	}
 }
 
-func (self DirectPipe) Send(data *Packet) {
-	self.dstJoint.Push(self.dstPort, data)
+func (self DirectPipe) Send(ctx context.Context, data *Packet) error {
+	return self.dstJoint.Push(ctx, self.dstPort, data)
 }
 
-func (self DirectPipe) Drain(param *DrainRequest) *DrainResponse {
-	return self.dstJoint.Pull(self.dstPort, param)
+func (self DirectPipe) Drain(ctx context.Context, param *DrainRequest) (*DrainResponse, error) {
+	return self.dstJoint.Pull(ctx, self.dstPort, param)
 }
 
 func (self DirectPipe) Close() {
@@ -142,12 +261,13 @@ type FuncTerminator struct {
 	handler func(*Packet)
 }
 
-func (self *FuncTerminator) Send(data *Packet) {
+func (self *FuncTerminator) Send(ctx context.Context, data *Packet) error {
 	self.handler(data)
+	return nil
 }
 
-func (self *FuncTerminator) Drain(param *DrainRequest) *DrainResponse {
-	panic("FuncTerminator is Output only pipe")
+func (self *FuncTerminator) Drain(ctx context.Context, param *DrainRequest) (*DrainResponse, error) {
+	return nil, &UnsupportedOperation{"FuncTerminator", "Drain"}
 }
 
 func NewFuncTerminator(handler func(*Packet)) *FuncTerminator {
@@ -166,12 +286,13 @@ func NewBufferTerminator() *BufferTerminator {
 	}
 }
 
-func (self *BufferTerminator) Send(data *Packet) {
+func (self *BufferTerminator) Send(ctx context.Context, data *Packet) error {
 	self.buf.PushBack(data)
+	return nil
 }
 
-func (self *BufferTerminator) Drain(param *DrainRequest) *DrainResponse {
-	panic("BufferTerminator os Output only pipe")
+func (self *BufferTerminator) Drain(ctx context.Context, param *DrainRequest) (*DrainResponse, error) {
+	return nil, &UnsupportedOperation{"BufferTerminator", "Drain"}
 }
 
 func (self *BufferTerminator) ToArray() []*Packet {
@@ -200,11 +321,11 @@ func NewBufferSource(items []*Packet) *BufferSource {
 	}
 }
 
-func (bs *BufferSource) Send(data *Packet) {
-	panic("BufferSource does not support push items.")
+func (bs *BufferSource) Send(ctx context.Context, data *Packet) error {
+	return &UnsupportedOperation{"BufferSource", "Send"}
 }
 
-func (bs *BufferSource) Drain(param *DrainRequest) *DrainResponse {
+func (bs *BufferSource) Drain(ctx context.Context, param *DrainRequest) (*DrainResponse, error) {
 	var ret []*Packet
 	if param.Count < len(bs.Items) {
 		ret = bs.Items[param.Count:]
@@ -215,5 +336,5 @@ func (bs *BufferSource) Drain(param *DrainRequest) *DrainResponse {
 	}
 	return &DrainResponse{
 		Items: ret,
-	}
+	}, nil
 }
@@ -0,0 +1,201 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const (
+	// queue capacity chosen by the planner for FlavorBetterFootprint
+	FOOTPRINT_PIPE_BUFFER = 8
+)
+
+// Performance characteristics of a component, used by the placement planner
+type ComponentHints struct {
+	// spends most of the time computing, worth running in parallel
+	CPUBound bool
+}
+
+// Component which tells its hints, components without hints are treated as light weight
+type HintedComponent interface {
+	Hints() ComponentHints
+}
+
+func HintsOf(component Component) ComponentHints {
+	if hinted, ok := component.(HintedComponent); ok {
+		return hinted.Hints()
+	}
+	return ComponentHints{}
+}
+
+// Mode chosen for a bridge, with the reason
+type PlacementDecision struct {
+	Bridge  *JointBridge
+	Mode    PipeMode
+	// queue capacity, 0 --> as configured on the bridge
+	Buffer  int
+	// link of a chain, both ends have no other bridges
+	Fusable bool
+	Reason  string
+}
+
+type PlacementPlan struct {
+	Flavor    PerformanceFlavor
+	Decisions []*PlacementDecision
+	// joints connected by fusable bridges, from upstream to downstream
+	Chains    [][]JointKey
+}
+
+// Human readable description of the plan
+func (self *PlacementPlan) Explain() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "flavor: %s\n", FlavorNames(self.Flavor))
+	for _, d := range self.Decisions {
+		fmt.Fprintf(&buf, "%s %s", d.Bridge.Repr(), d.Mode.Name())
+		if d.Buffer != 0 {
+			fmt.Fprintf(&buf, "(%d)", d.Buffer)
+		}
+		if d.Fusable {
+			buf.WriteString(" fusable")
+		}
+		fmt.Fprintf(&buf, ": %s\n", d.Reason)
+	}
+	for _, chain := range self.Chains {
+		keys := make([]string, len(chain))
+		for i, key := range chain {
+			keys[i] = string(key)
+		}
+		fmt.Fprintf(&buf, "chain: %s\n", strings.Join(keys, " -> "))
+	}
+	return buf.String()
+}
+
+// Decision for the bridge, nil if not in the plan
+func (self *PlacementPlan) Decision(br *JointBridge) *PlacementDecision {
+	for _, d := range self.Decisions {
+		if d.Bridge == br {
+			return d
+		}
+	}
+	return nil
+}
+
+// names of set bits, joined by "|"
+func FlavorNames(flavor PerformanceFlavor) string {
+	var names []string
+	for bit := FlavorBetterLatency; bit <= FlavorBetterFootprint; bit <<= 1 {
+		if flavor & bit != 0 {
+			names = append(names, bit.String())
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// Choose a mode for each bridge from the topology of the graph, Flavor and hints of components.
+//
+// Bridges at graph boundary stay direct, since sinks and sources belong to the caller.
+// Bridges into CPU-bound joints run in parallel if throughput is preferred.
+// Links of chains (single bridge between both joints) are direct and fusable.
+// Other fan-in and fan-out points are direct if latency is preferred, and queued otherwise.
+// Footprint preference bounds the queues small.
+func (mg *MetaGraph) PlanPlacement() *PlacementPlan {
+	latency := mg.Flavor & FlavorBetterLatency != 0
+	throughput := mg.Flavor & FlavorBetterThroughput != 0
+	footprint := mg.Flavor & FlavorBetterFootprint != 0
+	fanIn := make(map[JointKey]int)
+	fanOut := make(map[JointKey]int)
+	for _, br := range mg.Pipes {
+		fanOut[br.Source.Joint] += 1
+		fanIn[br.Destination.Joint] += 1
+	}
+	plan := &PlacementPlan{
+		Flavor: mg.Flavor,
+	}
+	for _, br := range mg.Pipes {
+		d := &PlacementDecision{
+			Bridge: br,
+		}
+		chainLink := br.Source.Joint != GRAPH && br.Destination.Joint != GRAPH &&
+			fanOut[br.Source.Joint] == 1 && fanIn[br.Destination.Joint] == 1
+		switch {
+		case !br.AutoMode:
+			d.Mode, d.Reason = br.Mode, "mode given explicitly"
+		case br.Source.Joint == GRAPH || br.Destination.Joint == GRAPH:
+			d.Mode, d.Reason = PIPE_DIRECT, "graph boundary"
+		case throughput && mg.cpuBound(br.Destination.Joint):
+			d.Mode, d.Reason = PIPE_ROUTINE, "destination is CPU-bound, run in parallel for throughput"
+		case chainLink:
+			d.Mode, d.Reason = PIPE_DIRECT, "single producer and single consumer"
+		case latency:
+			d.Mode, d.Reason = PIPE_DIRECT, fmt.Sprintf("fan-out %d, fan-in %d, direct for latency", fanOut[br.Source.Joint], fanIn[br.Destination.Joint])
+		case throughput:
+			d.Mode, d.Reason = PIPE_CHANNEL, fmt.Sprintf("fan-out %d, fan-in %d, decoupled for throughput", fanOut[br.Source.Joint], fanIn[br.Destination.Joint])
+		default:
+			d.Mode, d.Reason = FlavorToMode(mg.Flavor), fmt.Sprintf("fan-out %d, fan-in %d", fanOut[br.Source.Joint], fanIn[br.Destination.Joint])
+		}
+		d.Fusable = chainLink && d.Mode == PIPE_DIRECT
+		if footprint && br.AutoMode && d.Mode != PIPE_DIRECT && br.Buffer == 0 {
+			d.Buffer = FOOTPRINT_PIPE_BUFFER
+			d.Reason += ", small queue for footprint"
+		}
+		plan.Decisions = append(plan.Decisions, d)
+	}
+	plan.Chains = fusableChains(plan.Decisions)
+	return plan
+}
+
+func (mg *MetaGraph) cpuBound(key JointKey) bool {
+	joint, ok := mg.Joints[key]
+	if !ok || mg.Universe == nil {
+		return false
+	}
+	component, ok := mg.Universe.Components[joint.Component]
+	return ok && HintsOf(component).CPUBound
+}
+
+// maximal paths of joints connected by fusable bridges
+func fusableChains(decisions []*PlacementDecision) [][]JointKey {
+	next := make(map[JointKey]JointKey)
+	hasPrev := make(map[JointKey]bool)
+	for _, d := range decisions {
+		if d.Fusable {
+			next[d.Bridge.Source.Joint] = d.Bridge.Destination.Joint
+			hasPrev[d.Bridge.Destination.Joint] = true
+		}
+	}
+	var ret [][]JointKey
+	for _, d := range decisions {
+		head := d.Bridge.Source.Joint
+		if !d.Fusable || hasPrev[head] {
+			continue
+		}
+		chain := []JointKey{head}
+		for key, ok := next[head]; ok; key, ok = next[key] {
+			chain = append(chain, key)
+		}
+		ret = append(ret, chain)
+	}
+	return ret
+}
+
+// Set modes of bridges as planned, bridges with explicit mode are untouched.
+// Must be called before the bridges are started by Concrete.
+func (mg *MetaGraph) ApplyPlan(plan *PlacementPlan) {
+	for _, d := range plan.Decisions {
+		if !d.Bridge.AutoMode || d.Bridge.queue != nil {
+			continue
+		}
+		d.Bridge.Mode = d.Mode
+		d.Bridge.planned = d.Buffer
+	}
+	mg.placement = plan
+}
+
+// Plan applied at the last Concrete, nil before it
+func (mg *MetaGraph) Placement() *PlacementPlan {
+	return mg.placement
+}
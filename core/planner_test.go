@@ -0,0 +1,122 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/ugorji/go/codec"
+	"io"
+	"testing"
+)
+
+type planComponent struct {
+	key   ComponentKey
+	hints ComponentHints
+}
+
+func (self *planComponent) DecodeParam(decoder *codec.Decoder, data json.RawMessage) (ComponentParam, error) {
+	return &EmptyComponentParam{self.key}, nil
+}
+
+func (self *planComponent) Name() ComponentKey {
+	return self.key
+}
+
+func (self *planComponent) Hints() ComponentHints {
+	return self.hints
+}
+
+func (self *planComponent) CreateController(metaJoint *MetaJoint, param interface{}, graph *MetaGraph) (JointController, error) {
+	return &planController{}, nil
+}
+
+func (self *planComponent) Save(joint *MetaJoint, writer io.Writer) error {
+	return nil
+}
+
+func (self *planComponent) Restore(joint *MetaJoint, reader io.Reader) error {
+	return nil
+}
+
+type planController struct {
+}
+
+func (self *planController) Push(ctx context.Context, port PortKey, data *Packet) error {
+	return nil
+}
+
+func (self *planController) Pull(ctx context.Context, port PortKey, param *DrainRequest) (*DrainResponse, error) {
+	return &DrainResponse{}, nil
+}
+
+func (self *planController) Concrete(joint *MetaJoint, graph *MetaGraph) error {
+	return nil
+}
+
+// in -> a -> b -> c -> (d1, d2) -> e -> out, e is CPU-bound
+func planGraph(flavor PerformanceFlavor) *MetaGraph {
+	univ := NewUniverse([]Component{
+		&planComponent{key: "light"},
+		&planComponent{key: "heavy", hints: ComponentHints{CPUBound: true}},
+	}, nil)
+	mg := NewMetaGraph(univ)
+	mg.Flavor = flavor
+	for _, key := range []JointKey{"a", "b", "c", "d1", "d2"} {
+		mg.AddJointByComponent(key, &EmptyComponentParam{"light"})
+	}
+	mg.AddJointByComponent("e", &EmptyComponentParam{"heavy"})
+	mg.AddBridge(GRAPH, "in", "a", "in")
+	mg.AddBridge("a", "out", "b", "in")
+	mg.AddBridge("b", "out", "c", "in")
+	mg.AddBridge("c", "out", "d1", "in")
+	mg.AddBridge("c", "out", "d2", "in")
+	mg.AddBridge("d1", "out", "e", "in0")
+	mg.AddBridge("d2", "out", "e", "in1")
+	mg.AddBridge("e", "out", GRAPH, "out")
+	return mg
+}
+
+func planModes(plan *PlacementPlan) []PipeMode {
+	ret := make([]PipeMode, 0, len(plan.Decisions))
+	for _, d := range plan.Decisions {
+		ret = append(ret, d.Mode)
+	}
+	return ret
+}
+
+func TestFlavorToMode(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(PIPE_DIRECT, FlavorToMode(FlavorBetterLatency))
+	assert.Equal(PIPE_ROUTINE, FlavorToMode(FlavorBetterThroughput))
+	assert.Equal(PIPE_CHANNEL, FlavorToMode(FlavorBetterFootprint))
+	assert.Equal(PIPE_DIRECT, FlavorToMode(FlavorBetterLatency | FlavorBetterThroughput))
+}
+
+func TestPlanPlacement(t *testing.T) {
+	assert := assert.New(t)
+	plan := planGraph(FlavorBetterLatency).PlanPlacement()
+	assert.Equal([]PipeMode{PIPE_DIRECT, PIPE_DIRECT, PIPE_DIRECT, PIPE_DIRECT, PIPE_DIRECT, PIPE_DIRECT, PIPE_DIRECT, PIPE_DIRECT}, planModes(plan))
+	assert.Equal([][]JointKey{{"a", "b", "c"}}, plan.Chains)
+
+	mg := planGraph(FlavorBetterThroughput | FlavorBetterFootprint)
+	plan = mg.PlanPlacement()
+	assert.Equal([]PipeMode{PIPE_DIRECT, PIPE_DIRECT, PIPE_DIRECT, PIPE_CHANNEL, PIPE_CHANNEL, PIPE_ROUTINE, PIPE_ROUTINE, PIPE_DIRECT}, planModes(plan))
+	assert.True(plan.Decisions[1].Fusable)
+	assert.False(plan.Decisions[3].Fusable)
+	assert.Equal(FOOTPRINT_PIPE_BUFFER, plan.Decisions[5].Buffer)
+	assert.Contains(plan.Explain(), "[d1:out-e:in0] routine(8): destination is CPU-bound")
+	assert.Contains(plan.Explain(), "chain: a -> b -> c")
+
+	// explicit modes are kept
+	mg.Pipes[3].Mode, mg.Pipes[3].AutoMode = PIPE_DIRECT, false
+	if assert.NoError(mg.Concrete()) {
+		assert.Equal(PIPE_DIRECT, mg.Pipes[3].Mode)
+		assert.Equal(PIPE_CHANNEL, mg.Pipes[4].Mode)
+		// declared buffer is left as is
+		assert.Equal(0, mg.Pipes[4].Buffer)
+		assert.Equal(FOOTPRINT_PIPE_BUFFER, mg.Pipes[4].capacity())
+		assert.Equal(FOOTPRINT_PIPE_BUFFER, mg.Pipes[4].queue.capacity)
+		assert.Equal("mode given explicitly", mg.Placement().Decision(mg.Pipes[3]).Reason)
+	}
+	assert.NoError(mg.Shutdown(context.Background()))
+}
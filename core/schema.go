@@ -0,0 +1,197 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+type FieldType string
+
+const (
+	TYPE_ANY    FieldType = "any"
+	TYPE_STRING FieldType = "string"
+	TYPE_INT    FieldType = "int"
+	// accepts integers too
+	TYPE_FLOAT  FieldType = "float"
+	TYPE_BOOL   FieldType = "bool"
+	// nested object, described by FieldSchema.Fields
+	TYPE_OBJECT FieldType = "object"
+	// each element described by FieldSchema.Items
+	TYPE_ARRAY  FieldType = "array"
+)
+
+func ParseFieldType(name string) (FieldType, error) {
+	switch t := FieldType(name); t {
+	case TYPE_ANY, TYPE_STRING, TYPE_INT, TYPE_FLOAT, TYPE_BOOL, TYPE_OBJECT, TYPE_ARRAY:
+		return t, nil
+	case "":
+		return TYPE_ANY, nil
+	default:
+		return TYPE_ANY, fmt.Errorf("Unknown field type %s", name)
+	}
+}
+
+type FieldSchema struct {
+	Type     FieldType
+	Required bool
+	// for TYPE_OBJECT, nil --> any fields
+	Fields   map[string]*FieldSchema
+	// for TYPE_ARRAY, nil --> any items
+	Items    *FieldSchema
+}
+
+// Schema describes fields of packets passing a port.
+// Fields not declared in the schema are allowed.
+type Schema struct {
+	Fields map[string]*FieldSchema
+}
+
+func NewSchema(fields map[string]*FieldSchema) *Schema {
+	return &Schema{
+		Fields: fields,
+	}
+}
+
+// returns *SchemaViolation for the first violation found
+func (self *Schema) Validate(pkt *Packet) error {
+	if reason, path := validateFields(self.Fields, pkt.value, ""); reason != "" {
+		return &SchemaViolation{Path: path, Reason: reason}
+	}
+	return nil
+}
+
+// fields are checked in order of names, so that the same violation is reported every time
+func validateFields(fields map[string]*FieldSchema, value map[string]interface{}, prefix string) (string, string) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		field := fields[name]
+		path := prefix + name
+		v, ok := value[name]
+		if !ok || v == nil {
+			if field.Required {
+				return "required field is missing", path
+			}
+			continue
+		}
+		if reason, at := field.validate(v, path); reason != "" {
+			return reason, at
+		}
+	}
+	return "", ""
+}
+
+func (self *FieldSchema) validate(v interface{}, path string) (string, string) {
+	if !self.Type.accepts(v) {
+		return fmt.Sprintf("expected %s but got %T", self.Type, v), path
+	}
+	switch self.Type {
+	case TYPE_OBJECT:
+		if self.Fields != nil {
+			return validateFields(self.Fields, asObject(v), path + ".")
+		}
+	case TYPE_ARRAY:
+		if self.Items != nil {
+			rv := reflect.ValueOf(v)
+			for i := 0; i < rv.Len(); i++ {
+				if reason, at := self.Items.validate(rv.Index(i).Interface(), fmt.Sprintf("%s[%d]", path, i)); reason != "" {
+					return reason, at
+				}
+			}
+		}
+	}
+	return "", ""
+}
+
+func (self FieldType) accepts(v interface{}) bool {
+	kind := reflect.TypeOf(v).Kind()
+	switch self {
+	case TYPE_STRING:
+		return kind == reflect.String
+	case TYPE_INT:
+		return isIntKind(kind)
+	case TYPE_FLOAT:
+		return isIntKind(kind) || kind == reflect.Float32 || kind == reflect.Float64
+	case TYPE_BOOL:
+		return kind == reflect.Bool
+	case TYPE_OBJECT:
+		_, ok := v.(map[string]interface{})
+		return ok
+	case TYPE_ARRAY:
+		return kind == reflect.Slice || kind == reflect.Array
+	default:
+		return true
+	}
+}
+
+func isIntKind(kind reflect.Kind) bool {
+	return reflect.Int <= kind && kind <= reflect.Uint64
+}
+
+func asObject(v interface{}) map[string]interface{} {
+	obj, _ := v.(map[string]interface{})
+	return obj
+}
+
+// Static check for a bridge: can packets satisfying upstream schema (self)
+// always satisfy downstream schema?
+// returns *SchemaIncompatible for the first drift found
+func (self *Schema) CompatibleWith(downstream *Schema) error {
+	if reason, path := compatibleFields(self.Fields, downstream.Fields, ""); reason != "" {
+		return &SchemaIncompatible{Path: path, Reason: reason}
+	}
+	return nil
+}
+
+func compatibleFields(up, down map[string]*FieldSchema, prefix string) (string, string) {
+	for name, downField := range down {
+		path := prefix + name
+		upField, ok := up[name]
+		if !ok {
+			if downField.Required {
+				return "required field is not provided by upstream", path
+			}
+			continue
+		}
+		if downField.Required && !upField.Required {
+			return "required field is optional at upstream", path
+		}
+		if reason, at := upField.compatibleWith(downField, path); reason != "" {
+			return reason, at
+		}
+	}
+	return "", ""
+}
+
+func (self *FieldSchema) compatibleWith(down *FieldSchema, path string) (string, string) {
+	switch {
+	case down.Type == TYPE_ANY:
+		return "", ""
+	case self.Type == down.Type:
+	case self.Type == TYPE_INT && down.Type == TYPE_FLOAT:
+		return "", ""
+	default:
+		return fmt.Sprintf("upstream %s is not assignable to %s", self.Type, down.Type), path
+	}
+	switch down.Type {
+	case TYPE_OBJECT:
+		if down.Fields != nil {
+			if self.Fields == nil {
+				return "upstream object has no declared fields", path
+			}
+			return compatibleFields(self.Fields, down.Fields, path + ".")
+		}
+	case TYPE_ARRAY:
+		if down.Items != nil {
+			if self.Items == nil {
+				return "upstream array has no declared items", path
+			}
+			return self.Items.compatibleWith(down.Items, path + "[]")
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,224 @@
+package core
+
+import (
+	"bytes"
+	"github.com/ugorji/go/codec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry of joint state
+type StateEntry struct {
+	Key     string `codec:"key"`
+	Value   []byte `codec:"value"`
+	// zero if the entry never expires
+	Expires time.Time `codec:"expires,omitempty"`
+}
+
+func (self *StateEntry) expired(now time.Time) bool {
+	return !self.Expires.IsZero() && !now.Before(self.Expires)
+}
+
+// Storage of joint states, divided into namespaces of joints. Expired entries are never returned.
+type StateBackend interface {
+	Get(ns, key string) ([]byte, bool, error)
+	Put(ns string, entry *StateEntry) error
+	Delete(ns, key string) error
+	// entries whose keys start with prefix in order of keys, stops at the first error of fn
+	Scan(ns, prefix string, fn func(entry *StateEntry) error) error
+	// replace every entry of the namespace
+	Replace(ns string, entries []*StateEntry) error
+	// remove entries expired by now
+	Purge(now time.Time) error
+	Close() error
+}
+
+// State of a joint, got by MetaJoint.State or MetaGraph.JointState
+type StateStore struct {
+	backend StateBackend
+	ns      string
+}
+
+func (self *StateStore) Namespace() string {
+	return self.ns
+}
+
+func (self *StateStore) Get(key string) ([]byte, bool, error) {
+	return self.backend.Get(self.ns, key)
+}
+
+func (self *StateStore) Put(key string, value []byte) error {
+	return self.backend.Put(self.ns, &StateEntry{Key: key, Value: value})
+}
+
+// Put the entry which expires after ttl
+func (self *StateStore) PutTTL(key string, value []byte, ttl time.Duration) error {
+	return self.backend.Put(self.ns, &StateEntry{key, value, time.Now().Add(ttl)})
+}
+
+func (self *StateStore) Delete(key string) error {
+	return self.backend.Delete(self.ns, key)
+}
+
+// entries whose keys start with prefix in order of keys
+func (self *StateStore) Scan(prefix string, fn func(key string, value []byte) error) error {
+	return self.backend.Scan(self.ns, prefix, func(entry *StateEntry) error {
+		return fn(entry.Key, entry.Value)
+	})
+}
+
+func (mg *MetaGraph) stateBackend() StateBackend {
+	if mg.State == nil {
+		mg.State = NewMemoryStateBackend()
+	}
+	return mg.State
+}
+
+// State of the joint in MetaGraph.State, namespaced by StateNamespace and the joint key.
+// Controllers get it in Concrete, entries stay after the joint is removed.
+func (mg *MetaGraph) JointState(key JointKey) *StateStore {
+	ns := string(key)
+	if mg.StateNamespace != "" {
+		ns = mg.StateNamespace + "/" + ns
+	}
+	return &StateStore{mg.stateBackend(), ns}
+}
+
+func (self *MetaJoint) State() *StateStore {
+	return self.graph.JointState(self.Key)
+}
+
+// Remove expired entries from MetaGraph.State
+func (mg *MetaGraph) PurgeState() error {
+	return mg.stateBackend().Purge(time.Now())
+}
+
+// every entry of the joint in msgpack, nil if empty
+func (mg *MetaGraph) saveJointState(key JointKey) ([]byte, error) {
+	var entries []*StateEntry
+	st := mg.JointState(key)
+	err := st.backend.Scan(st.ns, "", func(entry *StateEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := codec.NewEncoder(&buf, PacketMsgpackHandle).Encode(entries); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// replace state of the joint by entries written by saveJointState, emptied if data is nil
+func (mg *MetaGraph) restoreJointState(key JointKey, data []byte) error {
+	var entries []*StateEntry
+	if data != nil {
+		if err := codec.NewDecoderBytes(data, PacketMsgpackHandle).Decode(&entries); err != nil {
+			return err
+		}
+	}
+	st := mg.JointState(key)
+	return st.backend.Replace(st.ns, entries)
+}
+
+// StateBackend on maps, lost at exit unless written by checkpoints
+type MemoryStateBackend struct {
+	lock       sync.RWMutex
+	namespaces map[string]map[string]*StateEntry
+}
+
+func NewMemoryStateBackend() *MemoryStateBackend {
+	return &MemoryStateBackend{
+		namespaces: make(map[string]map[string]*StateEntry),
+	}
+}
+
+func (self *MemoryStateBackend) Get(ns, key string) ([]byte, bool, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	entry, ok := self.namespaces[ns][key]
+	if !ok || entry.expired(time.Now()) {
+		return nil, false, nil
+	}
+	return entry.Value, true, nil
+}
+
+func (self *MemoryStateBackend) Put(ns string, entry *StateEntry) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	entries, ok := self.namespaces[ns]
+	if !ok {
+		entries = make(map[string]*StateEntry)
+		self.namespaces[ns] = entries
+	}
+	entries[entry.Key] = &StateEntry{entry.Key, append([]byte(nil), entry.Value...), entry.Expires}
+	return nil
+}
+
+func (self *MemoryStateBackend) Delete(ns, key string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.namespaces[ns], key)
+	return nil
+}
+
+func (self *MemoryStateBackend) Scan(ns, prefix string, fn func(entry *StateEntry) error) error {
+	now := time.Now()
+	self.lock.RLock()
+	var found []*StateEntry
+	for key, entry := range self.namespaces[ns] {
+		if strings.HasPrefix(key, prefix) && !entry.expired(now) {
+			found = append(found, entry)
+		}
+	}
+	self.lock.RUnlock()
+	// fn may write into the backend
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Key < found[j].Key
+	})
+	for _, entry := range found {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *MemoryStateBackend) Replace(ns string, entries []*StateEntry) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(entries) == 0 {
+		delete(self.namespaces, ns)
+		return nil
+	}
+	replaced := make(map[string]*StateEntry, len(entries))
+	for _, entry := range entries {
+		replaced[entry.Key] = entry
+	}
+	self.namespaces[ns] = replaced
+	return nil
+}
+
+func (self *MemoryStateBackend) Purge(now time.Time) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for ns, entries := range self.namespaces {
+		for key, entry := range entries {
+			if entry.expired(now) {
+				delete(entries, key)
+			}
+		}
+		if len(entries) == 0 {
+			delete(self.namespaces, ns)
+		}
+	}
+	return nil
+}
+
+func (self *MemoryStateBackend) Close() error {
+	return nil
+}
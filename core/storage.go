@@ -5,3 +5,11 @@ type Storage interface {
 	Load(key string, univ *Universe) (*MetaGraph, error)
 }
 
+
+// Storage which also keeps checkpoints of graphs, see MetaGraph.SaveCheckpoint
+type CheckpointStorage interface {
+	Storage
+	SaveCheckpoint(key string, cp *Checkpoint) error
+	// nil without error if no checkpoint is stored under the key
+	LoadCheckpoint(key string) (*Checkpoint, error)
+}
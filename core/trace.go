@@ -0,0 +1,296 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// spans buffered by Tracer before exported, without BatchSize
+	DEFAULT_TRACE_BATCH = 64
+	// batches waiting for the exporter, without QueueSize
+	DEFAULT_TRACE_QUEUE = 16
+)
+
+// Identifies a span, carried by packets in Metadata.Trace
+type SpanContext struct {
+	// 16 bytes in hex
+	TraceID string `codec:"trace_id"`
+	// 8 bytes in hex
+	SpanID  string `codec:"span_id"`
+}
+
+// A hop of packets through a joint
+type Span struct {
+	SpanContext
+	// empty for the first hop of a packet
+	ParentID   string `codec:"parent_id,omitempty"`
+	// spans related without being parents, such as the drain which returned the packet
+	Links      []SpanContext `codec:"links,omitempty"`
+	// "push <joint>", "pull <joint>" or "drain <joint>"
+	Name       string `codec:"name"`
+	Joint      JointKey `codec:"joint"`
+	Port       PortKey `codec:"port"`
+	Start      time.Time `codec:"start"`
+	End        time.Time `codec:"end"`
+	// message of the error returned by the controller
+	Error      string `codec:"error,omitempty"`
+	Attributes map[string]string `codec:"attributes,omitempty"`
+}
+
+// Receives finished spans
+type SpanExporter interface {
+	ExportSpans(spans []*Span) error
+}
+
+// Records spans of every hop through joints, set to MetaGraph.Tracer.
+// Spans are buffered and exported in batches by a goroutine of the tracer, so that a slow exporter does not hold packets.
+// Batches are dropped while the queue to the exporter is full, call Flush before exit and Close to stop the goroutine.
+// Branches of a fan-out become siblings under the span of the hop before it, whatever the CopyPolicy.
+type Tracer struct {
+	Exporter  SpanExporter
+	// DEFAULT_TRACE_BATCH if zero
+	BatchSize int
+	// batches waiting for the exporter, DEFAULT_TRACE_QUEUE if zero
+	QueueSize int
+	// called with failures of export during tracing, written to stderr if nil
+	OnError   func(err error)
+	lock      sync.Mutex
+	buffer    []*Span
+	queue     chan []*Span
+	// batches queued and not exported yet, idle is signaled when it gets zero
+	pending   int
+	idle      *sync.Cond
+	dropped   uint64
+	closed    bool
+}
+
+func NewTracer(exporter SpanExporter) *Tracer {
+	return &Tracer{
+		Exporter: exporter,
+	}
+}
+
+func newTraceID(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// span starting now, child of parent or root of a new trace if parent is nil
+func (self *Tracer) start(name string, parent *SpanContext, joint JointKey, port PortKey) *Span {
+	span := &Span{
+		Name: name,
+		Joint: joint,
+		Port: port,
+		Start: time.Now(),
+	}
+	span.SpanID = newTraceID(8)
+	if parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+	} else {
+		span.TraceID = newTraceID(16)
+	}
+	return span
+}
+
+func (self *Tracer) end(spans []*Span, err error) {
+	now := time.Now()
+	for _, span := range spans {
+		span.End = now
+		if err != nil {
+			span.Error = err.Error()
+		}
+	}
+	batchSize := self.BatchSize
+	if batchSize <= 0 {
+		batchSize = DEFAULT_TRACE_BATCH
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		self.dropped += uint64(len(spans))
+		return
+	}
+	self.buffer = append(self.buffer, spans...)
+	if len(self.buffer) >= batchSize {
+		self.enqueue(self.buffer)
+		self.buffer = nil
+	}
+}
+
+// hand the batch to the export goroutine, started on the first batch. requires lock
+func (self *Tracer) enqueue(spans []*Span) {
+	if self.queue == nil {
+		size := self.QueueSize
+		if size <= 0 {
+			size = DEFAULT_TRACE_QUEUE
+		}
+		self.queue = make(chan []*Span, size)
+		self.idle = sync.NewCond(&self.lock)
+		go self.run(self.queue)
+	}
+	select {
+	case self.queue <- spans:
+		self.pending++
+	default:
+		self.dropped += uint64(len(spans))
+	}
+}
+
+func (self *Tracer) run(queue chan []*Span) {
+	for spans := range queue {
+		if err := self.Exporter.ExportSpans(spans); err != nil {
+			self.tellError(err)
+		}
+		self.lock.Lock()
+		self.pending--
+		if self.pending == 0 {
+			self.idle.Broadcast()
+		}
+		self.lock.Unlock()
+	}
+}
+
+// Number of spans dropped because the queue was full or the tracer was closed
+func (self *Tracer) Dropped() uint64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.dropped
+}
+
+func (self *Tracer) tellError(err error) {
+	if self.OnError != nil {
+		self.OnError(err)
+	} else {
+		fmt.Fprintf(os.Stderr, "ERR(TRACER): %v\n", err)
+	}
+}
+
+// Wait for queued batches to be exported, then export buffered spans
+func (self *Tracer) Flush() error {
+	self.lock.Lock()
+	spans := self.buffer
+	self.buffer = nil
+	for self.pending > 0 {
+		self.idle.Wait()
+	}
+	self.lock.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+	return self.Exporter.ExportSpans(spans)
+}
+
+// Flush, then stop the export goroutine. Spans ended later are dropped
+func (self *Tracer) Close() error {
+	err := self.Flush()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.closed {
+		self.closed = true
+		// ended while flushing
+		self.dropped += uint64(len(self.buffer))
+		self.buffer = nil
+		if self.queue != nil {
+			close(self.queue)
+		}
+	}
+	return err
+}
+
+type spanContextKey struct{}
+
+// Context carrying the span, drains under it become its children
+func ContextWithSpan(ctx context.Context, sc *SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// Span carried by the context, nil if none
+func SpanFromContext(ctx context.Context) *SpanContext {
+	sc, _ := ctx.Value(spanContextKey{}).(*SpanContext)
+	return sc
+}
+
+func (mg *MetaGraph) observed() bool {
+	return mg.Metrics != nil || mg.Tracer != nil
+}
+
+// Run push of the batch into the joint by fn, recording a span for each packet and measurements of MetaGraph.Metrics.
+// Packets carry their spans during fn, so that hops downstream become children of them.
+func (mg *MetaGraph) observePush(key JointKey, port PortKey, batch []*Packet, fn func() error) error {
+	var spans []*Span
+	if tracer := mg.Tracer; tracer != nil {
+		spans = make([]*Span, len(batch))
+		for i, data := range batch {
+			span := tracer.start("push " + string(key), data.meta.Trace, key, port)
+			span.Attributes = map[string]string{"packet.id": data.meta.ID}
+			if data.meta.Inlet != PORT_EMPTY {
+				span.Attributes["packet.inlet"] = string(data.meta.Inlet)
+			}
+			sc := span.SpanContext
+			data.meta.Trace = &sc
+			spans[i] = span
+		}
+	}
+	start := time.Now()
+	err := fn()
+	if metrics := mg.Metrics; metrics != nil {
+		metrics.ObservePush(key, len(batch), time.Since(start), err)
+	}
+	if spans != nil {
+		mg.Tracer.end(spans, err)
+	}
+	return err
+}
+
+// Run drain from the joint by fn under a span of the drain, which is a child of the span in ctx.
+// Each returned packet gets a span of its hop, a child of its last hop linked to the drain.
+func (mg *MetaGraph) observePull(ctx context.Context, key JointKey, port PortKey, param *DrainRequest, fn func(ctx context.Context) (*DrainResponse, error)) (*DrainResponse, error) {
+	var drain *Span
+	if tracer := mg.Tracer; tracer != nil {
+		drain = tracer.start("drain " + string(key), SpanFromContext(ctx), key, port)
+		sc := drain.SpanContext
+		ctx = ContextWithSpan(ctx, &sc)
+	}
+	start := time.Now()
+	res, err := fn(ctx)
+	returned := 0
+	if res != nil {
+		returned = len(res.Items)
+	}
+	if metrics := mg.Metrics; metrics != nil {
+		metrics.ObservePull(key, param.Count, returned, time.Since(start), err)
+	}
+	if drain != nil {
+		drain.Attributes = map[string]string{
+			"drain.requested": strconv.Itoa(param.Count),
+			"drain.returned": strconv.Itoa(returned),
+		}
+		spans := []*Span{drain}
+		for i := 0; i < returned; i++ {
+			data := res.Items[i]
+			span := mg.Tracer.start("pull " + string(key), data.meta.Trace, key, port)
+			span.Start = drain.Start
+			span.Links = []SpanContext{drain.SpanContext}
+			span.Attributes = map[string]string{"packet.id": data.meta.ID}
+			if data.meta.Inlet != PORT_EMPTY {
+				span.Attributes["packet.inlet"] = string(data.meta.Inlet)
+			}
+			sc := span.SpanContext
+			data.meta.Trace = &sc
+			spans = append(spans, span)
+		}
+		mg.Tracer.end(spans, err)
+	}
+	return res, err
+}
@@ -0,0 +1,196 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/ugorji/go/codec"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// OTLP/HTTP endpoint of a collector on the local host
+	DEFAULT_OTLP_ENDPOINT = "http://localhost:4318/v1/traces"
+	DEFAULT_SERVICE_NAME = "pipenet"
+	// timeout of requests to the collector, without OTLPExporter.Client
+	DEFAULT_OTLP_TIMEOUT = 10 * time.Second
+)
+
+var defaultOTLPClient = &http.Client{Timeout: DEFAULT_OTLP_TIMEOUT}
+
+// Writes spans as JSON lines
+type WriterExporter struct {
+	lock   sync.Mutex
+	writer io.Writer
+}
+
+func NewWriterExporter(writer io.Writer) *WriterExporter {
+	return &WriterExporter{writer: writer}
+}
+
+func NewStdoutExporter() *WriterExporter {
+	return NewWriterExporter(os.Stdout)
+}
+
+func (self *WriterExporter) ExportSpans(spans []*Span) error {
+	var buf bytes.Buffer
+	for _, span := range spans {
+		var line bytes.Buffer
+		if err := codec.NewEncoder(&line, PacketJsonHandle).Encode(span); err != nil {
+			return errors.Wrapf(err, "Failed to encode span %s", span.SpanID)
+		}
+		buf.Write(bytes.TrimSpace(line.Bytes()))
+		buf.WriteByte('\n')
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, err := self.writer.Write(buf.Bytes())
+	return err
+}
+
+// Sends spans to an OpenTelemetry collector in OTLP/HTTP with JSON encoding
+type OTLPExporter struct {
+	// DEFAULT_OTLP_ENDPOINT if empty
+	Endpoint    string
+	// service.name of the resource, DEFAULT_SERVICE_NAME if empty
+	ServiceName string
+	// client with DEFAULT_OTLP_TIMEOUT if nil
+	Client      *http.Client
+}
+
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	return &OTLPExporter{Endpoint: endpoint}
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpLink struct {
+	TraceID string `json:"traceId"`
+	SpanID  string `json:"spanId"`
+}
+
+type otlpStatus struct {
+	Code    int `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string `json:"traceId"`
+	SpanID            string `json:"spanId"`
+	ParentSpanID      string `json:"parentSpanId,omitempty"`
+	Name              string `json:"name"`
+	Kind              int `json:"kind"`
+	StartTimeUnixNano string `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Links             []otlpLink `json:"links,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpAttributes(attrs map[string]string) []otlpAttribute {
+	var ret []otlpAttribute
+	for key, value := range attrs {
+		ret = append(ret, otlpAttribute{key, otlpValue{value}})
+	}
+	return ret
+}
+
+func toOTLPSpan(span *Span) otlpSpan {
+	attrs := map[string]string{
+		"pipenet.joint": string(span.Joint),
+		"pipenet.port": string(span.Port),
+	}
+	for key, value := range span.Attributes {
+		attrs[key] = value
+	}
+	ret := otlpSpan{
+		TraceID: span.TraceID,
+		SpanID: span.SpanID,
+		ParentSpanID: span.ParentID,
+		Name: span.Name,
+		// internal
+		Kind: 1,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano: strconv.FormatInt(span.End.UnixNano(), 10),
+		Attributes: otlpAttributes(attrs),
+	}
+	for _, link := range span.Links {
+		ret.Links = append(ret.Links, otlpLink{link.TraceID, link.SpanID})
+	}
+	if span.Error != "" {
+		ret.Status = otlpStatus{2, span.Error}
+	}
+	return ret
+}
+
+func (self *OTLPExporter) ExportSpans(spans []*Span) error {
+	service := self.ServiceName
+	if service == "" {
+		service = DEFAULT_SERVICE_NAME
+	}
+	scope := otlpScopeSpans{Scope: otlpScope{"go-pipenet"}}
+	for _, span := range spans {
+		scope.Spans = append(scope.Spans, toOTLPSpan(span))
+	}
+	body, err := json.Marshal(&otlpRequest{[]otlpResourceSpans{{
+		Resource: otlpResource{otlpAttributes(map[string]string{"service.name": service})},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}})
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode spans")
+	}
+	endpoint := self.Endpoint
+	if endpoint == "" {
+		endpoint = DEFAULT_OTLP_ENDPOINT
+	}
+	client := self.Client
+	if client == nil {
+		client = defaultOTLPClient
+	}
+	res, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to send spans to %s", endpoint)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("Failed to send spans to %s: %s %s", endpoint, res.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
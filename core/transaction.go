@@ -0,0 +1,212 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Graph source which reports and restores its read position,
+// so that packets after the last committed epoch are read again after recovery.
+// Packets read again must carry the same IDs as the first time, so that idempotent sinks can skip them.
+type OffsetSource interface {
+	Pipe
+	Offset() ([]byte, error)
+	Seek(offset []byte) error
+}
+
+// Sink committing its writes together with checkpoints of the graph, see MetaGraph.CommitEpoch.
+// Packets sent after Prepare of an epoch belong to the next epoch.
+type TransactionalSink interface {
+	Pipe
+	// make writes of the epoch durable, so that Commit can only fail transiently
+	Prepare(ctx context.Context, epoch uint64) error
+	// make writes of the prepared epoch visible
+	Commit(ctx context.Context, epoch uint64) error
+	// discard writes of the epoch
+	Abort(ctx context.Context, epoch uint64) error
+	// called by RecoverEpoch with the epoch of the restored checkpoint,
+	// prepared epochs up to it are to be committed and anything later discarded
+	Recover(ctx context.Context, committed uint64) error
+}
+
+// Remembers IDs of packets written by a sink
+type IdempotencyStore interface {
+	Seen(id string) (bool, error)
+	Remember(id string) error
+}
+
+type MemoryIdempotencyStore struct {
+	lock sync.Mutex
+	ids  map[string]bool
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		ids: make(map[string]bool),
+	}
+}
+
+func (self *MemoryIdempotencyStore) Seen(id string) (bool, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.ids[id], nil
+}
+
+func (self *MemoryIdempotencyStore) Remember(id string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.ids[id] = true
+	return nil
+}
+
+// Sink skipping packets whose IDs it has passed already, for sinks without transactions.
+// Writing and remembering are not atomic, a crash between them can still produce a duplicate
+// unless the store writes into the same transaction as the sink.
+type IdempotentSink struct {
+	// accessed atomically
+	skipped uint64
+	pipe    Pipe
+	store   IdempotencyStore
+}
+
+func NewIdempotentSink(pipe Pipe, store IdempotencyStore) *IdempotentSink {
+	return &IdempotentSink{
+		pipe: pipe,
+		store: store,
+	}
+}
+
+func (self *IdempotentSink) Send(ctx context.Context, data *Packet) error {
+	seen, err := self.store.Seen(data.ID())
+	if err != nil {
+		return err
+	}
+	if seen {
+		atomic.AddUint64(&self.skipped, 1)
+		return nil
+	}
+	if err := self.pipe.Send(ctx, data); err != nil {
+		return err
+	}
+	return self.store.Remember(data.ID())
+}
+
+func (self *IdempotentSink) Drain(ctx context.Context, param *DrainRequest) (*DrainResponse, error) {
+	return self.pipe.Drain(ctx, param)
+}
+
+// number of packets skipped as duplicates
+func (self *IdempotentSink) Skipped() uint64 {
+	return atomic.LoadUint64(&self.skipped)
+}
+
+// Last epoch committed by CommitEpoch or restored by RecoverEpoch
+func (mg *MetaGraph) Epoch() uint64 {
+	return mg.epoch
+}
+
+// sinks implementing TransactionalSink, ordered by port
+func (mg *MetaGraph) transactionalSinks() []TransactionalSink {
+	ports := make([]string, 0, len(mg.sinks))
+	for port, sink := range mg.sinks {
+		if _, ok := sink.(TransactionalSink); ok {
+			ports = append(ports, string(port))
+		}
+	}
+	sort.Strings(ports)
+	ret := make([]TransactionalSink, len(ports))
+	for i, port := range ports {
+		ret[i] = mg.sinks[PortKey(port)].(TransactionalSink)
+	}
+	return ret
+}
+
+// Commit everything processed since the last epoch at once, by two-phase commit over transactional sinks.
+// Packets inside the graph settle, then joint states and source offsets are taken as a checkpoint and every transactional sink prepares.
+// Storing the checkpoint under the key is the commit point, sinks commit after it.
+// If anything fails before the commit point, sinks abort the epoch and the graph should be recovered by RecoverEpoch,
+// replaying packets since the last committed epoch.
+func (mg *MetaGraph) CommitEpoch(ctx context.Context, key string) (uint64, error) {
+	if mg.placement == nil {
+		return 0, fmt.Errorf("Commit requires concreted graph")
+	}
+	cs, err := mg.checkpointStorage()
+	if err != nil {
+		return 0, err
+	}
+	if err := mg.gate.quiesce(ctx, mg.bridgesIdle); err != nil {
+		return 0, err
+	}
+	epoch := mg.epoch + 1
+	sinks := mg.transactionalSinks()
+	cp, err := mg.snapshot()
+	if err == nil {
+		cp.Epoch = epoch
+		for _, sink := range sinks {
+			if err = sink.Prepare(ctx, epoch); err != nil {
+				err = errors.Wrapf(err, "Failed to prepare epoch %d", epoch)
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = errors.Wrapf(cs.SaveCheckpoint(key, cp), "Failed to store checkpoint %s", key)
+	}
+	if err != nil {
+		for _, sink := range sinks {
+			if abortErr := sink.Abort(ctx, epoch); abortErr != nil {
+				mg.TellError(nil, errors.Wrapf(abortErr, "Failed to abort epoch %d", epoch))
+			}
+		}
+		mg.gate.release()
+		return 0, err
+	}
+	mg.epoch = epoch
+	mg.gate.release()
+	for _, sink := range sinks {
+		if err := sink.Commit(ctx, epoch); err != nil {
+			// the epoch is committed by the checkpoint, the sink finishes it in Recover
+			return epoch, errors.Wrapf(err, "Failed to commit epoch %d", epoch)
+		}
+	}
+	return epoch, nil
+}
+
+// Restore the last commit under the key after restart, then let transactional sinks settle their pending epochs.
+// Sources implementing OffsetSource are moved back to the committed offsets.
+// Returns the committed epoch, 0 if nothing has been committed.
+func (mg *MetaGraph) RecoverEpoch(ctx context.Context, key string) (uint64, error) {
+	if mg.placement == nil {
+		return 0, fmt.Errorf("Recovery requires concreted graph")
+	}
+	cs, err := mg.checkpointStorage()
+	if err != nil {
+		return 0, err
+	}
+	cp, err := cs.LoadCheckpoint(key)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to read checkpoint %s", key)
+	}
+	if err := mg.gate.quiesce(ctx, nil); err != nil {
+		return 0, err
+	}
+	defer mg.gate.release()
+	var committed uint64
+	if cp != nil {
+		if err := mg.restore(cp); err != nil {
+			return 0, err
+		}
+		committed = cp.Epoch
+	}
+	mg.epoch = committed
+	for _, sink := range mg.transactionalSinks() {
+		if err := sink.Recover(ctx, committed); err != nil {
+			return committed, errors.Wrapf(err, "Failed to recover sink at epoch %d", committed)
+		}
+	}
+	return committed, nil
+}
@@ -0,0 +1,482 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// segment size to rotate write-ahead logs at, without WalOptions.SegmentSize
+	DEFAULT_WAL_SEGMENT_SIZE = 4 << 20
+	// number of segments which triggers compaction, without WalOptions.CompactSegments
+	DEFAULT_WAL_COMPACT_SEGMENTS = 8
+	WAL_SEGMENT_EXT = ".wal"
+)
+
+const (
+	walRecordPacket byte = 'P'
+	walRecordAck    byte = 'A'
+	// kind, seq, count or length, crc
+	walHeaderSize = 1 + 8 + 4 + 4
+)
+
+// Options of write-ahead logs of durable bridges
+type WalOptions struct {
+	// directory holding a log directory for each durable bridge, named after the bridge
+	Dir             string
+	// active segment is rotated when it grows over this size
+	SegmentSize     int64
+	// unacknowledged packets in older segments are moved into the active one when segments exceed this number
+	CompactSegments int
+	// skip fsync after each write, packets logged just before a crash of the machine can be lost
+	NoSync          bool
+}
+
+type walSegment struct {
+	path    string
+	size    int64
+	// packets in this segment not acknowledged yet
+	unacked int
+}
+
+// Segmented log of packets sent through a durable bridge.
+// Packets are appended before delivery and acknowledged after the destination accepted them,
+// packets without acknowledgement are replayed when the log is opened again.
+type bridgeLog struct {
+	options  WalOptions
+	dir      string
+	lock     sync.Mutex
+	segments []*walSegment
+	active   *os.File
+	writer   *bufio.Writer
+	nextSeq  uint64
+	// seq --> segment holding the packet, for unacknowledged packets
+	pending  map[uint64]*walSegment
+	// recovered packets not delivered yet, in seq order
+	replay   []*Packet
+	replaySeqs []uint64
+	closed   bool
+}
+
+func walRecord(kind byte, seq uint64, n uint32, payload []byte) []byte {
+	buf := make([]byte, walHeaderSize + len(payload))
+	buf[0] = kind
+	binary.BigEndian.PutUint64(buf[1:9], seq)
+	binary.BigEndian.PutUint32(buf[9:13], n)
+	copy(buf[walHeaderSize:], payload)
+	crc := crc32.ChecksumIEEE(buf[:13])
+	crc = crc32.Update(crc, crc32.IEEETable, payload)
+	binary.BigEndian.PutUint32(buf[13:17], crc)
+	return buf
+}
+
+type walEntry struct {
+	kind    byte
+	seq     uint64
+	n       uint32
+	payload []byte
+}
+
+// reads records until the end or the first broken record, which is left by a crash during writing.
+// returns the size of the valid records
+func readWalSegment(path string, fn func(entry *walEntry)) (int64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var valid int64
+	for len(data) >= walHeaderSize {
+		entry := &walEntry{
+			kind: data[0],
+			seq: binary.BigEndian.Uint64(data[1:9]),
+			n: binary.BigEndian.Uint32(data[9:13]),
+		}
+		size := walHeaderSize
+		if entry.kind == walRecordPacket {
+			size += int(entry.n)
+		}
+		if len(data) < size {
+			break
+		}
+		entry.payload = data[walHeaderSize:size]
+		crc := crc32.ChecksumIEEE(data[:13])
+		crc = crc32.Update(crc, crc32.IEEETable, entry.payload)
+		if crc != binary.BigEndian.Uint32(data[13:17]) {
+			break
+		}
+		fn(entry)
+		data = data[size:]
+		valid += int64(size)
+	}
+	return valid, nil
+}
+
+// Open the log in the directory, recovering packets not acknowledged yet
+func openBridgeLog(dir string, options WalOptions) (*bridgeLog, error) {
+	if options.SegmentSize <= 0 {
+		options.SegmentSize = DEFAULT_WAL_SEGMENT_SIZE
+	}
+	if options.CompactSegments <= 1 {
+		options.CompactSegments = DEFAULT_WAL_COMPACT_SEGMENTS
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), WAL_SEGMENT_EXT) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	self := &bridgeLog{
+		options: options,
+		dir: dir,
+		nextSeq: 1,
+		pending: make(map[uint64]*walSegment),
+	}
+	payloads := make(map[uint64][]byte)
+	for _, name := range names {
+		seg := &walSegment{path: filepath.Join(dir, name)}
+		valid, err := readWalSegment(seg.path, func(entry *walEntry) {
+			switch entry.kind {
+			case walRecordPacket:
+				payloads[entry.seq] = entry.payload
+				self.pending[entry.seq] = seg
+				if entry.seq >= self.nextSeq {
+					self.nextSeq = entry.seq + 1
+				}
+			case walRecordAck:
+				for seq := entry.seq; seq < entry.seq + uint64(entry.n); seq++ {
+					delete(payloads, seq)
+					delete(self.pending, seq)
+				}
+			}
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to read %s", seg.path)
+		}
+		// cut a broken tail, the active segment can be reopened under the same name and appended to
+		if info, err := os.Stat(seg.path); err == nil && info.Size() > valid {
+			if err := os.Truncate(seg.path, valid); err != nil {
+				return nil, errors.Wrapf(err, "Failed to truncate %s", seg.path)
+			}
+		}
+		seg.size = valid
+		self.segments = append(self.segments, seg)
+	}
+	for _, seg := range self.pending {
+		seg.unacked++
+	}
+	for seq := range payloads {
+		self.replaySeqs = append(self.replaySeqs, seq)
+	}
+	sort.Slice(self.replaySeqs, func(i, j int) bool {
+		return self.replaySeqs[i] < self.replaySeqs[j]
+	})
+	for _, seq := range self.replaySeqs {
+		pkt, err := DecodePacket(payloads[seq], PacketMsgpackHandle)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Broken packet #%d in %s", seq, dir)
+		}
+		self.replay = append(self.replay, pkt)
+	}
+	// appends go to a segment named after nextSeq, which is the last one when it holds no packets
+	if err := self.rotate(); err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+// start a new active segment. requires lock
+func (self *bridgeLog) rotate() error {
+	if self.active != nil {
+		if err := self.flush(); err != nil {
+			return err
+		}
+		if err := self.active.Close(); err != nil {
+			return err
+		}
+	}
+	seg := &walSegment{path: filepath.Join(self.dir, fmt.Sprintf("%020d%s", self.nextSeq, WAL_SEGMENT_EXT))}
+	file, err := os.OpenFile(seg.path, os.O_CREATE | os.O_WRONLY | os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if info, err := file.Stat(); err == nil {
+		seg.size = info.Size()
+	}
+	if len(self.segments) > 0 && self.segments[len(self.segments) - 1].path == seg.path {
+		// reopened without appending anything since the last rotation
+		self.segments = self.segments[:len(self.segments) - 1]
+	}
+	self.segments = append(self.segments, seg)
+	self.active = file
+	self.writer = bufio.NewWriter(file)
+	return nil
+}
+
+func (self *bridgeLog) activeSegment() *walSegment {
+	return self.segments[len(self.segments) - 1]
+}
+
+// requires lock
+func (self *bridgeLog) write(record []byte) error {
+	if _, err := self.writer.Write(record); err != nil {
+		return err
+	}
+	self.activeSegment().size += int64(len(record))
+	return nil
+}
+
+// requires lock
+func (self *bridgeLog) flush() error {
+	if err := self.writer.Flush(); err != nil {
+		return err
+	}
+	if self.options.NoSync {
+		return nil
+	}
+	return self.active.Sync()
+}
+
+// Log the batch durably, returns seq of the first packet, following packets have consecutive seqs
+func (self *bridgeLog) append(batch []*Packet) (uint64, error) {
+	records := make([][]byte, len(batch))
+	for i, data := range batch {
+		payload, err := EncodePacket(data, PacketMsgpackHandle)
+		if err != nil {
+			return 0, err
+		}
+		records[i] = payload
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return 0, fmt.Errorf("Write-ahead log %s is closed", self.dir)
+	}
+	first := self.nextSeq
+	seg := self.activeSegment()
+	for i, payload := range records {
+		seq := first + uint64(i)
+		if err := self.write(walRecord(walRecordPacket, seq, uint32(len(payload)), payload)); err != nil {
+			return 0, err
+		}
+		self.pending[seq] = seg
+		seg.unacked++
+	}
+	self.nextSeq += uint64(len(batch))
+	if err := self.flush(); err != nil {
+		return 0, err
+	}
+	if seg.size >= self.options.SegmentSize {
+		if err := self.rotate(); err != nil {
+			return 0, err
+		}
+		if len(self.segments) > self.options.CompactSegments {
+			if err := self.compact(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return first, nil
+}
+
+// Mark n packets from seq delivered, and remove leading segments without pending packets
+func (self *bridgeLog) ack(seq uint64, n int) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return fmt.Errorf("Write-ahead log %s is closed", self.dir)
+	}
+	if err := self.write(walRecord(walRecordAck, seq, uint32(n), nil)); err != nil {
+		return err
+	}
+	if err := self.flush(); err != nil {
+		return err
+	}
+	for s := seq; s < seq + uint64(n); s++ {
+		if seg, ok := self.pending[s]; ok {
+			seg.unacked--
+			delete(self.pending, s)
+		}
+	}
+	// acks in a segment only refer packets in the same or earlier segments, so a fully acknowledged prefix can go
+	for len(self.segments) > 1 && self.segments[0].unacked == 0 {
+		if err := os.Remove(self.segments[0].path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		self.segments = self.segments[1:]
+	}
+	return nil
+}
+
+// Move pending packets of old segments into the active one, then remove the old segments.
+// Keeps a packet stuck in delivery from holding every later segment on disk. requires lock
+func (self *bridgeLog) compact() error {
+	old := self.segments[:len(self.segments) - 1]
+	active := self.activeSegment()
+	for _, seg := range old {
+		if seg.unacked == 0 {
+			continue
+		}
+		_, err := readWalSegment(seg.path, func(entry *walEntry) {
+			if entry.kind != walRecordPacket || self.pending[entry.seq] != seg {
+				return
+			}
+			if self.write(walRecord(walRecordPacket, entry.seq, entry.n, entry.payload)) == nil {
+				self.pending[entry.seq] = active
+				active.unacked++
+				seg.unacked--
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := self.flush(); err != nil {
+		return err
+	}
+	kept := self.segments[:0]
+	for _, seg := range old {
+		if seg.unacked > 0 {
+			// failed to move every packet, keep the segment
+			kept = append(kept, seg)
+			continue
+		}
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	self.segments = append(kept, active)
+	return nil
+}
+
+// number of packets logged and not acknowledged
+func (self *bridgeLog) unacked() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.pending)
+}
+
+// take recovered packets as runs of consecutive seqs
+func (self *bridgeLog) takeReplay() (batches [][]*Packet, seqs []uint64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for i, seq := range self.replaySeqs {
+		if i > 0 && seq == self.replaySeqs[i - 1] + 1 {
+			batches[len(batches) - 1] = append(batches[len(batches) - 1], self.replay[i])
+			continue
+		}
+		batches = append(batches, []*Packet{self.replay[i]})
+		seqs = append(seqs, seq)
+	}
+	self.replay, self.replaySeqs = nil, nil
+	return batches, seqs
+}
+
+func (self *bridgeLog) close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return nil
+	}
+	self.closed = true
+	if err := self.flush(); err != nil {
+		self.active.Close()
+		return err
+	}
+	return self.active.Close()
+}
+
+// Log the batch, then pass it on. Packets stay in the log until the destination accepts them
+func (mg *MetaGraph) sendLogged(ctx context.Context, br *JointBridge, batch []*Packet) error {
+	seq, err := br.wal.append(batch)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to log packets at %s", br.Repr())
+	}
+	return mg.passLogged(ctx, br, batch, seq)
+}
+
+func (mg *MetaGraph) passLogged(ctx context.Context, br *JointBridge, batch []*Packet, seq uint64) error {
+	if br.queue != nil {
+		return br.queue.enqueue(ctx, batch, seq)
+	}
+	var err error
+	if br.fused != nil {
+		err = SendBatch(ctx, br.fused, batch)
+	} else {
+		err = mg.deliverBatch(ctx, br, batch)
+	}
+	mg.ackDelivered(br, seq, len(batch), err)
+	return err
+}
+
+// acknowledge logged packets which reached the destination, the rest are replayed on restart
+func (mg *MetaGraph) ackDelivered(br *JointBridge, seq uint64, n int, err error) {
+	if err != nil {
+		batchErr, ok := err.(*BatchError)
+		if !ok {
+			return
+		}
+		n = batchErr.Index
+	}
+	if n > 0 {
+		mg.ackLogged(br, seq, n)
+	}
+}
+
+// failing to acknowledge only causes the packets to be delivered again on restart, so it is just reported
+func (mg *MetaGraph) ackLogged(br *JointBridge, seq uint64, n int) {
+	if seq == 0 || br.wal == nil {
+		return
+	}
+	if err := br.wal.ack(seq, n); err != nil {
+		mg.TellError(nil, errors.Wrapf(err, "Failed to acknowledge packets at %s", br.Repr()))
+	}
+}
+
+// Deliver packets recovered from logs of durable bridges, called by Concrete.
+// Failed packets stay in the logs.
+func (mg *MetaGraph) replayLogs(ctx context.Context) {
+	for _, br := range mg.Pipes {
+		if br.wal == nil {
+			continue
+		}
+		batches, seqs := br.wal.takeReplay()
+		for i, batch := range batches {
+			if err := mg.passLogged(ctx, br, batch, seqs[i]); err != nil {
+				mg.TellError(nil, errors.Wrapf(err, "Failed to replay packets at %s", br.Repr()))
+			}
+		}
+	}
+}
+
+func (self *JointBridge) closeLog() error {
+	if self.wal == nil {
+		return nil
+	}
+	return errors.Wrapf(self.wal.close(), "Failed to close log of %s", self.Repr())
+}
+
+// number of logged packets not accepted by the destination yet, 0 unless the bridge is durable
+func (self *JointBridge) Unacked() int {
+	if self.wal == nil {
+		return 0
+	}
+	return self.wal.unacked()
+}
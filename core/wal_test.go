@@ -0,0 +1,137 @@
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBridgeLog(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "pipenet-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wal, err := openBridgeLog(dir, WalOptions{NoSync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, err := wal.append([]*Packet{NewPacket_Single("foo"), NewPacket_Single("bar")})
+	assert.NoError(err)
+	assert.Equal(uint64(1), seq)
+	seq, err = wal.append([]*Packet{NewPacket_Single("baz")})
+	assert.NoError(err)
+	assert.Equal(uint64(3), seq)
+	assert.NoError(wal.ack(1, 2))
+	assert.Equal(1, wal.unacked())
+	assert.NoError(wal.close())
+
+	// broken tail left by a crash is skipped
+	segments, _ := filepath.Glob(filepath.Join(dir, "*" + WAL_SEGMENT_EXT))
+	last, err := os.OpenFile(segments[len(segments) - 1], os.O_WRONLY | os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last.Write([]byte{walRecordPacket, 0, 0, 0})
+	last.Close()
+
+	wal, err = openBridgeLog(dir, WalOptions{NoSync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batches, seqs := wal.takeReplay()
+	if assert.Len(batches, 1) {
+		assert.Equal([]uint64{3}, seqs)
+		data, _ := batches[0][0].Get("data")
+		assert.Equal("baz", data)
+	}
+	seq, err = wal.append([]*Packet{NewPacket_Single("hoge")})
+	assert.NoError(err)
+	assert.Equal(uint64(4), seq)
+	assert.NoError(wal.ack(3, 2))
+	assert.NoError(wal.close())
+}
+
+func TestBridgeLogCompaction(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "pipenet-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// every append rotates the segment
+	options := WalOptions{SegmentSize: 1, CompactSegments: 3, NoSync: true}
+	wal, err := openBridgeLog(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		seq, err := wal.append([]*Packet{NewPacket_Single(i)})
+		assert.NoError(err)
+		if seq != 1 {
+			assert.NoError(wal.ack(seq, 1))
+		}
+		assert.True(len(wal.segments) <= options.CompactSegments + 1, "segments are not compacted: %d", len(wal.segments))
+	}
+	assert.Equal(1, wal.unacked())
+	assert.NoError(wal.close())
+
+	wal, err = openBridgeLog(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batches, seqs := wal.takeReplay()
+	assert.Equal([]uint64{1}, seqs)
+	assert.Len(batches, 1)
+	assert.NoError(wal.ack(1, 1))
+	assert.NoError(wal.close())
+	segments, _ := filepath.Glob(filepath.Join(dir, "*" + WAL_SEGMENT_EXT))
+	assert.Len(segments, 1)
+}
+
+func TestBridgeLogTornReuse(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "pipenet-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wal, err := openBridgeLog(dir, WalOptions{NoSync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(wal.close())
+
+	// first record of the segment is torn, the segment is reused after reopening
+	segments, _ := filepath.Glob(filepath.Join(dir, "*" + WAL_SEGMENT_EXT))
+	if !assert.Len(segments, 1) {
+		return
+	}
+	assert.NoError(ioutil.WriteFile(segments[0], []byte{walRecordPacket, 0, 0, 0}, 0644))
+
+	wal, err = openBridgeLog(dir, WalOptions{NoSync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batches, _ := wal.takeReplay()
+	assert.Len(batches, 0)
+	seq, err := wal.append([]*Packet{NewPacket_Single("foo"), NewPacket_Single("bar")})
+	assert.NoError(err)
+	assert.Equal(uint64(1), seq)
+	assert.NoError(wal.close())
+
+	wal, err = openBridgeLog(dir, WalOptions{NoSync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batches, seqs := wal.takeReplay()
+	assert.Equal([]uint64{1}, seqs)
+	if assert.Len(batches, 1) && assert.Len(batches[0], 2) {
+		data, _ := batches[0][1].Get("data")
+		assert.Equal("bar", data)
+	}
+	assert.NoError(wal.close())
+}
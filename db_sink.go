@@ -0,0 +1,174 @@
+package pipenet
+
+import (
+	"context"
+	"fmt"
+	"github.com/coopernurse/gorp"
+	"github.com/kanosaki/go-pipenet/core"
+	"github.com/pkg/errors"
+	"sync"
+)
+
+const (
+	// IDs of packets written by each DbSink, with epochs they were written in
+	DB_SINK_TABLE = "pipenet_sink_packets"
+)
+
+// Sink writing packets into a database exactly once, see core.MetaGraph.CommitEpoch.
+// Writes of an epoch go into one transaction along with IDs of the written packets,
+// and packets whose IDs are already recorded are skipped.
+// The database keeps no prepared state, so the transaction is committed in Prepare with the epoch recorded for each ID,
+// and Abort and Recover undo epochs after the committed one by IDs of their packets.
+// Packets replayed after recovery are then written once, even if they get new IDs.
+type DbSink struct {
+	dbmap *gorp.DbMap
+	// distinguishes IDs of sinks sharing the database
+	name  string
+	write func(tx *gorp.Transaction, data *core.Packet) error
+	undo  func(tx *gorp.Transaction, ids []string) error
+	lock  sync.Mutex
+	// open transaction of the current epoch, nil until the first packet
+	tx    *gorp.Transaction
+}
+
+// write stores the packet through the transaction, undo removes what write stored for packets of the IDs.
+// The table of packet IDs is created if missing
+func NewDbSink(dbmap *gorp.DbMap, name string, write func(tx *gorp.Transaction, data *core.Packet) error, undo func(tx *gorp.Transaction, ids []string) error) (*DbSink, error) {
+	if write == nil || undo == nil {
+		return nil, fmt.Errorf("DbSink %s requires write and undo", name)
+	}
+	// epoch is 0 until the transaction is prepared
+	_, err := dbmap.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (sink VARCHAR(255) NOT NULL, packet_id VARCHAR(255) NOT NULL, epoch BIGINT NOT NULL, PRIMARY KEY (sink, packet_id))", DB_SINK_TABLE))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create %s", DB_SINK_TABLE)
+	}
+	return &DbSink{
+		dbmap: dbmap,
+		name: name,
+		write: write,
+		undo: undo,
+	}, nil
+}
+
+func (self *DbSink) bind(i int) string {
+	return self.dbmap.Dialect.BindVar(i)
+}
+
+func (self *DbSink) Send(ctx context.Context, data *core.Packet) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.tx == nil {
+		tx, err := self.dbmap.Begin()
+		if err != nil {
+			return err
+		}
+		self.tx = tx
+	}
+	n, err := self.tx.SelectInt(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE sink = %s AND packet_id = %s", DB_SINK_TABLE, self.bind(0), self.bind(1)), self.name, data.ID())
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		// written before the crash
+		return nil
+	}
+	if err := self.write(self.tx, data); err != nil {
+		return err
+	}
+	_, err = self.tx.Exec(fmt.Sprintf("INSERT INTO %s (sink, packet_id, epoch) VALUES (%s, %s, 0)", DB_SINK_TABLE, self.bind(0), self.bind(1)), self.name, data.ID())
+	return err
+}
+
+func (self *DbSink) Drain(ctx context.Context, param *core.DrainRequest) (*core.DrainResponse, error) {
+	return nil, &core.UnsupportedOperation{"DbSink", "Drain"}
+}
+
+// Commit writes of the epoch, they stay undoable by IDs until the checkpoint of the epoch is stored
+func (self *DbSink) Prepare(ctx context.Context, epoch uint64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.tx == nil {
+		return nil
+	}
+	tx := self.tx
+	self.tx = nil
+	_, err := tx.Exec(fmt.Sprintf("UPDATE %s SET epoch = %s WHERE sink = %s AND epoch = 0", DB_SINK_TABLE, self.bind(0), self.bind(1)), epoch, self.name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (self *DbSink) Commit(ctx context.Context, epoch uint64) error {
+	return nil
+}
+
+// Undo writes of the epoch, prepared or not
+func (self *DbSink) Abort(ctx context.Context, epoch uint64) error {
+	return self.discard(epoch - 1)
+}
+
+// Undo writes of epochs after committed, which were prepared but not committed by a checkpoint
+func (self *DbSink) Recover(ctx context.Context, committed uint64) error {
+	return self.discard(committed)
+}
+
+// roll back the open transaction, then undo writes of epochs after the epoch
+func (self *DbSink) discard(after uint64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.tx != nil {
+		tx := self.tx
+		self.tx = nil
+		if err := tx.Rollback(); err != nil {
+			return err
+		}
+	}
+	rows, err := self.dbmap.Db.Query(fmt.Sprintf("SELECT packet_id FROM %s WHERE sink = %s AND epoch > %s", DB_SINK_TABLE, self.bind(0), self.bind(1)), self.name, after)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	tx, err := self.dbmap.Begin()
+	if err != nil {
+		return err
+	}
+	if err := self.undo(tx, ids); err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "Failed to undo writes of %s after epoch %d", self.name, after)
+	}
+	_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE sink = %s AND epoch > %s", DB_SINK_TABLE, self.bind(0), self.bind(1)), self.name, after)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Discard writes not prepared yet
+func (self *DbSink) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.tx == nil {
+		return nil
+	}
+	tx := self.tx
+	self.tx = nil
+	return tx.Rollback()
+}
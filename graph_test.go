@@ -1,6 +1,8 @@
 package pipenet
 
 import (
+	"bytes"
+	"context"
 	"testing"
 	"github.com/stretchr/testify/assert"
 	"github.com/kanosaki/go-pipenet/component"
@@ -8,6 +10,15 @@ import (
 	"fmt"
 	"strings"
 	"github.com/kanosaki/go-pipenet/storage"
+	"github.com/pkg/errors"
+	"time"
+	"io/ioutil"
+	"os"
+	"sync"
+	"github.com/coopernurse/gorp"
+	"net/http/httptest"
+	"net/http"
+	"encoding/json"
 )
 
 var univ = core.NewUniverse(component.Builtins, storage.NewNullStorage())
@@ -18,6 +29,19 @@ func SimplePacket(data interface{}) *core.Packet {
 	return pkt
 }
 
+// compare packets by payload, metadata such as ID differs for each packet
+func assertPackets(assert *assert.Assertions, expected, actual []*core.Packet) bool {
+	return assert.Equal(payloads(expected), payloads(actual))
+}
+
+func payloads(packets []*core.Packet) []map[string]interface{} {
+	ret := make([]map[string]interface{}, 0, len(packets))
+	for _, pkt := range packets {
+		ret = append(ret, pkt.Fields())
+	}
+	return ret
+}
+
 func TestJson(t *testing.T) {
 	graphDef :=
 		`{
@@ -45,7 +69,7 @@ func TestJson(t *testing.T) {
 	mGraph.Concrete()
 	mGraph.Push("in0", SimplePacket("foo"))
 	mGraph.Push("in1", SimplePacket("bar"))
-	assert.Equal([]*core.Packet{
+	assertPackets(assert, []*core.Packet{
 		SimplePacket("foo"),
 		SimplePacket("bar"),
 	}, sink.ToArray())
@@ -85,7 +109,7 @@ func TestMultiHop(t *testing.T) {
 	mGraph.Push("in1", SimplePacket("bar"))
 	mGraph.Push("in2", SimplePacket("baz"))
 	mGraph.Push("in3", SimplePacket("hoge"))
-	assert.Equal([]*core.Packet{
+	assertPackets(assert, []*core.Packet{
 		SimplePacket("foo"),
 		SimplePacket("bar"),
 		SimplePacket("baz"),
@@ -144,7 +168,7 @@ func TestMultiHopFromJson(t *testing.T) {
 	mGraph.Push("in1", SimplePacket("bar"))
 	mGraph.Push("in2", SimplePacket("baz"))
 	mGraph.Push("in3", SimplePacket("hoge"))
-	assert.Equal([]*core.Packet{
+	assertPackets(assert, []*core.Packet{
 		SimplePacket("foo"),
 		SimplePacket("bar"),
 		SimplePacket("baz"),
@@ -179,9 +203,10 @@ func TestMultiHopFromJsonDrainJust(t *testing.T) {
 	if mGraph.Concrete() != nil {
 		t.FailNow()
 	}
-	res := mGraph.Pull(core.PortKey("out"), &core.DrainRequest{8})
+	res, err := mGraph.Pull(core.PortKey("out"), &core.DrainRequest{8})
+	assert.NoError(err)
 	assert.NotNil(res, "Empty response")
-	assert.Equal([]*core.Packet{
+	assertPackets(assert, []*core.Packet{
 		SimplePacket("foo1"),
 		SimplePacket("foo2"),
 		SimplePacket("bar1"),
@@ -224,9 +249,10 @@ func TestMultiHopFromJsonDrainEnoughSource(t *testing.T) {
 	if mGraph.Concrete() != nil {
 		t.FailNow()
 	}
-	res := mGraph.Pull(core.PortKey("out"), &core.DrainRequest{8})
+	res, err := mGraph.Pull(core.PortKey("out"), &core.DrainRequest{8})
+	assert.NoError(err)
 	assert.NotNil(res, "Empty response")
-	assert.Equal([]*core.Packet{
+	assertPackets(assert, []*core.Packet{
 		SimplePacket("foo1"),
 		SimplePacket("foo2"),
 		SimplePacket("foo3"),
@@ -236,9 +262,10 @@ func TestMultiHopFromJsonDrainEnoughSource(t *testing.T) {
 		SimplePacket("hoge1"),
 		SimplePacket("hoge2"),
 	}, res.Items)
-	res = mGraph.Pull(core.PortKey("out"), &core.DrainRequest{8})
+	res, err = mGraph.Pull(core.PortKey("out"), &core.DrainRequest{8})
+	assert.NoError(err)
 	assert.NotNil(res, "Empty response")
-	assert.Equal([]*core.Packet{
+	assertPackets(assert, []*core.Packet{
 		SimplePacket("hoge3"),
 		SimplePacket("fuga1"),
 		SimplePacket("fuga2"),
@@ -269,9 +296,10 @@ func TestMultiHopFromJsonDrainShortSource(t *testing.T) {
 	if mGraph.Concrete() != nil {
 		t.FailNow()
 	}
-	res := mGraph.Pull(core.PortKey("out"), &core.DrainRequest{8})
+	res, err := mGraph.Pull(core.PortKey("out"), &core.DrainRequest{8})
+	assert.NoError(err)
 	assert.NotNil(res, "Empty response")
-	assert.Equal([]*core.Packet{
+	assertPackets(assert, []*core.Packet{
 		SimplePacket("foo2"),
 		SimplePacket("bar2"),
 		SimplePacket("hoge2"),
@@ -279,6 +307,575 @@ func TestMultiHopFromJsonDrainShortSource(t *testing.T) {
 	}, res.Items)
 }
 
+// Source which never yields until its context is done
+type blockingSource struct{}
+
+func (bs *blockingSource) Send(ctx context.Context, data *core.Packet) error {
+	return nil
+}
+
+func (bs *blockingSource) Drain(ctx context.Context, param *core.DrainRequest) (*core.DrainResponse, error) {
+	<-ctx.Done()
+	return core.NewInterruptedResponse(nil), ctx.Err()
+}
+
+func TestMultiHopFromJsonDrainTimeout(t *testing.T) {
+	graphDef := DOUBLE_STEP_MERGE
+	assert := assert.New(t)
+	mGraph, err := storage.FromJson(strings.NewReader(graphDef), univ)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	mGraph.Source("in0", core.NewBufferSource(
+		[]*core.Packet{
+			SimplePacket("foo1"),
+			SimplePacket("foo2")}))
+	mGraph.Source("in1", &blockingSource{})
+	mGraph.Source("in2", core.NewBufferSource(
+		[]*core.Packet{
+			SimplePacket("hoge1")}))
+	mGraph.Source("in3", core.NewBufferSource(
+		[]*core.Packet{
+			SimplePacket("fuga1")}))
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	res, err := mGraph.PullContext(ctx, core.PortKey("out"), &core.DrainRequest{8})
+	assert.Equal(context.DeadlineExceeded, errors.Cause(err))
+	assert.NotNil(res, "Empty response")
+	assert.True(res.Interrupted)
+	assertPackets(assert, []*core.Packet{
+		SimplePacket("foo1"),
+		SimplePacket("foo2"),
+	}, res.Items)
+}
+
+func TestSchemaFromJson(t *testing.T) {
+	graphDef :=
+		`{
+			"inlets": ["in0"],
+			"outlets": ["out"],
+			"schemas": {
+				"in0": {
+					"data": {"type": "string", "required": true},
+					"attr": {"type": "object", "fields": {"count": {"type": "int"}}}
+				}
+			},
+			"joints": {
+				"j1": {
+					"type": "merge"
+				}
+			},
+			"pipes": [
+				[":in0", "j1:in0"],
+				["j1:out", ":out"]
+			]
+		}`
+	assert := assert.New(t)
+	mGraph, err := storage.FromJson(strings.NewReader(graphDef), univ)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	sink := core.NewBufferTerminator()
+	mGraph.Sink("out", sink)
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	assert.NoError(mGraph.Push("in0", SimplePacket("foo")))
+	err = mGraph.Push("in0", SimplePacket(1))
+	if assert.IsType(&core.SchemaViolation{}, err) {
+		assert.Equal("data", err.(*core.SchemaViolation).Path)
+	}
+	invalidAttr := SimplePacket("bar")
+	invalidAttr.Set("attr", map[string]interface{}{"count": "many"})
+	err = mGraph.Push("in0", invalidAttr)
+	if assert.IsType(&core.SchemaViolation{}, err) {
+		assert.Equal("attr.count", err.(*core.SchemaViolation).Path)
+	}
+	// with several violations, the first field in order of names is reported every time
+	for i := 0; i < 20; i++ {
+		invalidBoth := SimplePacket(1)
+		invalidBoth.Set("attr", map[string]interface{}{"count": "many"})
+		err = mGraph.Push("in0", invalidBoth)
+		if assert.IsType(&core.SchemaViolation{}, err) {
+			assert.Equal("attr.count", err.(*core.SchemaViolation).Path)
+		}
+	}
+	assertPackets(assert, []*core.Packet{
+		SimplePacket("foo"),
+	}, sink.ToArray())
+}
+
+func TestSchemaIncompatible(t *testing.T) {
+	graphDef :=
+		`{
+			"inlets": ["in0"],
+			"outlets": ["out"],
+			"schemas": {
+				"in0": {"data": {"type": "int"}}
+			},
+			"joints": {
+				"j1": {
+					"type": "merge",
+					"schemas": {
+						"in0": {"data": {"type": "int", "required": true}}
+					}
+				}
+			},
+			"pipes": [
+				[":in0", "j1:in0"],
+				["j1:out", ":out"]
+			]
+		}`
+	assert := assert.New(t)
+	mGraph, err := storage.FromJson(strings.NewReader(graphDef), univ)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	assert.IsType(&core.SchemaIncompatible{}, mGraph.Concrete())
+}
+
+func TestPacketMetadata(t *testing.T) {
+	graphDef := DOUBLE_STEP_MERGE
+	assert := assert.New(t)
+	mGraph, err := storage.FromJson(strings.NewReader(graphDef), univ)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	mGraph.RecordHops = true
+	sink := core.NewBufferTerminator()
+	mGraph.Sink("out", sink)
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	foo, bar := SimplePacket("foo"), SimplePacket("bar")
+	assert.NotEqual(foo.ID(), bar.ID())
+	foo.Meta().SetHeader("status", "user header")
+	assert.NoError(mGraph.Push("in1", foo))
+	assert.NoError(mGraph.Push("in2", bar))
+	meta := sink.ToArray()[0].Meta()
+	assert.Equal(core.PortKey("in1"), meta.Inlet)
+	assert.False(meta.Ingested.IsZero())
+	assert.Equal([]core.JointKey{"j1", "j3"}, meta.Hops)
+	assert.Equal([]core.JointKey{"j2", "j3"}, sink.ToArray()[1].Meta().Hops)
+	// payload does not collide with metadata
+	_, ok := foo.Get("status")
+	assert.False(ok)
+	errPkt := core.NewPacket_Error("failed")
+	errPkt.Set("message", "user data")
+	message, _ := errPkt.Meta().Header(core.HEADER_MESSAGE)
+	assert.Equal("failed", message)
+
+	// branches of a fan-out record their own hops, also when they share payload and run concurrently
+	for _, mode := range []core.PipeMode{core.PIPE_DIRECT, core.PIPE_CHANNEL} {
+		fanOut, err := storage.FromJson(strings.NewReader(FAN_OUT), univ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fanOut.RecordHops = true
+		for _, br := range fanOut.Pipes {
+			br.Mode = mode
+			br.AutoMode = false
+		}
+		outs := []chan *core.Packet{make(chan *core.Packet, 1), make(chan *core.Packet, 1)}
+		for i, out := range outs {
+			out := out
+			fanOut.SinkHandler(core.PortKey(fmt.Sprintf("out%d", i)), func(pkt *core.Packet) {
+				out <- pkt
+			})
+		}
+		if fanOut.Concrete() != nil {
+			t.FailNow()
+		}
+		assert.NoError(fanOut.Push("in", SimplePacket("foo")))
+		for i, hops := range [][]core.JointKey{{"j1"}, {"j2"}} {
+			select {
+			case pkt := <-outs[i]:
+				assert.Equal(hops, pkt.Meta().Hops, mode.Name())
+			case <-time.After(5 * time.Second):
+				t.Fatalf("out%d received nothing", i)
+			}
+		}
+	}
+}
+
+func TestPacketClone(t *testing.T) {
+	assert := assert.New(t)
+	pkt := SimplePacket(map[string]interface{}{"tags": []interface{}{"a", "b"}})
+	pkt.Meta().SetHeader("h", "v")
+	cloned := pkt.Clone()
+	data, _ := cloned.Get("data")
+	data.(map[string]interface{})["tags"].([]interface{})[0] = "modified"
+	cloned.Meta().SetHeader("h", "modified")
+	orig, _ := pkt.Get("data")
+	assert.Equal("a", orig.(map[string]interface{})["tags"].([]interface{})[0])
+	header, _ := pkt.Meta().Header("h")
+	assert.Equal("v", header)
+	assert.Equal(pkt.ID(), cloned.ID())
+}
+
+const FAN_OUT =
+	`{
+		"inlets": ["in"],
+		"outlets": ["out0", "out1"],
+		"joints": {
+			"j1": {"type": "merge"},
+			"j2": {"type": "merge"}
+		},
+		"pipes": [
+			[":in", "j1:in"],
+			[":in", "j2:in"],
+			["j1:out", ":out0"],
+			["j2:out", ":out1"]
+		]
+	}`
+
+func TestFanOutCopyPolicy(t *testing.T) {
+	assert := assert.New(t)
+	for _, policy := range []core.CopyPolicy{core.COPY_SHARE, core.COPY_CLONE, core.COPY_ON_WRITE} {
+		mGraph, err := storage.FromJson(strings.NewReader(FAN_OUT), univ)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		mGraph.CopyPolicy = policy
+		// branches get their own metadata, payload is still copied by the policy
+		mGraph.RecordHops = true
+		// first branch modifies the packet
+		mGraph.SinkHandler("out0", func(pkt *core.Packet) {
+			pkt.Set("data", "modified")
+		})
+		sink := core.NewBufferTerminator()
+		mGraph.Sink("out1", sink)
+		if mGraph.Concrete() != nil {
+			t.FailNow()
+		}
+		assert.NoError(mGraph.Push("in", SimplePacket("foo")))
+		expected := SimplePacket("foo")
+		if policy == core.COPY_SHARE {
+			expected = SimplePacket("modified")
+		}
+		assertPackets(assert, []*core.Packet{expected}, sink.ToArray())
+	}
+}
+
+// Storage which holds documents on memory
+type documentStorage map[string]string
+
+func (ds documentStorage) Save(key string, graph *core.MetaGraph, univ *core.Universe) error {
+	return fmt.Errorf("Read only")
+}
+
+func (ds documentStorage) Load(key string, univ *core.Universe) (*core.MetaGraph, error) {
+	if doc, ok := ds[key]; ok {
+		return storage.FromJson(strings.NewReader(doc), univ)
+	}
+	return nil, fmt.Errorf("Graph %s not found", key)
+}
+
+const NESTED_MERGE =
+	`{
+		"inlets": ["in0", "in1", "in2", "in3"],
+		"outlets": ["out"],
+		"joints": {
+			"s1": {
+				"type": "subgraph",
+				"param": {"graph": "merge2"}
+			},
+			"s2": {
+				"type": "subgraph",
+				"param": {
+					"inline": {
+						"joints": {"m": {"type": "merge"}},
+						"pipes": [
+							[":in0", "m:in0"],
+							[":in1", "m:in1"],
+							["m:out", ":out"]
+						]
+					}
+				}
+			},
+			"j3": {"type": "merge"}
+		},
+		"pipes": [
+			[":in0", "s1:in0"],
+			[":in1", "s1:in1"],
+			[":in2", "s2:in0"],
+			[":in3", "s2:in1"],
+			["s1:out", "j3:in0"],
+			["s2:out", "j3:in1"],
+			["j3:out", ":out"]
+		]
+	}`
+
+func TestSubgraph(t *testing.T) {
+	assert := assert.New(t)
+	nestedUniv := core.NewUniverse(component.Builtins, documentStorage{
+		"merge2": `{
+			"joints": {"m": {"type": "merge"}},
+			"pipes": [
+				[":in0", "m:in0"],
+				[":in1", "m:in1"],
+				["m:out", ":out"]
+			]
+		}`,
+	})
+	mGraph, err := storage.FromJson(strings.NewReader(NESTED_MERGE), nestedUniv)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	sink := core.NewBufferTerminator()
+	mGraph.Sink("out", sink)
+	if err := mGraph.Concrete(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	assert.NoError(mGraph.Push("in0", SimplePacket("foo")))
+	assert.NoError(mGraph.Push("in1", SimplePacket("bar")))
+	assert.NoError(mGraph.Push("in2", SimplePacket("baz")))
+	assert.NoError(mGraph.Push("in3", SimplePacket("hoge")))
+	assertPackets(assert, []*core.Packet{
+		SimplePacket("foo"),
+		SimplePacket("bar"),
+		SimplePacket("baz"),
+		SimplePacket("hoge"),
+	}, sink.ToArray())
+
+	// pull through subgraphs
+	mGraph, err = storage.FromJson(strings.NewReader(NESTED_MERGE), nestedUniv)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	for i, port := range []core.PortKey{"in0", "in1", "in2", "in3"} {
+		mGraph.Source(port, core.NewBufferSource([]*core.Packet{SimplePacket(i)}))
+	}
+	if err := mGraph.Concrete(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	res, err := mGraph.Pull("out", &core.DrainRequest{Count: 8})
+	assert.NoError(err)
+	assertPackets(assert, []*core.Packet{
+		SimplePacket(0),
+		SimplePacket(1),
+		SimplePacket(2),
+		SimplePacket(3),
+	}, res.Items)
+}
+
+// merges N inlets, N is given as a variable
+const MERGE_TEMPLATE =
+	`{
+		"vars": {
+			"n": {"type": "int", "default": 2}
+		},
+		"joints": {
+			"m": {"type": "merge"}
+		},
+		"repeat": [
+			{
+				"count": "${n}",
+				"joint": {"type": "merge"},
+				"pipes": [
+					[":in${index}", "$:in"],
+					["$:out", "m:in${index}"]
+				]
+			}
+		],
+		"pipes": [
+			["m:out", ":out"]
+		]
+	}`
+
+func TestTemplate(t *testing.T) {
+	assert := assert.New(t)
+	mGraph, err := storage.FromJsonTemplate(strings.NewReader(MERGE_TEMPLATE), univ, map[string]interface{}{
+		"n": "3",
+	})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	assert.Len(mGraph.Joints, 4)
+	sink := core.NewBufferTerminator()
+	mGraph.Sink("out", sink)
+	if err := mGraph.Concrete(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	assert.NoError(mGraph.Push("in0", SimplePacket("foo")))
+	assert.NoError(mGraph.Push("in2", SimplePacket("bar")))
+	assert.Error(mGraph.Push("in3", SimplePacket("baz")))
+	assertPackets(assert, []*core.Packet{
+		SimplePacket("foo"),
+		SimplePacket("bar"),
+	}, sink.ToArray())
+
+	// defaults
+	mGraph, err = storage.FromJsonTemplate(strings.NewReader(MERGE_TEMPLATE), univ, nil)
+	if assert.NoError(err) {
+		assert.Len(mGraph.Joints, 3)
+	}
+	_, err = storage.FromJsonTemplate(strings.NewReader(MERGE_TEMPLATE), univ, map[string]interface{}{
+		"n": "many",
+	})
+	assert.Error(err)
+	// variables are never left as text, even if the document declares none
+	_, err = storage.FromJson(strings.NewReader(`{
+		"joints": {"s": {"type": "subgraph", "param": {"graph": "${name}"}}}
+	}`), univ)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "Undefined variable name")
+	}
+	// unless escaped, the graph is looked up by the text
+	_, err = storage.FromJson(strings.NewReader(`{
+		"joints": {"s": {"type": "subgraph", "param": {"graph": "$${name}"}}}
+	}`), univ)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "Failed to load graph ${name}")
+	}
+}
+
+const DOUBLE_STEP_MERGE_YAML = `
+# same as DOUBLE_STEP_MERGE
+inlets: [in0, in1, in2, in3]
+outlets: [out]
+joints:
+  j1:
+    type: merge
+    param: {}
+  j2:
+    type: merge
+  j3:
+    type: merge
+pipes:
+  - [":in0", "j1:in0"]
+  - [":in1", "j1:in1"]
+  - [":in2", "j2:in0"]
+  - [":in3", "j2:in1"]
+  - ["j1:out", "j3:in0"]
+  - ["j2:out", "j3:in1"]
+  - ["j3:out", ":out"]
+`
+
+const DOUBLE_STEP_MERGE_TOML = `
+# same as DOUBLE_STEP_MERGE
+inlets = ["in0", "in1", "in2", "in3"]
+outlets = ["out"]
+pipes = [
+	[":in0", "j1:in0"],
+	[":in1", "j1:in1"],
+	[":in2", "j2:in0"],
+	[":in3", "j2:in1"],
+	["j1:out", "j3:in0"],
+	["j2:out", "j3:in1"],
+	["j3:out", ":out"],
+]
+
+[joints.j1]
+type = "merge"
+
+[joints.j1.param]
+
+[joints.j2]
+type = "merge"
+
+[joints.j3]
+type = "merge"
+`
+
+func TestYamlAndToml(t *testing.T) {
+	assert := assert.New(t)
+	loaders := map[string]func() (*core.MetaGraph, error){
+		"yaml": func() (*core.MetaGraph, error) {
+			return storage.FromYaml(strings.NewReader(DOUBLE_STEP_MERGE_YAML), univ)
+		},
+		"toml": func() (*core.MetaGraph, error) {
+			return storage.FromToml(strings.NewReader(DOUBLE_STEP_MERGE_TOML), univ)
+		},
+	}
+	for format, load := range loaders {
+		mGraph, err := load()
+		if err != nil {
+			t.Error(format, err)
+			t.FailNow()
+		}
+		sink := core.NewBufferTerminator()
+		mGraph.Sink("out", sink)
+		if mGraph.Concrete() != nil {
+			t.FailNow()
+		}
+		mGraph.Push("in0", SimplePacket("foo"))
+		mGraph.Push("in1", SimplePacket("bar"))
+		mGraph.Push("in2", SimplePacket("baz"))
+		mGraph.Push("in3", SimplePacket("hoge"))
+		assertPackets(assert, []*core.Packet{
+			SimplePacket("foo"),
+			SimplePacket("bar"),
+			SimplePacket("baz"),
+			SimplePacket("hoge"),
+		}, sink.ToArray())
+	}
+}
+
+func TestDocumentErrorPosition(t *testing.T) {
+	assert := assert.New(t)
+	_, err := storage.FromYaml(strings.NewReader(strings.Replace(DOUBLE_STEP_MERGE_YAML, "j2:\n    type: merge", "j2:\n    type: undefined", 1)), univ)
+	if assert.IsType(&storage.DocumentError{}, err) {
+		docErr := err.(*storage.DocumentError)
+		assert.Equal("joints.j2", docErr.Path)
+		assert.Equal(9, docErr.Line)
+		assert.Equal(3, docErr.Column)
+	}
+	_, err = storage.FromToml(strings.NewReader(strings.Replace(DOUBLE_STEP_MERGE_TOML, "[joints.j2]\ntype = \"merge\"", "[joints.j2]\ntype = \"undefined\"", 1)), univ)
+	if assert.IsType(&storage.DocumentError{}, err) {
+		docErr := err.(*storage.DocumentError)
+		assert.Equal("joints.j2", docErr.Path)
+		assert.Equal(20, docErr.Line)
+	}
+	// syntax errors
+	_, err = storage.FromYaml(strings.NewReader("joints:\n  j1: [\n"), univ)
+	if assert.IsType(&storage.DocumentError{}, err) {
+		assert.True(err.(*storage.DocumentError).Line > 0)
+	}
+	_, err = storage.FromToml(strings.NewReader("[joints.j1]\ntype = = \"merge\"\n"), univ)
+	if assert.IsType(&storage.DocumentError{}, err) {
+		assert.Equal(2, err.(*storage.DocumentError).Line)
+	}
+}
+
+func TestErrorPropagation(t *testing.T) {
+	graphDef := DOUBLE_STEP_MERGE
+	assert := assert.New(t)
+	mGraph, err := storage.FromJson(strings.NewReader(graphDef), univ)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	// no bridge from inlet
+	err = mGraph.Push("in_missing", SimplePacket("foo"))
+	assert.IsType(&core.PacketUnreachable{}, err)
+	// no sink attached to outlet "out"
+	err = mGraph.Push("in0", SimplePacket("foo"))
+	assert.IsType(&core.UndefinedPort{}, err)
+	// no source attached to inlets, items drained so far are kept
+	res, err := mGraph.Pull(core.PortKey("out"), &core.DrainRequest{8})
+	assert.Error(err)
+	assert.NotNil(res)
+	assert.Empty(res.Items)
+}
+
 func BenchmarkMultiHop(b *testing.B) {
 	graphDef := DOUBLE_STEP_MERGE
 	mGraph, err := storage.FromJson(strings.NewReader(graphDef), univ)
@@ -307,3 +904,1936 @@ func BenchmarkMultiHop(b *testing.B) {
 	}
 	b.StopTimer()
 }
+
+func TestDirectoryStorage(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "pipenet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ds, err := storage.NewDirectoryStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirUniv := core.NewUniverse(component.Builtins, ds)
+	mGraph, err := storage.FromJson(strings.NewReader(DOUBLE_STEP_MERGE), dirUniv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(dirUniv.Save("double", mGraph))
+	assert.Error(dirUniv.Save("../escape", mGraph))
+	loaded, err := dirUniv.Load("double")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(loaded.Joints, 3)
+	sink := core.NewBufferTerminator()
+	loaded.Sink("out", sink)
+	if loaded.Concrete() != nil {
+		t.FailNow()
+	}
+	loaded.Push("in0", SimplePacket("foo"))
+	loaded.Push("in3", SimplePacket("bar"))
+	assertPackets(assert, []*core.Packet{
+		SimplePacket("foo"),
+		SimplePacket("bar"),
+	}, sink.ToArray())
+
+	// upgrade stored documents of version 1
+	migrator := storage.NewMigrator(2)
+	migrator.Register(1, func(doc map[string]interface{}) error {
+		doc["outlets"] = []interface{}{"out", "unused"}
+		return nil
+	})
+	migrated, err := ds.MigrateAll(migrator)
+	assert.NoError(err)
+	assert.Equal([]string{"double"}, migrated)
+	migrated, err = ds.MigrateAll(migrator)
+	assert.NoError(err)
+	assert.Empty(migrated)
+	data, err := ds.ReadDocument("double")
+	if assert.NoError(err) {
+		assert.Contains(string(data), `"unused"`)
+	}
+	keys, err := ds.Keys()
+	assert.NoError(err)
+	assert.Equal([]string{"double"}, keys)
+}
+
+const PIPE_OPTIONS = `{
+		"inlets": ["in"],
+		"outlets": ["out", "errors"],
+		"joints": {
+			"j1": {
+				"type": "merge"
+			}
+		},
+		"pipes": [
+			{"source": ":in", "destination": "j1:in0", "name": "hot", "mode": "channel", "buffer": 4},
+			{"source": "j1:out", "destination": ":out"},
+			{"source": ":in", "destination": ":errors", "filter": "level == 'error' && count >= 2"}
+		]
+	}`
+
+func TestPipeOptions(t *testing.T) {
+	assert := assert.New(t)
+	mGraph, err := storage.FromJson(strings.NewReader(PIPE_OPTIONS), univ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hot := mGraph.Bridge("hot")
+	if assert.NotNil(hot) {
+		assert.Equal(core.PIPE_CHANNEL, hot.Mode)
+		assert.Equal(4, hot.Buffer)
+	}
+	sink := core.NewBufferTerminator()
+	errSink := core.NewBufferTerminator()
+	mGraph.Sink("out", sink)
+	mGraph.Sink("errors", errSink)
+	if err := mGraph.Concrete(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		pkt := SimplePacket(i)
+		pkt.Set("level", "error")
+		pkt.Set("count", i)
+		assert.NoError(mGraph.Push("in", pkt))
+	}
+	assert.NoError(mGraph.Shutdown(context.Background()))
+	assert.Equal(10, sink.Len())
+	assert.Equal(8, errSink.Len())
+	assert.Equal(uint64(2), mGraph.Pipes[2].Filtered())
+	_, ok := mGraph.Push("in", SimplePacket(0)).(*core.BridgeClosed)
+	assert.True(ok)
+
+	// round trip through document
+	var buf bytes.Buffer
+	assert.NoError(storage.ToJson(&buf, mGraph))
+	reloaded, err := storage.FromJson(&buf, univ)
+	if assert.NoError(err) {
+		assert.Equal(core.PIPE_CHANNEL, reloaded.Bridge("hot").Mode)
+		assert.Equal("level == 'error' && count >= 2", reloaded.Pipes[2].Filter.String())
+	}
+
+	_, err = storage.FromJson(strings.NewReader(strings.Replace(PIPE_OPTIONS, `"channel"`, `"teleport"`, 1)), univ)
+	if assert.IsType(&storage.DocumentError{}, err) {
+		assert.Equal("pipes[0]", err.(*storage.DocumentError).Path)
+	}
+}
+
+func TestPipeOverflow(t *testing.T) {
+	assert := assert.New(t)
+	release := make(chan struct{})
+	for policy, expected := range map[core.OverflowPolicy][]interface{}{
+		core.OVERFLOW_DROP_NEWEST: {0, 1, 2},
+		core.OVERFLOW_DROP_OLDEST: {0, 8, 9},
+	} {
+		mGraph := core.NewMetaGraph(univ)
+		mGraph.AddJointBridge(&core.JointBridge{
+			Source: core.Endpoint{core.GRAPH, "in"},
+			Destination: core.Endpoint{core.GRAPH, "out"},
+			Mode: core.PIPE_CHANNEL,
+			Buffer: 2,
+			Overflow: policy,
+		})
+		var received []interface{}
+		first := make(chan struct{})
+		mGraph.SinkHandler("out", func(pkt *core.Packet) {
+			v, _ := pkt.Get("data")
+			received = append(received, v)
+			if len(received) == 1 {
+				close(first)
+				<-release
+			}
+		})
+		if err := mGraph.Concrete(); err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(mGraph.Push("in", SimplePacket(0)))
+		// consumer is blocked with the first packet
+		<-first
+		for i := 1; i < 10; i++ {
+			assert.NoError(mGraph.Push("in", SimplePacket(i)))
+		}
+		release <- struct{}{}
+		assert.NoError(mGraph.Shutdown(context.Background()))
+		assert.Equal(expected, received, policy.String())
+		assert.Equal(uint64(7), mGraph.Pipes[0].Dropped())
+	}
+}
+
+func TestPipeOverflowBatch(t *testing.T) {
+	assert := assert.New(t)
+	for policy, expected := range map[core.OverflowPolicy][]interface{}{
+		core.OVERFLOW_DROP_NEWEST: {0, 1, 2},
+		core.OVERFLOW_DROP_OLDEST: {0, 4, 5},
+		core.OVERFLOW_BLOCK: {0, 1, 2},
+	} {
+		mGraph := core.NewMetaGraph(univ)
+		mGraph.AddJointBridge(&core.JointBridge{
+			Source: core.Endpoint{core.GRAPH, "in"},
+			Destination: core.Endpoint{core.GRAPH, "out"},
+			Mode: core.PIPE_CHANNEL,
+			Buffer: 2,
+			Overflow: policy,
+		})
+		var received []interface{}
+		first := make(chan struct{})
+		release := make(chan struct{})
+		mGraph.SinkHandler("out", func(pkt *core.Packet) {
+			v, _ := pkt.Get("data")
+			received = append(received, v)
+			if len(received) == 1 {
+				close(first)
+				<-release
+			}
+		})
+		if err := mGraph.Concrete(); err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(mGraph.Push("in", SimplePacket(0)))
+		<-first
+		// capacity is counted in packets, not in batches
+		var batch []*core.Packet
+		for i := 1; i <= 5; i++ {
+			batch = append(batch, SimplePacket(i))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+		err := mGraph.PushBatchContext(ctx, "in", batch)
+		cancel()
+		if policy == core.OVERFLOW_BLOCK {
+			assert.Equal(context.DeadlineExceeded, errors.Cause(err))
+		} else {
+			assert.NoError(err)
+			assert.Equal(uint64(3), mGraph.Pipes[0].Dropped(), policy.String())
+		}
+		assert.Equal(2, mGraph.Pipes[0].QueueDepth(), policy.String())
+		close(release)
+		assert.NoError(mGraph.Shutdown(context.Background()))
+		assert.Equal(expected, received, policy.String())
+	}
+}
+
+func TestFusion(t *testing.T) {
+	assert := assert.New(t)
+	mGraph, err := storage.FromJson(strings.NewReader(DOUBLE_STEP_MERGE), univ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	// sink given after Concrete is bound to fused path
+	sink := core.NewBufferTerminator()
+	mGraph.Sink("out", sink)
+	assert.NoError(mGraph.Push("in0", SimplePacket("foo")))
+	assertPackets(assert, []*core.Packet{SimplePacket("foo")}, sink.ToArray())
+	// cancellation stops the packet at the next hop of fused path
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(context.Canceled, errors.Cause(mGraph.PushContext(ctx, "in1", SimplePacket("bar"))))
+	assert.Equal(1, sink.Len())
+	// bridges added later are routed as usual
+	mGraph.AddBridge(core.GRAPH, "extra", core.GRAPH, "out")
+	assert.NoError(mGraph.Push("extra", SimplePacket("baz")))
+	assert.Equal(2, sink.Len())
+}
+
+// sink recording sizes of batches it received
+type batchSink struct {
+	core.BufferTerminator
+	sizes []int
+}
+
+func newBatchSink() *batchSink {
+	return &batchSink{
+		BufferTerminator: *core.NewBufferTerminator(),
+	}
+}
+
+func (bs *batchSink) SendBatch(ctx context.Context, batch []*core.Packet) error {
+	bs.sizes = append(bs.sizes, len(batch))
+	return bs.BufferTerminator.SendBatch(ctx, batch)
+}
+
+func TestPushBatch(t *testing.T) {
+	assert := assert.New(t)
+	batch := []*core.Packet{SimplePacket("foo"), SimplePacket("bar"), SimplePacket("baz")}
+
+	// fused bridges
+	mGraph, err := storage.FromJson(strings.NewReader(DOUBLE_STEP_MERGE), univ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := newBatchSink()
+	mGraph.Sink("out", sink)
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	assert.NoError(mGraph.PushBatch("in2", batch))
+	assert.Equal([]int{3}, sink.sizes)
+	assertPackets(assert, batch, sink.ToArray())
+	assert.Equal(core.PortKey("in2"), sink.ToArray()[0].Meta().Inlet)
+
+	// channel bridges
+	mGraph, err = storage.FromJson(strings.NewReader(PIPE_OPTIONS), univ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink = newBatchSink()
+	mGraph.Sink("out", sink)
+	mGraph.Sink("errors", core.NewBufferTerminator())
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	assert.NoError(mGraph.PushBatch("in", batch))
+	assert.NoError(mGraph.Shutdown(context.Background()))
+	assert.Equal([]int{3}, sink.sizes)
+
+	// controllers without batch support
+	var pushed []interface{}
+	controller := component.NewDelegateController(func(ctx context.Context, port core.PortKey, data *core.Packet) error {
+		v, _ := data.Get("data")
+		if v == "baz" {
+			return fmt.Errorf("rejected")
+		}
+		pushed = append(pushed, v)
+		return nil
+	}, nil)
+	err = core.AsBatchController(controller).PushBatch(context.Background(), "in", batch)
+	if assert.IsType(&core.BatchError{}, err) {
+		assert.Equal(2, err.(*core.BatchError).Index)
+	}
+	assert.Equal([]interface{}{"foo", "bar"}, pushed)
+}
+
+func BenchmarkMultiHopBatch(b *testing.B) {
+	mGraph, err := storage.FromJson(strings.NewReader(DOUBLE_STEP_MERGE), univ)
+	if err != nil {
+		b.FailNow()
+	}
+	sink := core.NewBufferTerminator()
+	mGraph.Sink("out", sink)
+	if mGraph.Concrete() != nil {
+		b.FailNow()
+	}
+	batches := make([][]*core.Packet, 4)
+	for num := 0; num < 400; num++ {
+		batches[num % 4] = append(batches[num % 4], SimplePacket(fmt.Sprintf("packet_%d", num)))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mGraph.PushBatch("in0", batches[0])
+		mGraph.PushBatch("in1", batches[1])
+		mGraph.PushBatch("in2", batches[2])
+		mGraph.PushBatch("in3", batches[3])
+		sink.Clear()
+	}
+	b.StopTimer()
+}
+
+func TestDemand(t *testing.T) {
+	assert := assert.New(t)
+	graphDef := `{
+		"inlets": ["in"],
+		"outlets": ["out"],
+		"joints": {
+			"j1": {
+				"type": "merge"
+			}
+		},
+		"pipes": [
+			[":in", "j1:in0"],
+			{"source": "j1:out", "destination": ":out", "mode": "demand", "name": "boundary"}
+		]
+	}`
+	mGraph, err := storage.FromJson(strings.NewReader(graphDef), univ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := core.NewBufferTerminator()
+	mGraph.Sink("out", sink)
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		assert.NoError(mGraph.Push("in", SimplePacket(i)))
+	}
+	boundary := mGraph.Bridge("boundary")
+	assert.Equal(0, sink.Len())
+	assert.Equal(5, boundary.Pending())
+	// credit releases buffered packets
+	assert.NoError(mGraph.Request(ctx, "out", 2))
+	assertPackets(assert, []*core.Packet{SimplePacket(0), SimplePacket(1)}, sink.ToArray())
+	// pull consumer reads pushed packets
+	res, err := mGraph.Pull("out", &core.DrainRequest{2})
+	assert.NoError(err)
+	assertPackets(assert, []*core.Packet{SimplePacket(2), SimplePacket(3)}, res.Items)
+	// remaining credit lets packets through
+	assert.NoError(mGraph.Request(ctx, "out", 2))
+	assert.NoError(mGraph.Push("in", SimplePacket(5)))
+	assert.NoError(mGraph.Push("in", SimplePacket(6)))
+	assert.Equal(4, sink.Len())
+	assert.Equal(1, boundary.Pending())
+	assert.Equal(0, boundary.Credit())
+
+	// credit goes upstream through joints
+	graphDef = strings.Replace(strings.Replace(graphDef, `[":in", "j1:in0"]`, `{"source": ":in", "destination": "j1:in0", "mode": "demand", "name": "boundary"}`, 1),
+		`{"source": "j1:out", "destination": ":out", "mode": "demand", "name": "boundary"}`, `["j1:out", ":out"]`, 1)
+	mGraph, err = storage.FromJson(strings.NewReader(graphDef), univ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink = core.NewBufferTerminator()
+	mGraph.Sink("out", sink)
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	assert.NoError(mGraph.PushBatch("in", []*core.Packet{SimplePacket(0), SimplePacket(1), SimplePacket(2)}))
+	assert.Equal(0, sink.Len())
+	assert.NoError(mGraph.Request(ctx, "out", 2))
+	assertPackets(assert, []*core.Packet{SimplePacket(0), SimplePacket(1)}, sink.ToArray())
+}
+
+func TestMutate(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	mGraph, err := storage.FromJson(strings.NewReader(DOUBLE_STEP_MERGE), univ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mGraph.RecordHops = true
+	sink := core.NewBufferTerminator()
+	mGraph.Sink("out", sink)
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	// insert j4 between j3 and outlet
+	err = mGraph.Mutate(ctx, func(m *core.Mutation) error {
+		if err := m.RemoveBridge(mGraph.SelectBridges("j3", "out", core.GRAPH, "out")[0]); err != nil {
+			return err
+		}
+		if _, err := m.AddJoint("j4", &component.MergeParam{}); err != nil {
+			return err
+		}
+		m.AddBridge(&core.JointBridge{Source: core.Endpoint{"j3", "out"}, Destination: core.Endpoint{"j4", "in0"}})
+		m.AddBridge(&core.JointBridge{Source: core.Endpoint{"j4", "out"}, Destination: core.Endpoint{core.GRAPH, "out"}})
+		return nil
+	})
+	assert.NoError(err)
+	assert.NoError(mGraph.Push("in0", SimplePacket("foo")))
+	assert.Equal([]core.JointKey{"j1", "j3", "j4"}, sink.ToArray()[0].Meta().Hops)
+
+	// removing j2 also removes bridges from in2 and in3
+	assert.NoError(mGraph.RemoveJoint(ctx, "j2"))
+	assert.IsType(&core.PacketUnreachable{}, mGraph.Push("in2", SimplePacket("bar")))
+	assert.NoError(mGraph.Push("in1", SimplePacket("baz")))
+	assert.Equal(2, sink.Len())
+
+	// failed mutation leaves the graph as it was, j3 can not work without inlets
+	assert.Error(mGraph.RemoveJoint(ctx, "j1"))
+	assert.Contains(mGraph.Joints, core.JointKey("j1"))
+	assert.NoError(mGraph.Push("in0", SimplePacket("hoge")))
+	assert.Equal(3, sink.Len())
+}
+
+func TestMutateConcurrently(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	graphDef := `{
+		"inlets": ["in"],
+		"outlets": ["out"],
+		"joints": {
+			"j1": {
+				"type": "merge"
+			}
+		},
+		"pipes": [
+			[":in", "j1:in0"],
+			["j1:out", ":out", "channel"]
+		]
+	}`
+	mGraph, err := storage.FromJson(strings.NewReader(graphDef), univ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lock sync.Mutex
+	received := 0
+	mGraph.SinkHandler("out", func(pkt *core.Packet) {
+		lock.Lock()
+		received++
+		lock.Unlock()
+	})
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	const pushers, packets = 4, 200
+	var wg sync.WaitGroup
+	for i := 0; i < pushers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < packets; j++ {
+				assert.NoError(mGraph.Push("in", SimplePacket(j)))
+			}
+		}()
+	}
+	// replace the channel bridge repeatedly while packets flow
+	for i := 0; i < 20; i++ {
+		err := mGraph.Mutate(ctx, func(m *core.Mutation) error {
+			old := mGraph.SelectBridges("j1", "out", core.GRAPH, "out")[0]
+			m.RemoveBridge(old)
+			return m.AddBridge(&core.JointBridge{
+				Source: old.Source,
+				Destination: old.Destination,
+				Mode: core.PIPE_CHANNEL,
+				Buffer: 4,
+			})
+		})
+		assert.NoError(err)
+	}
+	wg.Wait()
+	assert.NoError(mGraph.Shutdown(ctx))
+	assert.Equal(pushers * packets, received)
+}
+
+func TestReload(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "pipenet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ds, err := storage.NewDirectoryStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirUniv := core.NewUniverse(component.Builtins, ds)
+	mGraph, err := storage.FromJson(strings.NewReader(DOUBLE_STEP_MERGE), dirUniv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(dirUniv.Save("double", mGraph))
+	mGraph.RecordHops = true
+	sink := core.NewBufferTerminator()
+	mGraph.Sink("out", sink)
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	j3 := mGraph.Joints["j3"]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan string, 16)
+	reloaded := make(chan *storage.GraphDiff, 1)
+	go ds.Watch(ctx, 5 * time.Millisecond, func(key string) {
+		if key != "double" {
+			changes <- key
+			return
+		}
+		diff, err := storage.Reload(ctx, mGraph, ds, key)
+		assert.NoError(err)
+		reloaded <- diff
+	})
+	// wait for the watcher to take its first look at the directory
+	for i := 0; ; i++ {
+		assert.NoError(ds.WriteDocument("ready", []byte(fmt.Sprintf("%d", i))))
+		select {
+		case <-changes:
+		case <-time.After(20 * time.Millisecond):
+			continue
+		}
+		break
+	}
+
+	// drop j2, replace j1 by a merge without param, and put j4 after j3
+	revised := `{
+		"inlets": ["in0", "in1"],
+		"outlets": ["out"],
+		"joints": {
+			"j1": {"type": "merge"},
+			"j3": {"type": "merge", "param": {}},
+			"j4": {"type": "merge", "param": {}}
+		},
+		"pipes": [
+			[":in0", "j1:in0"],
+			[":in1", "j1:in1"],
+			["j1:out", "j3:in0"],
+			["j3:out", "j4:in0"],
+			["j4:out", ":out"]
+		]
+	}`
+	assert.NoError(ds.WriteDocument("double", []byte(revised)))
+	var diff *storage.GraphDiff
+	select {
+	case diff = <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reload was not triggered")
+	}
+	assert.Equal([]core.JointKey{"j2"}, diff.RemovedJoints)
+	assert.Contains(diff.AddedJoints, core.JointKey("j4"))
+	assert.True(diff.ChangedJoints["j1"].Replaced)
+	assert.NotContains(diff.ChangedJoints, core.JointKey("j3"))
+	// unchanged joint keeps running with the same controller
+	assert.True(j3 == mGraph.Joints["j3"])
+	assert.NoError(mGraph.Push("in1", SimplePacket("foo")))
+	assert.Equal([]core.JointKey{"j1", "j3", "j4"}, sink.ToArray()[0].Meta().Hops)
+	assert.IsType(&core.PacketUnreachable{}, mGraph.Push("in2", SimplePacket("bar")))
+
+	// nothing to do for the same document
+	diff, err = storage.Reload(ctx, mGraph, ds, "double")
+	assert.NoError(err)
+	assert.True(diff.Empty())
+
+	// queues sized by the planner are not taken as changes
+	assert.NoError(ds.WriteDocument("fan", []byte(`{
+		"inlets": ["in"],
+		"outlets": ["out0", "out1"],
+		"joints": {
+			"j0": {"type": "merge"},
+			"j1": {"type": "merge"},
+			"j2": {"type": "merge"}
+		},
+		"pipes": [
+			[":in", "j0:in"],
+			["j0:out", "j1:in"],
+			["j0:out", "j2:in"],
+			["j1:out", ":out0"],
+			["j2:out", ":out1"]
+		]
+	}`)))
+	fanOut, err := ds.Load("fan", dirUniv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fanOut.Flavor = core.FlavorBetterFootprint
+	fanOut.Sink("out0", core.NewBufferTerminator())
+	fanOut.Sink("out1", core.NewBufferTerminator())
+	if fanOut.Concrete() != nil {
+		t.FailNow()
+	}
+	defer fanOut.Shutdown(ctx)
+	assert.Contains(fanOut.Placement().Explain(), "small queue for footprint")
+	diff, err = storage.Reload(ctx, fanOut, ds, "fan")
+	assert.NoError(err)
+	assert.True(diff.Empty(), "%+v", diff)
+}
+
+const CHECKPOINTED = `{
+		"inlets": ["src", "in"],
+		"outlets": ["out", "held"],
+		"joints": {
+			"j1": {"type": "merge"},
+			"j2": {"type": "merge"}
+		},
+		"pipes": [
+			[":src", "j1:in0"],
+			["j1:out", ":out"],
+			[":in", "j2:in0"],
+			{"source": "j2:out", "destination": ":held", "mode": "demand", "name": "held"}
+		]
+	}`
+
+func TestCheckpoint(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "pipenet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ds, err := storage.NewDirectoryStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirUniv := core.NewUniverse(component.Builtins, ds)
+	mGraph, err := storage.FromJson(strings.NewReader(CHECKPOINTED), dirUniv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(dirUniv.Save("cp", mGraph))
+	mGraph.Source("src", core.NewBufferSource([]*core.Packet{
+		SimplePacket("foo1"),
+		SimplePacket("foo2"),
+		SimplePacket("foo3"),
+	}))
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	// j1 keeps foo2 drained from upstream, held keeps pushed packets
+	res, err := mGraph.Pull("out", &core.DrainRequest{2})
+	assert.NoError(err)
+	assertPackets(assert, []*core.Packet{SimplePacket("foo3"), SimplePacket("foo1")}, res.Items)
+	assert.NoError(mGraph.Push("in", SimplePacket("bar1")))
+	assert.NoError(mGraph.Push("in", SimplePacket("bar2")))
+	assert.NoError(mGraph.ShutdownWithCheckpoint(ctx, "cp"))
+
+	restored, err := dirUniv.Load("cp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored.Source("src", core.NewBufferSource(nil))
+	if restored.Concrete() != nil {
+		t.FailNow()
+	}
+	found, err := restored.LoadCheckpoint(ctx, "cp")
+	assert.NoError(err)
+	assert.True(found)
+	// restoring again replaces buffered packets instead of adding to them
+	found, err = restored.LoadCheckpoint(ctx, "cp")
+	assert.NoError(err)
+	assert.True(found)
+	res, err = restored.Pull("out", &core.DrainRequest{2})
+	assert.NoError(err)
+	assertPackets(assert, []*core.Packet{SimplePacket("foo2")}, res.Items)
+	assert.Equal(2, restored.Bridge("held").Pending())
+	res, err = restored.Pull("held", &core.DrainRequest{2})
+	assert.NoError(err)
+	assertPackets(assert, []*core.Packet{SimplePacket("bar1"), SimplePacket("bar2")}, res.Items)
+
+	found, err = restored.LoadCheckpoint(ctx, "missing")
+	assert.NoError(err)
+	assert.False(found)
+
+	// buffers of bridges missing in the checkpoint are emptied
+	assert.NoError(restored.Push("in", SimplePacket("bar3")))
+	assert.Equal(1, restored.Bridge("held").Pending())
+	assert.NoError(restored.RestoreCheckpoint(ctx, &core.Checkpoint{}))
+	assert.Equal(0, restored.Bridge("held").Pending())
+}
+
+func TestCheckpointConcurrently(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	graphDef := `{
+		"inlets": ["in"],
+		"outlets": ["out"],
+		"joints": {
+			"j1": {"type": "merge"},
+			"j2": {"type": "merge"}
+		},
+		"pipes": [
+			[":in", "j1:in0", "channel"],
+			["j1:out", "j2:in0", "routine"],
+			["j2:out", ":out"]
+		]
+	}`
+	mGraph, err := storage.FromJson(strings.NewReader(graphDef), univ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lock sync.Mutex
+	received := 0
+	mGraph.SinkHandler("out", func(pkt *core.Packet) {
+		lock.Lock()
+		received++
+		lock.Unlock()
+	})
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	const pushers, packets = 4, 200
+	var wg sync.WaitGroup
+	for i := 0; i < pushers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < packets; j++ {
+				assert.NoError(mGraph.Push("in", SimplePacket(j)))
+			}
+		}()
+	}
+	// every packet pushed before a checkpoint has left the graph when it is taken
+	for i := 0; i < 20; i++ {
+		_, err := mGraph.TakeCheckpoint(ctx)
+		assert.NoError(err)
+	}
+	wg.Wait()
+	_, err = mGraph.TakeCheckpoint(ctx)
+	assert.NoError(err)
+	lock.Lock()
+	assert.Equal(pushers * packets, received)
+	lock.Unlock()
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.NoError(mGraph.Push("in", SimplePacket("foo")))
+	_, err = mGraph.TakeCheckpoint(canceled)
+	assert.Equal(context.Canceled, err)
+	assert.NoError(mGraph.Shutdown(ctx))
+}
+
+// sink which fails while down
+type flakySink struct {
+	lock  sync.Mutex
+	down  bool
+	items []*core.Packet
+}
+
+func (fs *flakySink) Send(ctx context.Context, data *core.Packet) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.down {
+		return errors.New("sink is down")
+	}
+	fs.items = append(fs.items, data)
+	return nil
+}
+
+func (fs *flakySink) Drain(ctx context.Context, param *core.DrainRequest) (*core.DrainResponse, error) {
+	return nil, &core.UnsupportedOperation{"flakySink", "Drain"}
+}
+
+func TestDurableBridge(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "pipenet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	graphDef := `{
+		"inlets": ["in"],
+		"outlets": ["out"],
+		"joints": {
+			"j1": {"type": "merge"}
+		},
+		"pipes": [
+			[":in", "j1:in0"],
+			{"source": "j1:out", "destination": ":out", "mode": "channel", "name": "critical", "durable": true}
+		]
+	}`
+	mGraph, err := storage.FromJson(strings.NewReader(graphDef), univ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// durable bridges require a log directory
+	assert.Error(mGraph.Concrete())
+	mGraph, err = storage.FromJson(strings.NewReader(graphDef), univ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mGraph.Wal = &core.WalOptions{Dir: dir, NoSync: true}
+	sink := &flakySink{down: true}
+	mGraph.Sink("out", sink)
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	assert.NoError(mGraph.Push("in", SimplePacket("foo")))
+	assert.NoError(mGraph.Push("in", SimplePacket("bar")))
+	assert.NoError(mGraph.Shutdown(ctx))
+	// packets failed to reach the sink are kept in the log
+	assert.Equal(2, mGraph.Bridge("critical").Unacked())
+	assert.Empty(sink.items)
+
+	// restarted graph replays them
+	restarted, err := storage.FromJson(strings.NewReader(graphDef), univ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted.Wal = &core.WalOptions{Dir: dir, NoSync: true}
+	sink = &flakySink{}
+	restarted.Sink("out", sink)
+	if restarted.Concrete() != nil {
+		t.FailNow()
+	}
+	assert.NoError(restarted.Push("in", SimplePacket("baz")))
+	assert.NoError(restarted.Shutdown(ctx))
+	assertPackets(assert, []*core.Packet{SimplePacket("foo"), SimplePacket("bar"), SimplePacket("baz")}, sink.items)
+	assert.Equal(0, restarted.Bridge("critical").Unacked())
+
+	var buf bytes.Buffer
+	assert.NoError(storage.ToJson(&buf, restarted))
+	assert.Contains(buf.String(), `"durable":true`)
+}
+
+// source reading packets with stable IDs from a fixed log
+type offsetSource struct {
+	items []*core.Packet
+	pos   int
+}
+
+func newOffsetSource(data ...string) *offsetSource {
+	ret := &offsetSource{}
+	for _, d := range data {
+		pkt := SimplePacket(d)
+		pkt.Meta().ID = d
+		ret.items = append(ret.items, pkt)
+	}
+	return ret
+}
+
+func (self *offsetSource) Send(ctx context.Context, data *core.Packet) error {
+	return &core.UnsupportedOperation{"offsetSource", "Send"}
+}
+
+func (self *offsetSource) Drain(ctx context.Context, param *core.DrainRequest) (*core.DrainResponse, error) {
+	end := self.pos + param.Count
+	if end > len(self.items) {
+		end = len(self.items)
+	}
+	ret := self.items[self.pos:end]
+	self.pos = end
+	return &core.DrainResponse{Items: ret}, nil
+}
+
+func (self *offsetSource) Offset() ([]byte, error) {
+	return []byte(fmt.Sprint(self.pos)), nil
+}
+
+func (self *offsetSource) Seek(offset []byte) error {
+	_, err := fmt.Sscan(string(offset), &self.pos)
+	return err
+}
+
+// storage failing to store checkpoints while fail is set
+type flakyCheckpointStorage struct {
+	*storage.DirectoryStorage
+	fail bool
+}
+
+func (self *flakyCheckpointStorage) SaveCheckpoint(key string, cp *core.Checkpoint) error {
+	if self.fail {
+		return fmt.Errorf("Disk is full")
+	}
+	return self.DirectoryStorage.SaveCheckpoint(key, cp)
+}
+
+func TestExactlyOnce(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "pipenet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ds, err := storage.NewDirectoryStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flaky := &flakyCheckpointStorage{DirectoryStorage: ds}
+	dirUniv := core.NewUniverse(component.Builtins, flaky)
+	dbmap, err := CreateSqliteDbMap(dir + "/sink.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Db.Close()
+	_, err = dbmap.Exec("CREATE TABLE events (id VARCHAR(255), data VARCHAR(255))")
+	assert.NoError(err)
+	insert := func(tx *gorp.Transaction, data *core.Packet) error {
+		value, _ := data.Get("data")
+		_, err := tx.Exec("INSERT INTO events (id, data) VALUES (?, ?)", data.ID(), value)
+		return err
+	}
+	undo := func(tx *gorp.Transaction, ids []string) error {
+		for _, id := range ids {
+			if _, err := tx.Exec("DELETE FROM events WHERE id = ?", id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	graphDef := `{
+		"inlets": ["src", "in"],
+		"outlets": ["out", "db"],
+		"joints": {
+			"j1": {"type": "merge"},
+			"j2": {"type": "merge"}
+		},
+		"pipes": [
+			[":src", "j1:in0"],
+			["j1:out", ":out"],
+			[":in", "j2:in0"],
+			["j2:out", ":db"]
+		]
+	}`
+	start := func() (*core.MetaGraph, *DbSink, *offsetSource) {
+		mGraph, err := storage.FromJson(strings.NewReader(graphDef), dirUniv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sink, err := NewDbSink(dbmap, "events", insert, undo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source := newOffsetSource("foo", "bar", "baz")
+		mGraph.Sink("db", sink)
+		mGraph.Source("src", source)
+		if mGraph.Concrete() != nil {
+			t.FailNow()
+		}
+		return mGraph, sink, source
+	}
+	count := func() int64 {
+		n, err := dbmap.SelectInt("SELECT COUNT(*) FROM events")
+		assert.NoError(err)
+		return n
+	}
+	mGraph, sink, _ := start()
+	// read foo and bar, write them into the database
+	res, err := mGraph.Pull("out", &core.DrainRequest{2})
+	assert.NoError(err)
+	for _, pkt := range res.Items {
+		assert.NoError(mGraph.Push("in", pkt))
+	}
+	epoch, err := mGraph.CommitEpoch(ctx, "eo")
+	assert.NoError(err)
+	assert.Equal(uint64(1), epoch)
+	assert.Equal(int64(2), count())
+	// baz is written but not committed when the process dies
+	res, err = mGraph.Pull("out", &core.DrainRequest{2})
+	assert.NoError(err)
+	for _, pkt := range res.Items {
+		assert.NoError(mGraph.Push("in", pkt))
+	}
+	assert.NoError(sink.Close())
+
+	// restart replays from the committed offset
+	mGraph, _, _ = start()
+	epoch, err = mGraph.RecoverEpoch(ctx, "eo")
+	assert.NoError(err)
+	assert.Equal(uint64(1), epoch)
+	res, err = mGraph.Pull("out", &core.DrainRequest{2})
+	assert.NoError(err)
+	assertPackets(assert, []*core.Packet{SimplePacket("baz")}, res.Items)
+	for _, pkt := range res.Items {
+		assert.NoError(mGraph.Push("in", pkt))
+	}
+	// replayed duplicates are skipped by their IDs
+	for _, d := range []string{"foo", "bar"} {
+		pkt := SimplePacket(d)
+		pkt.Meta().ID = d
+		assert.NoError(mGraph.Push("in", pkt))
+	}
+	epoch, err = mGraph.CommitEpoch(ctx, "eo")
+	assert.NoError(err)
+	assert.Equal(uint64(2), epoch)
+	assert.Equal(int64(3), count())
+
+	// prepared writes are undone if the checkpoint is not stored
+	assert.NoError(mGraph.Push("in", SimplePacket("qux")))
+	flaky.fail = true
+	_, err = mGraph.CommitEpoch(ctx, "eo")
+	assert.Error(err)
+	flaky.fail = false
+	assert.Equal(int64(3), count())
+	// and by recovery if the process dies before storing it
+	mGraph, sink, _ = start()
+	_, err = mGraph.RecoverEpoch(ctx, "eo")
+	assert.NoError(err)
+	assert.NoError(mGraph.Push("in", SimplePacket("qux")))
+	assert.NoError(sink.Prepare(ctx, 3))
+	assert.Equal(int64(4), count())
+	mGraph, _, _ = start()
+	epoch, err = mGraph.RecoverEpoch(ctx, "eo")
+	assert.NoError(err)
+	assert.Equal(uint64(2), epoch)
+	assert.Equal(int64(3), count())
+	// replayed with a new ID, written once
+	assert.NoError(mGraph.Push("in", SimplePacket("qux")))
+	epoch, err = mGraph.CommitEpoch(ctx, "eo")
+	assert.NoError(err)
+	assert.Equal(uint64(3), epoch)
+	assert.Equal(int64(4), count())
+
+	// idempotent wrapper for sinks without transactions
+	buf := core.NewBufferTerminator()
+	idem := core.NewIdempotentSink(buf, core.NewMemoryIdempotencyStore())
+	pkt := SimplePacket("foo")
+	assert.NoError(idem.Send(ctx, pkt))
+	assert.NoError(idem.Send(ctx, pkt.Clone()))
+	assert.Equal(1, buf.Len())
+	assert.Equal(uint64(1), idem.Skipped())
+}
+
+func TestSqlComponents(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "pipenet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbs := &SqlDatabases{}
+	defer dbs.Close()
+	dsn := dir + "/sql.db"
+	dbmap, err := dbs.Open("", "sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dbmap.Exec("CREATE TABLE events (id INTEGER PRIMARY KEY, name TEXT, count INTEGER)")
+	assert.NoError(err)
+	sqlUniv := core.NewUniverse(append(NewSqlComponents(dbs), component.Builtins...), storage.NewNullStorage())
+	mGraph, err := storage.FromJson(strings.NewReader(fmt.Sprintf(`{
+		"inlets": ["in"],
+		"outlets": ["out", "all", "by_count", "ties"],
+		"joints": {
+			"w": {
+				"type": "sql_out",
+				"param": {
+					"driver": "sqlite3", "dsn": %q, "table": "events",
+					"columns": {"key": "id", "name": "name", "n": "count"},
+					"key": ["id"], "batch_size": 2
+				}
+			},
+			"r": {
+				"type": "sql_in",
+				"param": {
+					"driver": "sqlite3", "dsn": %q,
+					"query": "SELECT id, name, count FROM events", "cursor": "id", "id_column": "id"
+				}
+			},
+			"all": {
+				"type": "sql_in",
+				"param": {
+					"driver": "sqlite3", "dsn": %q,
+					"query": "SELECT name FROM events WHERE count > ? ORDER BY id", "args": [1]
+				}
+			},
+			"by_count": {
+				"type": "sql_in",
+				"param": {
+					"driver": "sqlite3", "dsn": %q,
+					"query": "SELECT id, name, count FROM events", "cursor": "count", "id_column": "id"
+				}
+			},
+			"ties": {
+				"type": "sql_in",
+				"param": {
+					"driver": "sqlite3", "dsn": %q,
+					"query": "SELECT name, count FROM events", "cursor": "count"
+				}
+			}
+		},
+		"pipes": [
+			[":in", "w:in"],
+			["r:out", ":out"],
+			["all:out", ":all"],
+			["by_count:out", ":by_count"],
+			["ties:out", ":ties"]
+		]
+	}`, dsn, dsn, dsn, dsn, dsn)), sqlUniv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	row := func(key int, name string, n int) *core.Packet {
+		pkt := core.NewPacket()
+		pkt.Set("key", key)
+		pkt.Set("name", name)
+		pkt.Set("n", n)
+		return pkt
+	}
+	names := func(packets []*core.Packet) []interface{} {
+		var ret []interface{}
+		for _, pkt := range packets {
+			name, _ := pkt.Get("name")
+			ret = append(ret, name)
+		}
+		return ret
+	}
+	assert.NoError(mGraph.PushBatch("in", []*core.Packet{row(1, "a", 1), row(2, "b", 2), row(3, "c", 3)}))
+	// upsert on key
+	assert.NoError(mGraph.Push("in", row(2, "b2", 5)))
+	count, err := dbmap.SelectInt("SELECT COUNT(*) FROM events")
+	assert.NoError(err)
+	assert.Equal(int64(3), count)
+
+	res, err := mGraph.Pull("out", &core.DrainRequest{2})
+	assert.NoError(err)
+	assert.Equal([]interface{}{"a", "b2"}, names(res.Items))
+	assert.Equal("2", res.Items[1].ID())
+	res, err = mGraph.Pull("out", &core.DrainRequest{2})
+	assert.NoError(err)
+	assert.Equal([]interface{}{"c"}, names(res.Items))
+	res, err = mGraph.Pull("out", &core.DrainRequest{2})
+	assert.NoError(err)
+	assert.Empty(res.Items)
+	// new rows are polled by the next Pull
+	cp, err := mGraph.TakeCheckpoint(ctx)
+	assert.NoError(err)
+	assert.NoError(mGraph.Push("in", row(4, "d", 1)))
+	res, err = mGraph.Pull("out", &core.DrainRequest{2})
+	assert.NoError(err)
+	assert.Equal([]interface{}{"d"}, names(res.Items))
+	// cursor goes back to the checkpoint, the row is read again with the same ID
+	assert.NoError(mGraph.RestoreCheckpoint(ctx, cp))
+	res, err = mGraph.Pull("out", &core.DrainRequest{2})
+	assert.NoError(err)
+	assert.Equal([]interface{}{"d"}, names(res.Items))
+	assert.Equal("4", res.Items[0].ID())
+
+	// without cursor the query is read once
+	res, err = mGraph.Pull("all", &core.DrainRequest{1})
+	assert.NoError(err)
+	assert.Equal([]interface{}{"b2"}, names(res.Items))
+	res, err = mGraph.Pull("all", &core.DrainRequest{5})
+	assert.NoError(err)
+	assert.Equal([]interface{}{"c"}, names(res.Items))
+	res, err = mGraph.Pull("all", &core.DrainRequest{5})
+	assert.NoError(err)
+	assert.Empty(res.Items)
+
+	// failing transaction rolls back only its rows
+	bad := row(7, "g", 1)
+	bad.Set("key", map[string]interface{}{"not": "integer"})
+	err = mGraph.PushBatch("in", []*core.Packet{row(5, "e", 1), row(6, "f", 1), bad, row(8, "h", 1)})
+	if assert.IsType(&core.BatchError{}, err) {
+		assert.Equal(2, err.(*core.BatchError).Index)
+	}
+	count, err = dbmap.SelectInt("SELECT COUNT(*) FROM events WHERE id > 4")
+	assert.NoError(err)
+	assert.Equal(int64(2), count)
+
+	// rows sharing a cursor value are paged by id column
+	var paged []interface{}
+	for i := 0; i < 4; i++ {
+		res, err = mGraph.Pull("by_count", &core.DrainRequest{2})
+		assert.NoError(err)
+		paged = append(paged, names(res.Items)...)
+	}
+	assert.Equal([]interface{}{"a", "d", "e", "f", "c", "b2"}, paged)
+	// and rejected without it
+	_, err = mGraph.Pull("ties", &core.DrainRequest{2})
+	assert.Error(err)
+}
+
+func TestStateStore(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "pipenet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbmap, err := CreateSqliteDbMap(dir + "/state.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Db.Close()
+	sqlBackend, err := NewSqlStateBackend(dbmap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStateBackend(t, core.NewMemoryStateBackend())
+	testStateBackend(t, sqlBackend)
+	// entries of the sql backend survive the graph
+	value, ok, err := sqlBackend.Get("g/j1", "count")
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal([]byte("2"), value)
+}
+
+func testStateBackend(t *testing.T, backend core.StateBackend) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	mGraph, err := storage.FromJson(strings.NewReader(`{
+		"inlets": ["in"],
+		"outlets": ["out"],
+		"joints": {
+			"j1": {"type": "merge"},
+			"j2": {"type": "merge"}
+		},
+		"pipes": [
+			[":in", "j1:in0"],
+			["j1:out", "j2:in0"],
+			["j2:out", ":out"]
+		]
+	}`), univ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mGraph.State = backend
+	mGraph.StateNamespace = "g"
+	mGraph.Sink("out", core.NewBufferTerminator())
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	st := mGraph.Joints["j1"].State()
+	other := mGraph.JointState("j2")
+	assert.Equal("g/j1", st.Namespace())
+	assert.NoError(st.Put("seen/a", []byte("1")))
+	assert.NoError(st.Put("seen/b", []byte("2")))
+	assert.NoError(st.Put("count", []byte("2")))
+	assert.NoError(other.Put("seen/c", []byte("3")))
+	value, ok, err := st.Get("seen/a")
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal([]byte("1"), value)
+	// namespaced by joints
+	_, ok, err = st.Get("seen/c")
+	assert.NoError(err)
+	assert.False(ok)
+	scan := func(st *core.StateStore, prefix string) []string {
+		var ret []string
+		assert.NoError(st.Scan(prefix, func(key string, value []byte) error {
+			ret = append(ret, key + "=" + string(value))
+			return nil
+		}))
+		return ret
+	}
+	assert.Equal([]string{"seen/a=1", "seen/b=2"}, scan(st, "seen/"))
+	assert.Equal([]string{"count=2", "seen/a=1", "seen/b=2"}, scan(st, ""))
+	assert.Empty(scan(st, "SEEN/"))
+	assert.NoError(st.Delete("seen/b"))
+	assert.Equal([]string{"seen/a=1"}, scan(st, "seen/"))
+
+	// expired entries disappear
+	assert.NoError(st.PutTTL("tmp", []byte("x"), 10 * time.Millisecond))
+	_, ok, _ = st.Get("tmp")
+	assert.True(ok)
+	time.Sleep(20 * time.Millisecond)
+	_, ok, _ = st.Get("tmp")
+	assert.False(ok)
+	assert.NoError(mGraph.PurgeState())
+	assert.Equal([]string{"count=2", "seen/a=1"}, scan(st, ""))
+
+	// checkpoint rolls state back
+	cp, err := mGraph.TakeCheckpoint(ctx)
+	assert.NoError(err)
+	assert.NoError(st.Put("count", []byte("3")))
+	assert.NoError(st.Put("seen/d", []byte("4")))
+	assert.NoError(other.Delete("seen/c"))
+	assert.NoError(mGraph.RestoreCheckpoint(ctx, cp))
+	assert.Equal([]string{"count=2", "seen/a=1"}, scan(st, ""))
+	assert.Equal([]string{"seen/c=3"}, scan(other, ""))
+}
+
+func TestDescribe(t *testing.T) {
+	assert := assert.New(t)
+	mGraph, err := storage.FromJson(strings.NewReader(`{
+		"inlets": ["in"],
+		"outlets": ["out"],
+		"joints": {
+			"j1": {"type": "merge"},
+			"j2": {"type": "merge"}
+		},
+		"pipes": [
+			[":in", "j1:in0"],
+			{"source": "j1:out", "destination": "j2:in0", "name": "mid", "mode": "channel"},
+			["j2:out", ":out"]
+		]
+	}`), univ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := mGraph.Describe()
+	assert.NoError(err)
+	assert.Equal([]core.PortKey{"in"}, desc.Inlets)
+	assert.Equal([]core.PortKey{"out"}, desc.Outlets)
+	if assert.Len(desc.Joints, 2) {
+		assert.Equal(core.JointKey("j1"), desc.Joints[0].Key)
+		assert.Equal(component.KEY_MERGE, desc.Joints[0].Component)
+		assert.Equal([]core.PortKey{"in0"}, desc.Joints[0].Inlets)
+		assert.Equal([]core.PortKey{"out"}, desc.Joints[0].Outlets)
+	}
+	if assert.Len(desc.Bridges, 3) {
+		assert.Equal("mid", desc.Bridges[1].Name)
+		assert.Equal(core.PIPE_CHANNEL, desc.Bridges[1].Mode)
+		assert.False(desc.Bridges[1].AutoMode)
+	}
+	assert.Equal(`digraph pipenet {
+  rankdir=LR;
+  n0 [shape=cds, label="in"];
+  n1 [shape=box, label="j1\nmerge"];
+  n2 [shape=box, label="j2\nmerge"];
+  n3 [shape=cds, label="out"];
+  n0 -> n1 [label="in0 (direct)"];
+  n1 -> n2 [label="mid out -> in0 (channel)"];
+  n2 -> n3 [label="out (direct)"];
+}
+`, desc.Dot())
+	assert.Equal(`flowchart LR
+  n0(["in"])
+  n1["j1<br/>merge"]
+  n2["j2<br/>merge"]
+  n3(["out"])
+  n0 -->|"in0 (direct)"| n1
+  n1 -->|"mid out -> in0 (channel)"| n2
+  n2 -->|"out (direct)"| n3
+`, desc.Mermaid())
+}
+
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+	mGraph, err := storage.FromJson(strings.NewReader(DOUBLE_STEP_MERGE), univ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := core.NewMetricsCollector()
+	mGraph.Metrics = metrics.Graph("push")
+	sink := core.NewBufferTerminator()
+	mGraph.Sink("out", sink)
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	mGraph.Push("in0", SimplePacket("foo"))
+	mGraph.Push("in1", SimplePacket("bar"))
+	mGraph.PushBatch("in2", []*core.Packet{SimplePacket("baz"), SimplePacket("hoge")})
+
+	pullGraph, err := storage.FromJson(strings.NewReader(`{
+		"inlets": ["in"],
+		"outlets": ["out"],
+		"joints": {
+			"j1": {"type": "merge"}
+		},
+		"pipes": [
+			[":in", "j1:in0"],
+			["j1:out", ":out"]
+		]
+	}`), univ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// same joint keys in another graph are kept apart
+	pullGraph.Metrics = metrics.Graph("pull")
+	pullGraph.Source("in", core.NewBufferSource([]*core.Packet{SimplePacket("foo")}))
+	if pullGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	res, err := pullGraph.Pull("out", &core.DrainRequest{3})
+	assert.NoError(err)
+	assert.Len(res.Items, 1)
+
+	serve := func() string {
+		rec := httptest.NewRecorder()
+		metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return rec.Body.String()
+	}
+	body := serve()
+	for _, line := range []string{
+		"# TYPE pipenet_joint_packets_in_total counter",
+		`pipenet_joint_packets_in_total{graph="push",joint="j1"} 2`,
+		`pipenet_joint_packets_in_total{graph="push",joint="j2"} 2`,
+		`pipenet_joint_packets_in_total{graph="push",joint="j3"} 4`,
+		`pipenet_joint_packets_out_total{graph="push",joint="j1"} 2`,
+		`pipenet_joint_packets_out_total{graph="push",joint="j3"} 4`,
+		`pipenet_joint_errors_total{graph="push",joint="j3"} 0`,
+		"# TYPE pipenet_joint_push_seconds histogram",
+		// a batch is pushed at once
+		`pipenet_joint_push_seconds_count{graph="push",joint="j2"} 1`,
+		`pipenet_joint_push_seconds_bucket{graph="push",joint="j3",le="+Inf"} 3`,
+		`pipenet_joint_drain_requested_total{graph="pull",joint="j1"} 3`,
+		`pipenet_joint_drain_requested_total{graph="push",joint="j1"} 0`,
+		`pipenet_joint_drain_returned_total{graph="pull",joint="j1"} 1`,
+		`pipenet_joint_packets_out_total{graph="pull",joint="j1"} 1`,
+		`pipenet_bridge_packets_total{graph="push",bridge="[j3:out-:out]",mode="direct"} 4`,
+		`pipenet_bridge_packets_total{graph="push",bridge="[:in2-j2:in0]",mode="direct"} 2`,
+		`pipenet_bridge_drain_requested_total{graph="pull",bridge="[j1:out-:out]",mode="direct"} 3`,
+		`pipenet_bridge_queue_depth{graph="push",bridge="[j3:out-:out]",mode="direct"} 0`,
+	} {
+		assert.Contains(body, line + "\n")
+	}
+
+	// series of removed bridges are dropped
+	for _, br := range mGraph.Pipes {
+		if br.Repr() == "[:in2-j2:in0]" {
+			assert.NoError(mGraph.RemoveBridge(context.Background(), br))
+			break
+		}
+	}
+	body = serve()
+	assert.NotContains(body, `bridge="[:in2-j2:in0]"`)
+	assert.Contains(body, `pipenet_bridge_packets_total{graph="push",bridge="[j3:out-:out]",mode="direct"} 4` + "\n")
+}
+
+func TestQueueDepth(t *testing.T) {
+	assert := assert.New(t)
+	mGraph := Create()
+	mGraph.AddJointBridge(&core.JointBridge{
+		Source: Port("in"),
+		Destination: Port("out"),
+		Mode: core.PIPE_CHANNEL,
+	})
+	block := make(chan struct{})
+	mGraph.SinkHandler("out", func(*core.Packet) {
+		<-block
+	})
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	br := mGraph.Pipes[0]
+	for i := 0; i < 3; i++ {
+		assert.NoError(mGraph.Push("in", SimplePacket(i)))
+	}
+	// the first one is taken by the worker
+	assert.Eventually(func() bool {
+		return br.QueueDepth() == 2
+	}, time.Second, time.Millisecond)
+	close(block)
+	assert.NoError(mGraph.Shutdown(context.Background()))
+	assert.Equal(0, br.QueueDepth())
+}
+
+// SpanExporter which keeps spans
+type spanCollector struct {
+	lock  sync.Mutex
+	spans []*core.Span
+}
+
+func (self *spanCollector) ExportSpans(spans []*core.Span) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.spans = append(self.spans, spans...)
+	return nil
+}
+
+// spans of the joint in order of export
+func (self *spanCollector) find(name string) []*core.Span {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var ret []*core.Span
+	for _, span := range self.spans {
+		if span.Name == name {
+			ret = append(ret, span)
+		}
+	}
+	return ret
+}
+
+func TestTracing(t *testing.T) {
+	assert := assert.New(t)
+	mGraph, err := storage.FromJson(strings.NewReader(DOUBLE_STEP_MERGE), univ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spans := &spanCollector{}
+	mGraph.Tracer = &core.Tracer{Exporter: spans, BatchSize: 1}
+	sink := core.NewBufferTerminator()
+	mGraph.Sink("out", sink)
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	assert.NoError(mGraph.Push("in0", SimplePacket("foo")))
+	assert.NoError(mGraph.PushBatch("in2", []*core.Packet{SimplePacket("bar"), SimplePacket("baz")}))
+	// exported in background
+	assert.NoError(mGraph.Tracer.Flush())
+
+	j1 := spans.find("push j1")
+	j2 := spans.find("push j2")
+	j3 := spans.find("push j3")
+	assert.Len(j1, 1)
+	assert.Len(j2, 2)
+	assert.Len(j3, 3)
+	// first hops start traces
+	assert.Empty(j1[0].ParentID)
+	assert.Equal("in0", j1[0].Attributes["packet.inlet"])
+	assert.Equal(core.PortKey("in0"), j1[0].Port)
+	assert.NotEqual(j2[0].TraceID, j2[1].TraceID)
+	// hops at j3 continue traces of j1 and j2
+	parents := make(map[string]*core.Span)
+	for _, span := range append(j1, j2...) {
+		parents[span.SpanID] = span
+	}
+	for _, span := range j3 {
+		parent, ok := parents[span.ParentID]
+		if assert.True(ok, span.Name) {
+			assert.Equal(parent.TraceID, span.TraceID)
+			assert.Equal(parent.Attributes["packet.id"], span.Attributes["packet.id"])
+			assert.False(span.End.Before(span.Start))
+		}
+	}
+	// packets carry the span of the last hop
+	out := sink.ToArray()
+	assert.Len(out, 3)
+	assert.Equal(j3[0].SpanContext, *out[0].Meta().Trace)
+
+	// branches of a fan-out are siblings, continuing a trace given by the caller
+	for _, policy := range []core.CopyPolicy{core.COPY_SHARE, core.COPY_ON_WRITE} {
+		for _, mode := range []core.PipeMode{core.PIPE_DIRECT, core.PIPE_CHANNEL} {
+			fanOut, err := storage.FromJson(strings.NewReader(FAN_OUT), univ)
+			if err != nil {
+				t.Fatal(err)
+			}
+			spans = &spanCollector{}
+			fanOut.Tracer = core.NewTracer(spans)
+			fanOut.CopyPolicy = policy
+			for _, br := range fanOut.Pipes {
+				br.Mode = mode
+				br.AutoMode = false
+			}
+			outs := []chan *core.Packet{make(chan *core.Packet, 1), make(chan *core.Packet, 1)}
+			for i, out := range outs {
+				out := out
+				fanOut.SinkHandler(core.PortKey(fmt.Sprintf("out%d", i)), func(pkt *core.Packet) {
+					out <- pkt
+				})
+			}
+			if fanOut.Concrete() != nil {
+				t.FailNow()
+			}
+			caller := core.SpanContext{"0102030405060708090a0b0c0d0e0f10", "0102030405060708"}
+			pkt := SimplePacket("foo")
+			pkt.Meta().Trace = &caller
+			assert.NoError(fanOut.Push("in", pkt))
+			received := make([]*core.Packet, len(outs))
+			for i, out := range outs {
+				select {
+				case received[i] = <-out:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("out%d received nothing", i)
+				}
+			}
+			// buffered until flushed
+			assert.Empty(spans.find("push j1"))
+			assert.NoError(fanOut.Tracer.Flush())
+			var branches []*core.Span
+			for i, name := range []string{"push j1", "push j2"} {
+				branch := spans.find(name)
+				if assert.Len(branch, 1, name) {
+					assert.Equal(caller.SpanID, branch[0].ParentID, "%s %d %s", name, policy, mode.Name())
+					assert.Equal(caller.TraceID, branch[0].TraceID, name)
+					branches = append(branches, branch[0])
+					// each branch carries its own span out
+					assert.Equal(branch[0].SpanContext, *received[i].Meta().Trace, name)
+				}
+			}
+			if len(branches) == 2 {
+				assert.NotEqual(branches[0].SpanID, branches[1].SpanID)
+			}
+		}
+	}
+
+	// drains are nested along the path, returned packets link to them
+	pullGraph, err := storage.FromJson(strings.NewReader(`{
+		"inlets": ["in"],
+		"outlets": ["out"],
+		"joints": {
+			"a": {"type": "merge"},
+			"b": {"type": "merge"}
+		},
+		"pipes": [
+			[":in", "a:in0"],
+			["a:out", "b:in0"],
+			["b:out", ":out"]
+		]
+	}`), univ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spans = &spanCollector{}
+	pullGraph.Tracer = &core.Tracer{Exporter: spans, BatchSize: 1}
+	pullGraph.Source("in", core.NewBufferSource([]*core.Packet{SimplePacket("foo")}))
+	if pullGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	res, err := pullGraph.Pull("out", &core.DrainRequest{3})
+	assert.NoError(err)
+	assert.Len(res.Items, 1)
+	assert.NoError(pullGraph.Tracer.Flush())
+	drainA := spans.find("drain a")
+	drainB := spans.find("drain b")
+	pullA := spans.find("pull a")
+	pullB := spans.find("pull b")
+	// b drains again after the first drain of a
+	if !assert.NotEmpty(drainA) || !assert.Len(drainB, 1) || !assert.Len(pullA, 1) || !assert.Len(pullB, 1) {
+		t.FailNow()
+	}
+	assert.Empty(drainB[0].ParentID)
+	for _, span := range drainA {
+		assert.Equal(drainB[0].SpanID, span.ParentID)
+		assert.Equal(drainB[0].TraceID, span.TraceID)
+	}
+	assert.Equal("3", drainB[0].Attributes["drain.requested"])
+	assert.Equal("1", drainB[0].Attributes["drain.returned"])
+	assert.Equal([]core.SpanContext{drainA[0].SpanContext}, pullA[0].Links)
+	assert.Equal([]core.SpanContext{drainB[0].SpanContext}, pullB[0].Links)
+	assert.Equal(pullA[0].SpanID, pullB[0].ParentID)
+	assert.Equal(pullB[0].SpanContext, *res.Items[0].Meta().Trace)
+}
+
+// exporter which blocks until released
+type blockingExporter struct {
+	spanCollector
+	release chan struct{}
+}
+
+func (self *blockingExporter) ExportSpans(spans []*core.Span) error {
+	<-self.release
+	return self.spanCollector.ExportSpans(spans)
+}
+
+func TestTracerQueue(t *testing.T) {
+	assert := assert.New(t)
+	mGraph, err := storage.FromJson(strings.NewReader(DOUBLE_STEP_MERGE), univ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := &blockingExporter{release: make(chan struct{})}
+	mGraph.Tracer = &core.Tracer{Exporter: exporter, BatchSize: 1, QueueSize: 1}
+	mGraph.Sink("out", core.NewBufferTerminator())
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	// pushes do not wait for the exporter
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 4; i++ {
+			assert.NoError(mGraph.Push("in0", SimplePacket(i)))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Push waited for the exporter")
+	}
+	// one batch is taken by the exporter and one is queued, the others are dropped
+	dropped := mGraph.Tracer.Dropped()
+	assert.True(dropped >= 4, "dropped %d", dropped)
+	close(exporter.release)
+	assert.NoError(mGraph.Tracer.Close())
+	exported := len(exporter.find("push j1")) + len(exporter.find("push j3"))
+	assert.Equal(8, exported + int(dropped))
+	// closed tracer drops spans
+	assert.NoError(mGraph.Push("in0", SimplePacket("foo")))
+	assert.Equal(dropped + 2, mGraph.Tracer.Dropped())
+}
+
+func TestTraceExporters(t *testing.T) {
+	assert := assert.New(t)
+	start := time.Unix(1, 0)
+	spans := []*core.Span{
+		{
+			SpanContext: core.SpanContext{"0102030405060708090a0b0c0d0e0f10", "0102030405060708"},
+			Name: "push j1",
+			Joint: "j1",
+			Port: "in0",
+			Start: start,
+			End: start.Add(time.Millisecond),
+			Attributes: map[string]string{"packet.id": "p1"},
+		},
+		{
+			SpanContext: core.SpanContext{"0102030405060708090a0b0c0d0e0f10", "1112131415161718"},
+			ParentID: "0102030405060708",
+			Links: []core.SpanContext{{"2122232425262728292a2b2c2d2e2f30", "2122232425262728"}},
+			Name: "push j2",
+			Joint: "j2",
+			Port: "in0",
+			Start: start,
+			End: start.Add(time.Millisecond),
+			Error: "broken",
+		},
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(core.NewWriterExporter(&buf).ExportSpans(spans))
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if assert.Len(lines, 2) {
+		assert.Contains(lines[0], `"span_id":"0102030405060708"`)
+		assert.Contains(lines[0], `"packet.id":"p1"`)
+		assert.Contains(lines[1], `"parent_id":"0102030405060708"`)
+		assert.Contains(lines[1], `"error":"broken"`)
+	}
+
+	var received map[string]interface{}
+	var contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer server.Close()
+	exporter := &core.OTLPExporter{Endpoint: server.URL + "/v1/traces", ServiceName: "test"}
+	assert.NoError(exporter.ExportSpans(spans))
+	assert.Equal("application/json", contentType)
+	resource := received["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	assert.Equal([]interface{}{map[string]interface{}{"key": "service.name", "value": map[string]interface{}{"stringValue": "test"}}},
+		resource["resource"].(map[string]interface{})["attributes"])
+	sent := resource["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	if assert.Len(sent, 2) {
+		first := sent[0].(map[string]interface{})
+		assert.Equal("0102030405060708090a0b0c0d0e0f10", first["traceId"])
+		assert.Equal("push j1", first["name"])
+		assert.Equal("1000000000", first["startTimeUnixNano"])
+		assert.Equal("1001000000", first["endTimeUnixNano"])
+		assert.NotContains(first, "parentSpanId")
+		assert.Contains(first["attributes"], map[string]interface{}{"key": "packet.id", "value": map[string]interface{}{"stringValue": "p1"}})
+		second := sent[1].(map[string]interface{})
+		assert.Equal("0102030405060708", second["parentSpanId"])
+		assert.Equal(map[string]interface{}{"code": float64(2), "message": "broken"}, second["status"])
+		assert.Equal([]interface{}{map[string]interface{}{"traceId": "2122232425262728292a2b2c2d2e2f30", "spanId": "2122232425262728"}}, second["links"])
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	err := (&core.OTLPExporter{Endpoint: failing.URL}).ExportSpans(spans)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "503")
+	}
+}
+
+func TestDrainSchemaViolation(t *testing.T) {
+	assert := assert.New(t)
+	mGraph, err := storage.FromJson(strings.NewReader(`{
+		"inlets": ["in"],
+		"outlets": ["out"],
+		"schemas": {
+			"in": {"data": {"type": "string", "required": true}}
+		},
+		"joints": {"j1": {"type": "merge"}},
+		"pipes": [
+			[":in", "j1:in0"],
+			["j1:out", ":out"]
+		]
+	}`), univ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := newOffsetSource("a", "b", "c")
+	source.items[1].Set("data", 1)
+	mGraph.Source("in", source)
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	res, err := mGraph.Pull("out", &core.DrainRequest{3})
+	assert.IsType(&core.SchemaViolation{}, errors.Cause(err))
+	// the invalid packet is dropped
+	assertPackets(assert, []*core.Packet{SimplePacket("a"), SimplePacket("c")}, res.Items)
+	// items kept by the source are intact
+	assert.Equal("b", source.items[1].ID())
+	assert.Equal("c", source.items[2].ID())
+}
+
+func TestPushBatchSchemaViolation(t *testing.T) {
+	assert := assert.New(t)
+	mGraph, err := storage.FromJson(strings.NewReader(`{
+		"inlets": ["in"],
+		"outlets": ["out"],
+		"joints": {
+			"j1": {
+				"type": "merge",
+				"schemas": {"in0": {"data": {"type": "string", "required": true}}}
+			}
+		},
+		"pipes": [
+			[":in", "j1:in0"],
+			["j1:out", ":out"]
+		]
+	}`), univ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := core.NewBufferTerminator()
+	mGraph.Sink("out", sink)
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	err = mGraph.PushBatch("in", []*core.Packet{SimplePacket("a"), SimplePacket(1), SimplePacket("c")})
+	// packets before the violation are delivered
+	if assert.IsType(&core.BatchError{}, err) {
+		assert.Equal(1, err.(*core.BatchError).Index)
+		assert.IsType(&core.SchemaViolation{}, errors.Cause(err))
+	}
+	assertPackets(assert, []*core.Packet{SimplePacket("a")}, sink.ToArray())
+}
+
+func TestDemandSchemaViolation(t *testing.T) {
+	assert := assert.New(t)
+	mGraph, err := storage.FromJson(strings.NewReader(`{
+		"inlets": ["in"],
+		"outlets": ["out"],
+		"schemas": {
+			"out": {"data": {"type": "string", "required": true}}
+		},
+		"joints": {"j1": {"type": "merge"}},
+		"pipes": [
+			[":in", "j1:in0"],
+			{"source": "j1:out", "destination": ":out", "mode": "demand"}
+		]
+	}`), univ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := core.NewBufferTerminator()
+	mGraph.Sink("out", sink)
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	for _, v := range []interface{}{"a", 1, "c", 2} {
+		assert.NoError(mGraph.Push("in", SimplePacket(v)))
+	}
+	// pulled packets are validated as packets released by credit are
+	res, err := mGraph.Pull("out", &core.DrainRequest{3})
+	assert.IsType(&core.SchemaViolation{}, errors.Cause(err))
+	assertPackets(assert, []*core.Packet{SimplePacket("a"), SimplePacket("c")}, res.Items)
+	err = mGraph.Request(context.Background(), "out", 1)
+	assert.IsType(&core.SchemaViolation{}, errors.Cause(err))
+	assert.Equal(0, sink.Len())
+}
+
+func TestMutateWithStalledPush(t *testing.T) {
+	assert := assert.New(t)
+	mGraph, err := storage.FromJson(strings.NewReader(`{
+		"inlets": ["in"],
+		"outlets": ["out"],
+		"joints": {"j1": {"type": "merge"}},
+		"pipes": [
+			[":in", "j1:in0"],
+			{"source": "j1:out", "destination": ":out", "mode": "demand", "buffer": 1}
+		]
+	}`), univ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mGraph.Concrete() != nil {
+		t.FailNow()
+	}
+	ctx := context.Background()
+	// waits until fn returns, failing the test if it takes too long
+	within := func(name string, fn func()) {
+		done := make(chan struct{})
+		go func() {
+			fn()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s did not return", name)
+		}
+	}
+	for i, stop := range []func() error{
+		func() error {
+			return mGraph.Mutate(ctx, func(m *core.Mutation) error {
+				return nil
+			})
+		},
+		func() error {
+			_, err := mGraph.TakeCheckpoint(ctx)
+			return err
+		},
+	} {
+		assert.NoError(mGraph.Push("in", SimplePacket(2 * i)))
+		// the second push waits for room in the demand buffer, holding its flow
+		pushed := make(chan error, 1)
+		go func(v int) {
+			pushed <- mGraph.Push("in", SimplePacket(v))
+		}(2 * i + 1)
+		time.Sleep(20 * time.Millisecond)
+		stopped := make(chan error, 1)
+		go func() {
+			stopped <- stop()
+		}()
+		time.Sleep(20 * time.Millisecond)
+		// pull makes room while the graph is waiting to stop
+		within("Pull", func() {
+			res, err := mGraph.Pull("out", &core.DrainRequest{1})
+			assert.NoError(err)
+			assertPackets(assert, []*core.Packet{SimplePacket(2 * i)}, res.Items)
+		})
+		within("Push", func() {
+			assert.NoError(<-pushed)
+		})
+		within("Mutate or checkpoint", func() {
+			assert.NoError(<-stopped)
+		})
+		res, err := mGraph.Pull("out", &core.DrainRequest{1})
+		assert.NoError(err)
+		assertPackets(assert, []*core.Packet{SimplePacket(2 * i + 1)}, res.Items)
+	}
+}
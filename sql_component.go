@@ -0,0 +1,569 @@
+package pipenet
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/coopernurse/gorp"
+	"github.com/kanosaki/go-pipenet/core"
+	"github.com/pkg/errors"
+	"github.com/ugorji/go/codec"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	KEY_SQL_OUT core.ComponentKey = "sql_out"
+	KEY_SQL_IN  core.ComponentKey = "sql_in"
+)
+
+// Databases used by sql components, shared by joints which refer to the same one
+type SqlDatabases struct {
+	lock   sync.Mutex
+	dbmaps map[string]*gorp.DbMap
+	// keys of databases opened by Open
+	opened map[string]bool
+}
+
+// Components writing to and reading from databases of dbs
+func NewSqlComponents(dbs *SqlDatabases) []core.Component {
+	return []core.Component{
+		&SqlOut{dbs},
+		&SqlIn{dbs},
+	}
+}
+
+// Make the dbmap available to params as database
+func (self *SqlDatabases) Register(name string, dbmap *gorp.DbMap) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.dbmaps == nil {
+		self.dbmaps = make(map[string]*gorp.DbMap)
+	}
+	self.dbmaps[name] = dbmap
+}
+
+// Registered database, or the one opened by CreateDbMap with driver and dsn, sqlite3 and postgres are supported
+func (self *SqlDatabases) Open(database, driver, dsn string) (*gorp.DbMap, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if database != "" {
+		dbmap, ok := self.dbmaps[database]
+		if !ok {
+			return nil, fmt.Errorf("Undefined database %s", database)
+		}
+		return dbmap, nil
+	}
+	key := driver + ":" + dsn
+	if dbmap, ok := self.dbmaps[key]; ok {
+		return dbmap, nil
+	}
+	var dbmap *gorp.DbMap
+	var err error
+	switch driver {
+	case "sqlite3":
+		dbmap, err = CreateSqliteDbMap(dsn)
+	case "postgres":
+		dbmap, err = CreatePostgresDbMap(dsn)
+	default:
+		return nil, fmt.Errorf("Unsupported database driver %q", driver)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to open %s database", driver)
+	}
+	if self.dbmaps == nil {
+		self.dbmaps = make(map[string]*gorp.DbMap)
+	}
+	if self.opened == nil {
+		self.opened = make(map[string]bool)
+	}
+	self.dbmaps[key] = dbmap
+	self.opened[key] = true
+	return dbmap, nil
+}
+
+// Close databases opened by Open, registered ones are left to their owners
+func (self *SqlDatabases) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var firstErr error
+	for key := range self.opened {
+		if err := self.dbmaps[key].Db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(self.dbmaps, key)
+		delete(self.opened, key)
+	}
+	return firstErr
+}
+
+// Database a sql joint works on, either registered name or driver and dsn
+type SqlTarget struct {
+	Database string `codec:"database"`
+	Driver   string `codec:"driver"`
+	Dsn      string `codec:"dsn"`
+}
+
+func (self *SqlTarget) open(dbs *SqlDatabases) (*gorp.DbMap, error) {
+	if dbs == nil {
+		return nil, fmt.Errorf("sql components require SqlDatabases")
+	}
+	return dbs.Open(self.Database, self.Driver, self.Dsn)
+}
+
+// values of packets as column values, nested values are written as JSON
+func sqlValue(v interface{}) (interface{}, error) {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return string(data), nil
+	default:
+		return v, nil
+	}
+}
+
+// Writes packets into a table, packets are passed to outlets if there are any after they are written
+type SqlOut struct {
+	Databases *SqlDatabases
+}
+
+type SqlOutParam struct {
+	SqlTarget
+	Table     string `codec:"table"`
+	// column by packet field, every field goes to the column of its name if empty
+	Columns   map[string]string `codec:"columns"`
+	// rows conflicting on these columns are updated, instead of failing
+	Key       []string `codec:"key"`
+	// rows per statement and transaction of PushBatch, 100 if zero
+	BatchSize int `codec:"batch_size"`
+}
+
+func (p *SqlOutParam) Name() core.ComponentKey {
+	return KEY_SQL_OUT
+}
+
+func (s *SqlOut) Name() core.ComponentKey {
+	return KEY_SQL_OUT
+}
+
+func (s *SqlOut) CreateController(metaJoint *core.MetaJoint, param interface{}, graph *core.MetaGraph) (core.JointController, error) {
+	sp, ok := param.(*SqlOutParam)
+	if !ok || sp.Table == "" {
+		return nil, fmt.Errorf("SqlOut requires table")
+	}
+	dbmap, err := sp.open(s.Databases)
+	if err != nil {
+		return nil, err
+	}
+	batchSize := sp.BatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	return &SqlOutController{
+		dbmap: dbmap,
+		param: sp,
+		batchSize: batchSize,
+	}, nil
+}
+
+func (s *SqlOut) Save(joint *core.MetaJoint, writer io.Writer) error {
+	return nil
+}
+
+func (s *SqlOut) Restore(joint *core.MetaJoint, reader io.Reader) error {
+	return nil
+}
+
+func (s *SqlOut) DecodeParam(decoder *codec.Decoder, data json.RawMessage) (core.ComponentParam, error) {
+	ret := &SqlOutParam{}
+	err := decoder.Decode(ret)
+	return ret, err
+}
+
+type SqlOutController struct {
+	dbmap     *gorp.DbMap
+	param     *SqlOutParam
+	batchSize int
+	outlets   []core.Pipe
+}
+
+func (sc *SqlOutController) Concrete(metaJoint *core.MetaJoint, graph *core.MetaGraph) error {
+	sc.outlets = graph.JointOutlets(metaJoint.Key)
+	return nil
+}
+
+func (sc *SqlOutController) Push(ctx context.Context, port core.PortKey, data *core.Packet) error {
+	if err := sc.write([]*core.Packet{data}); err != nil {
+		return err
+	}
+	for _, outlet := range sc.outlets {
+		if err := outlet.Send(ctx, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Batch is written in transactions of BatchSize rows, failing one rolls back only its rows
+func (sc *SqlOutController) PushBatch(ctx context.Context, port core.PortKey, batch []*core.Packet) error {
+	for start := 0; start < len(batch); start += sc.batchSize {
+		end := start + sc.batchSize
+		if end > len(batch) {
+			end = len(batch)
+		}
+		if err := sc.write(batch[start:end]); err != nil {
+			return &core.BatchError{start, err}
+		}
+	}
+	for _, outlet := range sc.outlets {
+		if err := core.SendBatch(ctx, outlet, batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sc *SqlOutController) Pull(ctx context.Context, port core.PortKey, param *core.DrainRequest) (*core.DrainResponse, error) {
+	return nil, &core.UnsupportedOperation{"SqlOut", "Pull"}
+}
+
+// fields written and their columns, ordered by column
+func (sc *SqlOutController) columns(batch []*core.Packet) ([]string, []string) {
+	var fields []string
+	if len(sc.param.Columns) > 0 {
+		for field := range sc.param.Columns {
+			fields = append(fields, field)
+		}
+	} else {
+		seen := make(map[string]bool)
+		for _, data := range batch {
+			for field := range data.Fields() {
+				if !seen[field] {
+					seen[field] = true
+					fields = append(fields, field)
+				}
+			}
+		}
+	}
+	columnOf := func(field string) string {
+		if column, ok := sc.param.Columns[field]; ok {
+			return column
+		}
+		return field
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return columnOf(fields[i]) < columnOf(fields[j])
+	})
+	columns := make([]string, len(fields))
+	for i, field := range fields {
+		columns[i] = columnOf(field)
+	}
+	return fields, columns
+}
+
+// single INSERT of every packet, upserting if key is set
+func (sc *SqlOutController) write(batch []*core.Packet) error {
+	dialect := sc.dbmap.Dialect
+	fields, columns := sc.columns(batch)
+	if len(fields) == 0 {
+		return nil
+	}
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = dialect.QuoteField(column)
+	}
+	args := make([]interface{}, 0, len(batch) * len(fields))
+	rows := make([]string, len(batch))
+	for i, data := range batch {
+		binds := make([]string, len(fields))
+		for j, field := range fields {
+			v, _ := data.Get(field)
+			v, err := sqlValue(v)
+			if err != nil {
+				return errors.Wrapf(err, "Invalid value of %s", field)
+			}
+			binds[j] = dialect.BindVar(len(args))
+			args = append(args, v)
+		}
+		rows[i] = "(" + strings.Join(binds, ", ") + ")"
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", dialect.QuoteField(sc.param.Table), strings.Join(quoted, ", "), strings.Join(rows, ", "))
+	if len(sc.param.Key) > 0 {
+		keys := make([]string, len(sc.param.Key))
+		isKey := make(map[string]bool, len(sc.param.Key))
+		for i, key := range sc.param.Key {
+			keys[i] = dialect.QuoteField(key)
+			isKey[key] = true
+		}
+		var updates []string
+		for i, column := range columns {
+			if !isKey[column] {
+				updates = append(updates, fmt.Sprintf("%s = excluded.%s", quoted[i], quoted[i]))
+			}
+		}
+		if len(updates) == 0 {
+			query += fmt.Sprintf(" ON CONFLICT (%s) DO NOTHING", strings.Join(keys, ", "))
+		} else {
+			query += fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(keys, ", "), strings.Join(updates, ", "))
+		}
+	}
+	tx, err := sc.dbmap.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(query, args...); err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "Failed to write into %s", sc.param.Table)
+	}
+	return tx.Commit()
+}
+
+// Emits rows of a query as packets with fields named by columns, pulled through its outlets.
+// Without cursor the query runs once and its rows are emitted until exhausted,
+// with cursor every Pull reads rows after the last emitted one, so new rows are read by later Pulls.
+// Pages are ordered by cursor and id column, without id column the cursor must be unique and Pull fails on rows sharing it.
+type SqlIn struct {
+	Databases *SqlDatabases
+}
+
+type SqlInParam struct {
+	SqlTarget
+	// query with bind variables of the dialect for args
+	Query     string `codec:"query"`
+	Args      []interface{} `codec:"args"`
+	// column increasing with new rows, unique unless id_column is set
+	Cursor    string `codec:"cursor"`
+	// rows with cursor up to it are skipped
+	Start     interface{} `codec:"start"`
+	// unique column used as packet ID, so that rows read again get the same IDs.
+	// with cursor it orders rows sharing a cursor value
+	IdColumn  string `codec:"id_column"`
+}
+
+func (p *SqlInParam) Name() core.ComponentKey {
+	return KEY_SQL_IN
+}
+
+func (s *SqlIn) Name() core.ComponentKey {
+	return KEY_SQL_IN
+}
+
+func (s *SqlIn) CreateController(metaJoint *core.MetaJoint, param interface{}, graph *core.MetaGraph) (core.JointController, error) {
+	sp, ok := param.(*SqlInParam)
+	if !ok || sp.Query == "" {
+		return nil, fmt.Errorf("SqlIn requires query")
+	}
+	dbmap, err := sp.open(s.Databases)
+	if err != nil {
+		return nil, err
+	}
+	return &SqlInController{
+		dbmap: dbmap,
+		param: sp,
+		cursor: sp.Start,
+	}, nil
+}
+
+// position of the reader
+type sqlInState struct {
+	Cursor  interface{} `codec:"cursor"`
+	LastID  interface{} `codec:"last_id"`
+	Emitted int `codec:"emitted"`
+}
+
+// State is the cursor, or number of rows emitted without cursor
+func (s *SqlIn) Save(joint *core.MetaJoint, writer io.Writer) error {
+	sc, ok := joint.Controller().(*SqlInController)
+	if !ok {
+		return fmt.Errorf("SqlIn requires SqlInController, but %T", joint.Controller())
+	}
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	return codec.NewEncoder(writer, core.PacketMsgpackHandle).Encode(&sqlInState{sc.cursor, sc.lastID, sc.emitted})
+}
+
+func (s *SqlIn) Restore(joint *core.MetaJoint, reader io.Reader) error {
+	sc, ok := joint.Controller().(*SqlInController)
+	if !ok {
+		return fmt.Errorf("SqlIn requires SqlInController, but %T", joint.Controller())
+	}
+	state := &sqlInState{}
+	if err := codec.NewDecoder(reader, core.PacketMsgpackHandle).Decode(state); err != nil {
+		return err
+	}
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.cursor = state.Cursor
+	sc.lastID = state.LastID
+	sc.emitted = state.Emitted
+	// read again on next Pull, skipping emitted rows
+	sc.rows = nil
+	sc.loaded = false
+	return nil
+}
+
+func (s *SqlIn) DecodeParam(decoder *codec.Decoder, data json.RawMessage) (core.ComponentParam, error) {
+	ret := &SqlInParam{}
+	err := decoder.Decode(ret)
+	return ret, err
+}
+
+type SqlInController struct {
+	dbmap   *gorp.DbMap
+	param   *SqlInParam
+	lock    sync.Mutex
+	// last emitted value of the cursor column
+	cursor  interface{}
+	// id column of the last emitted row
+	lastID  interface{}
+	// rows of the query without cursor not emitted yet
+	rows    []*core.Packet
+	loaded  bool
+	emitted int
+}
+
+func (sc *SqlInController) Concrete(metaJoint *core.MetaJoint, graph *core.MetaGraph) error {
+	if len(graph.JointInlets(metaJoint.Key)) > 0 {
+		return fmt.Errorf("SqlInController takes no inlets")
+	}
+	return nil
+}
+
+func (sc *SqlInController) Push(ctx context.Context, port core.PortKey, data *core.Packet) error {
+	return &core.UnsupportedOperation{"SqlIn", "Push"}
+}
+
+func (sc *SqlInController) Pull(ctx context.Context, port core.PortKey, param *core.DrainRequest) (*core.DrainResponse, error) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if sc.param.Cursor != "" {
+		return sc.poll(ctx, param.Count)
+	}
+	if !sc.loaded {
+		rows, err := sc.query(ctx, sc.param.Query, sc.param.Args)
+		if err != nil {
+			return nil, err
+		}
+		if sc.emitted > len(rows) {
+			sc.emitted = len(rows)
+		}
+		sc.rows = rows[sc.emitted:]
+		sc.loaded = true
+	}
+	n := param.Count
+	if n > len(sc.rows) {
+		n = len(sc.rows)
+	}
+	ret := sc.rows[:n]
+	sc.rows = sc.rows[n:]
+	sc.emitted += n
+	return &core.DrainResponse{
+		Items: ret,
+	}, nil
+}
+
+// next rows after the cursor and the last id, in order of them
+func (sc *SqlInController) poll(ctx context.Context, count int) (*core.DrainResponse, error) {
+	dialect := sc.dbmap.Dialect
+	cursor := dialect.QuoteField(sc.param.Cursor)
+	args := append([]interface{}(nil), sc.param.Args...)
+	bind := func(v interface{}) string {
+		args = append(args, v)
+		return dialect.BindVar(len(args) - 1)
+	}
+	query := fmt.Sprintf("SELECT * FROM (%s) AS q", sc.param.Query)
+	order := cursor
+	limit := count
+	if sc.param.IdColumn != "" {
+		id := dialect.QuoteField(sc.param.IdColumn)
+		order += ", " + id
+		if sc.cursor != nil && sc.lastID != nil {
+			query += fmt.Sprintf(" WHERE %s > %s OR (%s = %s AND %s > %s)", cursor, bind(sc.cursor), cursor, bind(sc.cursor), id, bind(sc.lastID))
+		} else if sc.cursor != nil {
+			query += fmt.Sprintf(" WHERE %s > %s", cursor, bind(sc.cursor))
+		}
+	} else {
+		if sc.cursor != nil {
+			query += fmt.Sprintf(" WHERE %s > %s", cursor, bind(sc.cursor))
+		}
+		// one more row to find a cursor value split by the end of the page
+		limit++
+	}
+	query += fmt.Sprintf(" ORDER BY %s LIMIT %s", order, bind(limit))
+	rows, err := sc.query(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(rows))
+	for i, row := range rows {
+		value, ok := row.Get(sc.param.Cursor)
+		if !ok {
+			return nil, fmt.Errorf("Query does not return cursor column %s", sc.param.Cursor)
+		}
+		values[i] = value
+		if sc.param.IdColumn == "" && i > 0 && reflect.DeepEqual(values[i - 1], value) {
+			return nil, fmt.Errorf("Cursor column %s has duplicate value %v, set id_column to read rows sharing it", sc.param.Cursor, value)
+		}
+	}
+	if len(rows) > count {
+		rows = rows[:count]
+	}
+	if len(rows) > 0 {
+		last := rows[len(rows) - 1]
+		if sc.param.IdColumn != "" {
+			id, ok := last.Get(sc.param.IdColumn)
+			if !ok {
+				return nil, fmt.Errorf("Query does not return id column %s", sc.param.IdColumn)
+			}
+			sc.lastID = id
+		}
+		sc.cursor = values[len(rows) - 1]
+	}
+	return &core.DrainResponse{
+		Items: rows,
+	}, nil
+}
+
+func (sc *SqlInController) query(ctx context.Context, query string, args []interface{}) ([]*core.Packet, error) {
+	rows, err := sc.dbmap.Db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to run query")
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var ret []*core.Packet
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, errors.Wrap(err, "Failed to read row")
+		}
+		pkt := core.NewPacket()
+		for i, column := range columns {
+			v := values[i]
+			if b, ok := v.([]byte); ok {
+				v = string(b)
+			}
+			pkt.Set(column, v)
+		}
+		if sc.param.IdColumn != "" {
+			if id, ok := pkt.Get(sc.param.IdColumn); ok {
+				pkt.Meta().ID = fmt.Sprint(id)
+			}
+		}
+		ret = append(ret, pkt)
+	}
+	return ret, errors.Wrap(rows.Err(), "Failed to read rows")
+}
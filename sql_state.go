@@ -0,0 +1,143 @@
+package pipenet
+
+import (
+	"fmt"
+	"github.com/coopernurse/gorp"
+	"github.com/kanosaki/go-pipenet/core"
+	"github.com/pkg/errors"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// entries of SqlStateBackend
+	STATE_TABLE = "pipenet_state"
+)
+
+// core.StateBackend on a database, entries survive restarts without checkpoints.
+// Set it to MetaGraph.State before Concrete.
+type SqlStateBackend struct {
+	dbmap *gorp.DbMap
+}
+
+// The table of entries is created if missing
+func NewSqlStateBackend(dbmap *gorp.DbMap) (*SqlStateBackend, error) {
+	blob := "BLOB"
+	if _, ok := dbmap.Dialect.(gorp.PostgresDialect); ok {
+		blob = "BYTEA"
+	}
+	_, err := dbmap.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (namespace VARCHAR(255) NOT NULL, state_key VARCHAR(255) NOT NULL, value %s, expires BIGINT NOT NULL, PRIMARY KEY (namespace, state_key))", STATE_TABLE, blob))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create %s", STATE_TABLE)
+	}
+	return &SqlStateBackend{dbmap}, nil
+}
+
+func (self *SqlStateBackend) bind(i int) string {
+	return self.dbmap.Dialect.BindVar(i)
+}
+
+// expiry in unix nanoseconds, 0 if never
+func expiresAt(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// condition of entries alive at the bind variable i
+func (self *SqlStateBackend) alive(i int) string {
+	return fmt.Sprintf("(expires = 0 OR expires > %s)", self.bind(i))
+}
+
+func (self *SqlStateBackend) Get(ns, key string) ([]byte, bool, error) {
+	rows, err := self.dbmap.Db.Query(fmt.Sprintf("SELECT value FROM %s WHERE namespace = %s AND state_key = %s AND %s", STATE_TABLE, self.bind(0), self.bind(1), self.alive(2)), ns, key, time.Now().UnixNano())
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, false, rows.Err()
+	}
+	var value []byte
+	if err := rows.Scan(&value); err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (self *SqlStateBackend) put(exec gorp.SqlExecutor, ns string, entry *core.StateEntry) error {
+	_, err := exec.Exec(fmt.Sprintf("INSERT INTO %s (namespace, state_key, value, expires) VALUES (%s, %s, %s, %s) ON CONFLICT (namespace, state_key) DO UPDATE SET value = excluded.value, expires = excluded.expires",
+		STATE_TABLE, self.bind(0), self.bind(1), self.bind(2), self.bind(3)), ns, entry.Key, entry.Value, expiresAt(entry.Expires))
+	return err
+}
+
+func (self *SqlStateBackend) Put(ns string, entry *core.StateEntry) error {
+	return self.put(self.dbmap, ns, entry)
+}
+
+func (self *SqlStateBackend) Delete(ns, key string) error {
+	_, err := self.dbmap.Exec(fmt.Sprintf("DELETE FROM %s WHERE namespace = %s AND state_key = %s", STATE_TABLE, self.bind(0), self.bind(1)), ns, key)
+	return err
+}
+
+func (self *SqlStateBackend) Scan(ns, prefix string, fn func(entry *core.StateEntry) error) error {
+	// substr instead of LIKE, which ignores case in SQLite
+	rows, err := self.dbmap.Db.Query(fmt.Sprintf("SELECT state_key, value, expires FROM %s WHERE namespace = %s AND substr(state_key, 1, %d) = %s AND %s ORDER BY state_key",
+		STATE_TABLE, self.bind(0), utf8.RuneCountInString(prefix), self.bind(1), self.alive(2)), ns, prefix, time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+	// read everything first, fn may write into the backend
+	var entries []*core.StateEntry
+	for rows.Next() {
+		entry := &core.StateEntry{}
+		var expires int64
+		if err := rows.Scan(&entry.Key, &entry.Value, &expires); err != nil {
+			rows.Close()
+			return err
+		}
+		if expires != 0 {
+			entry.Expires = time.Unix(0, expires)
+		}
+		entries = append(entries, entry)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *SqlStateBackend) Replace(ns string, entries []*core.StateEntry) error {
+	tx, err := self.dbmap.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE namespace = %s", STATE_TABLE, self.bind(0)), ns); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, entry := range entries {
+		if err := self.put(tx, ns, entry); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (self *SqlStateBackend) Purge(now time.Time) error {
+	_, err := self.dbmap.Exec(fmt.Sprintf("DELETE FROM %s WHERE expires <> 0 AND expires <= %s", STATE_TABLE, self.bind(0)), now.UnixNano())
+	return err
+}
+
+// the database is left to its owner
+func (self *SqlStateBackend) Close() error {
+	return nil
+}
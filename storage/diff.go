@@ -0,0 +1,304 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/kanosaki/go-pipenet/core"
+	"github.com/pkg/errors"
+	"github.com/ugorji/go/codec"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Structural difference between two documents of a graph.
+// Documents are compared as instantiated, template variables and repeat blocks are not expanded,
+// so compare ToInfo of loaded graphs when documents are templates.
+type GraphDiff struct {
+	AddedJoints   map[core.JointKey]*JointInfo
+	RemovedJoints []core.JointKey
+	ChangedJoints map[core.JointKey]*JointChange
+	AddedPipes    []*PipeInfo
+	RemovedPipes  []*PipeInfo
+	// schemas of graph ports, nil if not changed
+	Schemas       map[core.PortKey]SchemaInfo
+	SchemasChanged bool
+	// pipes of the new document, to wire replaced joints again
+	pipes         []*PipeInfo
+}
+
+type JointChange struct {
+	From *JointInfo
+	To   *JointInfo
+	// component or param differs, the joint is replaced by a new controller
+	Replaced bool
+}
+
+func Diff(from, to *GraphInfo) (*GraphDiff, error) {
+	ret := &GraphDiff{
+		AddedJoints: make(map[core.JointKey]*JointInfo),
+		ChangedJoints: make(map[core.JointKey]*JointChange),
+		pipes: to.Pipes,
+	}
+	for key, jFrom := range from.Joints {
+		jTo, ok := to.Joints[key]
+		if !ok {
+			ret.RemovedJoints = append(ret.RemovedJoints, key)
+			continue
+		}
+		sameParam, err := paramEqual(jFrom.Param, jTo.Param)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to compare param of joint %s", key)
+		}
+		replaced := jFrom.Component != jTo.Component || !sameParam
+		if replaced || !schemasEqual(jFrom.Schemas, jTo.Schemas) {
+			ret.ChangedJoints[key] = &JointChange{jFrom, jTo, replaced}
+		}
+	}
+	sort.Slice(ret.RemovedJoints, func(i, j int) bool {
+		return ret.RemovedJoints[i] < ret.RemovedJoints[j]
+	})
+	for key, jTo := range to.Joints {
+		if _, ok := from.Joints[key]; !ok {
+			ret.AddedJoints[key] = jTo
+		}
+	}
+	// pipes are compared as a multiset of all their options
+	count := make(map[PipeInfo]int, len(from.Pipes))
+	for _, pInfo := range from.Pipes {
+		count[*pInfo] += 1
+	}
+	for _, pInfo := range to.Pipes {
+		if count[*pInfo] > 0 {
+			count[*pInfo] -= 1
+			continue
+		}
+		ret.AddedPipes = append(ret.AddedPipes, pInfo)
+	}
+	for _, pInfo := range from.Pipes {
+		if count[*pInfo] > 0 {
+			count[*pInfo] -= 1
+			ret.RemovedPipes = append(ret.RemovedPipes, pInfo)
+		}
+	}
+	if !schemasEqual(from.Schemas, to.Schemas) {
+		ret.Schemas = to.Schemas
+		ret.SchemasChanged = true
+	}
+	return ret, nil
+}
+
+// params are equal if they decode to the same value, missing params equal null
+func paramEqual(a, b []byte) (bool, error) {
+	if bytes.Equal(a, b) {
+		return true, nil
+	}
+	var va, vb interface{}
+	if len(a) != 0 {
+		if err := codec.NewDecoderBytes(a, jsonHandle).Decode(&va); err != nil {
+			return false, err
+		}
+	}
+	if len(b) != 0 {
+		if err := codec.NewDecoderBytes(b, jsonHandle).Decode(&vb); err != nil {
+			return false, err
+		}
+	}
+	return reflect.DeepEqual(va, vb), nil
+}
+
+func schemasEqual(a, b map[core.PortKey]SchemaInfo) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func (self *GraphDiff) Empty() bool {
+	return len(self.AddedJoints) == 0 && len(self.RemovedJoints) == 0 && len(self.ChangedJoints) == 0 &&
+		len(self.AddedPipes) == 0 && len(self.RemovedPipes) == 0 && !self.SchemasChanged
+}
+
+// One line per change, + added, - removed, ~ changed
+func (self *GraphDiff) String() string {
+	var lines []string
+	for key, jInfo := range self.AddedJoints {
+		lines = append(lines, fmt.Sprintf("+ joint %s (%s)", key, jInfo.Component))
+	}
+	for _, key := range self.RemovedJoints {
+		lines = append(lines, fmt.Sprintf("- joint %s", key))
+	}
+	for key, change := range self.ChangedJoints {
+		if change.Replaced {
+			lines = append(lines, fmt.Sprintf("~ joint %s (%s)", key, change.To.Component))
+		} else {
+			lines = append(lines, fmt.Sprintf("~ joint %s schemas", key))
+		}
+	}
+	sort.Strings(lines)
+	for _, pInfo := range self.AddedPipes {
+		lines = append(lines, fmt.Sprintf("+ pipe %s -> %s", pInfo.Source, pInfo.Destination))
+	}
+	for _, pInfo := range self.RemovedPipes {
+		lines = append(lines, fmt.Sprintf("- pipe %s -> %s", pInfo.Source, pInfo.Destination))
+	}
+	if self.SchemasChanged {
+		lines = append(lines, "~ graph schemas")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Move the running graph to the new document by a single Mutate.
+// Joints and bridges not in the diff keep running as they are, with their controllers and queued packets.
+// Replaced joints are removed and added again, so every bridge at them is rebuilt,
+// packets queued toward them are delivered to the new controllers.
+func (self *GraphDiff) Apply(ctx context.Context, graph *core.MetaGraph) error {
+	if self.Empty() {
+		return nil
+	}
+	return graph.Mutate(ctx, func(m *core.Mutation) error {
+		rewired := make(map[core.JointKey]bool)
+		taken := make(map[*core.JointBridge]bool)
+		for _, key := range self.RemovedJoints {
+			if err := m.RemoveJoint(key); err != nil {
+				return err
+			}
+		}
+		for key, change := range self.ChangedJoints {
+			if change.Replaced {
+				if err := m.RemoveJoint(key); err != nil {
+					return err
+				}
+				if err := addMutationJoint(m, graph.Universe, key, change.To); err != nil {
+					return err
+				}
+				rewired[key] = true
+			}
+			if err := setMutationSchemas(m, key, change.From.Schemas, change.To.Schemas); err != nil {
+				return errors.Wrapf(err, "Failed to set schemas of joint %s", key)
+			}
+		}
+		for key, jInfo := range self.AddedJoints {
+			if err := addMutationJoint(m, graph.Universe, key, jInfo); err != nil {
+				return err
+			}
+			if err := setMutationSchemas(m, key, nil, jInfo.Schemas); err != nil {
+				return errors.Wrapf(err, "Failed to set schemas of joint %s", key)
+			}
+		}
+		for _, pInfo := range self.RemovedPipes {
+			if rewired[pInfo.Source.Joint()] || rewired[pInfo.Destination.Joint()] {
+				// already gone with the replaced joint
+				continue
+			}
+			br := findBridge(graph, pInfo, taken)
+			if br == nil {
+				return fmt.Errorf("Pipe %s -> %s is not in the graph", pInfo.Source, pInfo.Destination)
+			}
+			if err := m.RemoveBridge(br); err != nil {
+				return err
+			}
+			taken[br] = true
+		}
+		pipes := append([]*PipeInfo(nil), self.AddedPipes...)
+		if len(rewired) > 0 {
+			// every pipe at replaced joints, without duplicating added ones
+			added := make(map[*PipeInfo]bool, len(self.AddedPipes))
+			for _, pInfo := range self.AddedPipes {
+				added[pInfo] = true
+			}
+			for _, pInfo := range self.pipes {
+				if !added[pInfo] && (rewired[pInfo.Source.Joint()] || rewired[pInfo.Destination.Joint()]) {
+					pipes = append(pipes, pInfo)
+				}
+			}
+		}
+		for _, pInfo := range pipes {
+			br, err := pInfo.bridge(graph.Flavor)
+			if err != nil {
+				return errors.Wrapf(err, "Invalid pipe %s -> %s", pInfo.Source, pInfo.Destination)
+			}
+			if err := m.AddBridge(br); err != nil {
+				return err
+			}
+		}
+		if self.SchemasChanged {
+			var from map[core.PortKey]SchemaInfo
+			for ep, schema := range graph.Schemas() {
+				if ep.Joint == core.GRAPH {
+					if from == nil {
+						from = make(map[core.PortKey]SchemaInfo)
+					}
+					from[ep.Port] = NewSchemaInfo(schema)
+				}
+			}
+			if err := setMutationSchemas(m, core.GRAPH, from, self.Schemas); err != nil {
+				return errors.Wrap(err, "Failed to set graph schemas")
+			}
+		}
+		return nil
+	})
+}
+
+func addMutationJoint(m *core.Mutation, univ *core.Universe, key core.JointKey, jInfo *JointInfo) error {
+	param, err := decodeParam(univ, key, jInfo, jsonHandle, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := m.AddJoint(key, param); err != nil {
+		return errors.Wrapf(err, "Error during adding joint %s", key)
+	}
+	return nil
+}
+
+func setMutationSchemas(m *core.Mutation, joint core.JointKey, from, to map[core.PortKey]SchemaInfo) error {
+	for port := range from {
+		if _, ok := to[port]; !ok {
+			m.SetSchema(core.Endpoint{joint, port}, nil)
+		}
+	}
+	for port, sInfo := range to {
+		schema, err := sInfo.Schema()
+		if err != nil {
+			return errors.Wrapf(err, "Invalid schema at %s", port)
+		}
+		m.SetSchema(core.Endpoint{joint, port}, schema)
+	}
+	return nil
+}
+
+// live bridge described by the pipe and not taken yet, nil if not found
+func findBridge(graph *core.MetaGraph, pInfo *PipeInfo, taken map[*core.JointBridge]bool) *core.JointBridge {
+	for _, br := range graph.Pipes {
+		if !taken[br] && *newPipeInfo(br) == *pInfo {
+			return br
+		}
+	}
+	return nil
+}
+
+// Load the graph stored under the key and move the running graph to it, see GraphDiff.Apply.
+// Returns the applied diff.
+func Reload(ctx context.Context, graph *core.MetaGraph, st core.Storage, key string) (*GraphDiff, error) {
+	loaded, err := st.Load(key, graph.Universe)
+	if err != nil {
+		return nil, err
+	}
+	from, err := ToInfo(graph)
+	if err != nil {
+		return nil, err
+	}
+	to, err := ToInfo(loaded)
+	if err != nil {
+		return nil, err
+	}
+	diff, err := Diff(from, to)
+	if err != nil {
+		return nil, err
+	}
+	if err := diff.Apply(ctx, graph); err != nil {
+		return nil, errors.Wrapf(err, "Failed to reload graph %s", key)
+	}
+	return diff, nil
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"encoding/json"
+	"github.com/kanosaki/go-pipenet/core"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	from := &GraphInfo{
+		Joints: map[core.JointKey]*JointInfo{
+			"a": {Component: "merge", Param: json.RawMessage(`{"x": 1, "y": [1, 2]}`)},
+			"b": {Component: "merge"},
+			"c": {Component: "merge"},
+		},
+		Pipes: []*PipeInfo{
+			{Source: ":in", Destination: "a:in0"},
+			{Source: "a:out", Destination: "b:in0"},
+			{Source: "b:out", Destination: ":out"},
+		},
+	}
+	to := &GraphInfo{
+		Joints: map[core.JointKey]*JointInfo{
+			"a": {Component: "merge", Param: json.RawMessage(`{"y":[1,2],"x":1}`)},
+			"b": {Component: "merge", Param: json.RawMessage(`{"x": 2}`)},
+			"d": {Component: "merge"},
+		},
+		Pipes: []*PipeInfo{
+			{Source: ":in", Destination: "a:in0"},
+			{Source: "a:out", Destination: "b:in0", Mode: "channel"},
+			{Source: "b:out", Destination: ":out"},
+		},
+	}
+	diff, err := Diff(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := diff.ChangedJoints["a"]; ok {
+		t.Errorf("Params in different order must be equal")
+	}
+	if change, ok := diff.ChangedJoints["b"]; !ok || !change.Replaced {
+		t.Errorf("Changed param must replace the joint: %v", diff.ChangedJoints)
+	}
+	if len(diff.RemovedJoints) != 1 || diff.RemovedJoints[0] != "c" {
+		t.Errorf("Unexpected removed joints: %v", diff.RemovedJoints)
+	}
+	if _, ok := diff.AddedJoints["d"]; !ok || len(diff.AddedJoints) != 1 {
+		t.Errorf("Unexpected added joints: %v", diff.AddedJoints)
+	}
+	if len(diff.AddedPipes) != 1 || diff.AddedPipes[0].Mode != "channel" || len(diff.RemovedPipes) != 1 || diff.RemovedPipes[0].Mode != "" {
+		t.Errorf("Pipe with changed mode must be replaced: %v", diff)
+	}
+	same, err := Diff(to, to)
+	if err != nil || !same.Empty() {
+		t.Errorf("Diff of the same document must be empty: %v %v", same, err)
+	}
+}
@@ -1,9 +1,247 @@
 package storage
 
-type DirectoryStorage struct {
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/kanosaki/go-pipenet/core"
+	"github.com/pkg/errors"
+	"github.com/ugorji/go/codec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DOCUMENT_EXT = ".json"
+	CHECKPOINT_EXT = ".checkpoint"
+)
 
+// Stores each graph as a JSON document named <key>.json in the directory
+type DirectoryStorage struct {
+	dir string
 }
 
 func NewDirectoryStorage(dir string) (*DirectoryStorage, error) {
-	panic("NIE")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "Failed to create directory %s", dir)
+	}
+	return &DirectoryStorage{
+		dir: dir,
+	}, nil
+}
+
+func (self *DirectoryStorage) Dir() string {
+	return self.dir
+}
+
+func (self *DirectoryStorage) path(key, ext string) (string, error) {
+	if key == "" || strings.ContainsAny(key, `/\`) || key == "." || key == ".." {
+		return "", fmt.Errorf("Invalid key %q", key)
+	}
+	return filepath.Join(self.dir, key + ext), nil
+}
+
+// Keys of stored documents, sorted
+func (self *DirectoryStorage) Keys() ([]string, error) {
+	entries, err := ioutil.ReadDir(self.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != DOCUMENT_EXT {
+			continue
+		}
+		ret = append(ret, strings.TrimSuffix(entry.Name(), DOCUMENT_EXT))
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (self *DirectoryStorage) ReadDocument(key string) ([]byte, error) {
+	path, err := self.path(key, DOCUMENT_EXT)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+// Replace the document atomically, through a temporary file in the same directory
+func (self *DirectoryStorage) WriteDocument(key string, data []byte) error {
+	path, err := self.path(key, DOCUMENT_EXT)
+	if err != nil {
+		return err
+	}
+	return self.writeFile(key, path, data)
+}
+
+func (self *DirectoryStorage) writeFile(key, path string, data []byte) error {
+	tmp, err := ioutil.TempFile(self.dir, "." + key + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (self *DirectoryStorage) Save(key string, graph *core.MetaGraph, univ *core.Universe) error {
+	var buf bytes.Buffer
+	if err := ToJson(&buf, graph); err != nil {
+		return errors.Wrapf(err, "Failed to encode graph %s", key)
+	}
+	return self.WriteDocument(key, buf.Bytes())
+}
+
+func (self *DirectoryStorage) Load(key string, univ *core.Universe) (*core.MetaGraph, error) {
+	data, err := self.ReadDocument(key)
+	if err != nil {
+		return nil, err
+	}
+	mGraph, err := FromJson(bytes.NewReader(data), univ)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to load graph %s", key)
+	}
+	return mGraph, nil
+}
+
+// Checkpoint is stored as <key>.checkpoint next to the document
+func (self *DirectoryStorage) SaveCheckpoint(key string, cp *core.Checkpoint) error {
+	path, err := self.path(key, CHECKPOINT_EXT)
+	if err != nil {
+		return err
+	}
+	var buf []byte
+	if err := codec.NewEncoderBytes(&buf, jsonHandle).Encode(cp); err != nil {
+		return errors.Wrapf(err, "Failed to encode checkpoint %s", key)
+	}
+	return self.writeFile(key, path, buf)
+}
+
+func (self *DirectoryStorage) LoadCheckpoint(key string) (*core.Checkpoint, error) {
+	path, err := self.path(key, CHECKPOINT_EXT)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cp := &core.Checkpoint{}
+	if err := codec.NewDecoderBytes(data, jsonHandle).Decode(cp); err != nil {
+		return nil, errors.Wrapf(err, "Failed to decode checkpoint %s", key)
+	}
+	return cp, nil
+}
+
+// Rewrite documents of older versions to the latest one
+func (self *DirectoryStorage) MigrateAll(migrator *Migrator) ([]string, error) {
+	keys, err := self.Keys()
+	if err != nil {
+		return nil, err
+	}
+	var migrated []string
+	for _, key := range keys {
+		data, err := self.ReadDocument(key)
+		if err != nil {
+			return migrated, err
+		}
+		upgraded, err := MigrateJson(data, migrator)
+		if err != nil {
+			return migrated, errors.Wrapf(err, "Failed to migrate graph %s", key)
+		}
+		if upgraded == nil {
+			continue
+		}
+		if err := self.WriteDocument(key, upgraded); err != nil {
+			return migrated, err
+		}
+		migrated = append(migrated, key)
+	}
+	return migrated, nil
+}
+
+type documentStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func (self *DirectoryStorage) stamps() (map[string]documentStamp, error) {
+	entries, err := ioutil.ReadDir(self.dir)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]documentStamp, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != DOCUMENT_EXT {
+			continue
+		}
+		ret[strings.TrimSuffix(entry.Name(), DOCUMENT_EXT)] = documentStamp{entry.ModTime(), entry.Size()}
+	}
+	return ret, nil
+}
+
+// Poll the directory every interval, calling onChange with keys of documents written since the last poll.
+// Documents existing when Watch starts are not reported, removed ones are not reported.
+// Blocks until ctx is done or the directory can not be read.
+func (self *DirectoryStorage) Watch(ctx context.Context, interval time.Duration, onChange func(key string)) error {
+	known, err := self.stamps()
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		current, err := self.stamps()
+		if err != nil {
+			return err
+		}
+		var changed []string
+		for key, stamp := range current {
+			if prev, ok := known[key]; !ok || prev != stamp {
+				changed = append(changed, key)
+			}
+		}
+		known = current
+		sort.Strings(changed)
+		for _, key := range changed {
+			onChange(key)
+		}
+	}
+}
+
+// Reload the running graph whenever the document under the key is written, see Reload.
+// Failed reloads are reported by TellError of the graph, which keeps running as it was.
+func (self *DirectoryStorage) WatchGraph(ctx context.Context, interval time.Duration, key string, graph *core.MetaGraph) error {
+	return self.Watch(ctx, interval, func(changed string) {
+		if changed != key {
+			return
+		}
+		if _, err := Reload(ctx, graph, self, key); err != nil {
+			graph.TellError(nil, err)
+		}
+	})
 }
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kanosaki/go-pipenet/core"
+	"github.com/pkg/errors"
+	"github.com/ugorji/go/codec"
+)
+
+// position of an element in a document, 1-origin
+type position struct {
+	line   int
+	column int
+}
+
+// path of an element, as used in DocumentError
+func childPath(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+// Construct MetaGraph from a generic tree (maps, slices and scalars) decoded from a document.
+// The tree goes through JSON so that GraphInfo and params of joints are decoded in the same way as JSON documents.
+// Documents of older versions are upgraded by DefaultMigrator before decoding.
+func fromTree(tree interface{}, univ *core.Universe, vars map[string]interface{}, format string, positions map[string]position) (*core.MetaGraph, error) {
+	root, ok := normalizeTree(tree).(map[string]interface{})
+	if !ok {
+		return nil, &DocumentError{Format: format, Err: fmt.Errorf("Document must be an object")}
+	}
+	if _, err := DefaultMigrator.Upgrade(root); err != nil {
+		return nil, &DocumentError{Format: format, Path: VERSION_KEY, Line: positions[VERSION_KEY].line, Column: positions[VERSION_KEY].column, Err: err}
+	}
+	doc, err := json.Marshal(root)
+	if err != nil {
+		return nil, &DocumentError{Format: format, Err: errors.Wrap(err, "Unsupported value")}
+	}
+	info := &GraphInfo{}
+	if err := codec.NewDecoderBytes(doc, jsonHandle).Decode(info); err != nil {
+		return nil, &DocumentError{Format: format, Err: errors.Wrap(err, "Decode failed")}
+	}
+	mGraph, err := buildGraph(info, univ, jsonHandle, vars)
+	if docErr, ok := err.(*DocumentError); ok {
+		docErr.Format = format
+		if pos, ok := positions[docErr.Path]; ok {
+			docErr.Line, docErr.Column = pos.line, pos.column
+		}
+	}
+	return mGraph, err
+}
+
+// maps with non-string keys and raw strings, which some decoders produce, into JSON compatible ones
+func normalizeTree(tree interface{}) interface{} {
+	switch x := tree.(type) {
+	case map[string]interface{}:
+		for k, v := range x {
+			x[k] = normalizeTree(v)
+		}
+		return x
+	case map[interface{}]interface{}:
+		ret := make(map[string]interface{}, len(x))
+		for k, v := range x {
+			ret[fmt.Sprint(normalizeTree(k))] = normalizeTree(v)
+		}
+		return ret
+	case []interface{}:
+		for i, v := range x {
+			x[i] = normalizeTree(v)
+		}
+		return x
+	case []byte:
+		return string(x)
+	default:
+		return x
+	}
+}
@@ -0,0 +1,32 @@
+package storage
+
+import "fmt"
+
+// Error in a graph document,
+// Line and Column are 1-origin, and 0 if the position is unknown.
+type DocumentError struct {
+	Format string
+	// e.g. joints.j1, repeat[0]
+	Path   string
+	Line   int
+	Column int
+	Err    error
+}
+
+func (self *DocumentError) Error() string {
+	var at string
+	switch {
+	case self.Line > 0 && self.Column > 0:
+		at = fmt.Sprintf("%s:%d:%d: ", self.Format, self.Line, self.Column)
+	case self.Line > 0:
+		at = fmt.Sprintf("%s:%d: ", self.Format, self.Line)
+	}
+	if self.Path != "" {
+		at += self.Path + ": "
+	}
+	return at + self.Err.Error()
+}
+
+func (self *DocumentError) Cause() error {
+	return self.Err
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"io"
 	"github.com/kanosaki/go-pipenet/core"
 	"github.com/ugorji/go/codec"
@@ -16,13 +17,23 @@ const (
 
 var (
 	jsonHandle *codec.JsonHandle = &codec.JsonHandle{}
+	// for documents written by storages
+	indentJsonHandle *codec.JsonHandle = &codec.JsonHandle{Indent: 2}
 )
 
 type GraphInfo struct {
+	// version of the document shape, see LATEST_VERSION
+	Version int `codec:"version,omitempty"`
 	Joints  map[core.JointKey]*JointInfo `codec:"joints"`
 	Pipes   []*PipeInfo `codec:"pipes"`
 	Inlets  []core.PortKey `codec:"inlets"`
 	Outlets []core.PortKey `codec:"outlets"`
+	// schemas of graph inlets and outlets
+	Schemas map[core.PortKey]SchemaInfo `codec:"schemas"`
+	// template variables, substituted for ${name} in joint params. write $${ for ${ as text
+	Vars    map[string]*VarInfo `codec:"vars"`
+	// blocks stamping out joints repeatedly
+	Repeat  []*RepeatInfo `codec:"repeat"`
 }
 
 type JointInfo struct {
@@ -30,17 +41,207 @@ type JointInfo struct {
 	Inlets    []core.PortKey `codec:"inlets"`
 	Outlets   []core.PortKey `codec:"outlets"`
 	Param     json.RawMessage `codec:"param"`
+	// schemas of joint ports
+	Schemas   map[core.PortKey]SchemaInfo `codec:"schemas"`
 }
 
+// field name --> field
+type SchemaInfo map[string]*FieldInfo
+
+type FieldInfo struct {
+	Type     string `codec:"type"`
+	Required bool `codec:"required"`
+	Fields   SchemaInfo `codec:"fields"`
+	Items    *FieldInfo `codec:"items"`
+}
+
+func (self SchemaInfo) Schema() (*core.Schema, error) {
+	fields, err := self.fields()
+	if err != nil {
+		return nil, err
+	}
+	return core.NewSchema(fields), nil
+}
+
+func (self SchemaInfo) fields() (map[string]*core.FieldSchema, error) {
+	if self == nil {
+		return nil, nil
+	}
+	ret := make(map[string]*core.FieldSchema, len(self))
+	for name, fInfo := range self {
+		field, err := fInfo.field()
+		if err != nil {
+			return nil, errors.Wrapf(err, "at field %s", name)
+		}
+		ret[name] = field
+	}
+	return ret, nil
+}
+
+func NewSchemaInfo(schema *core.Schema) SchemaInfo {
+	return newSchemaInfo(schema.Fields)
+}
+
+func newSchemaInfo(fields map[string]*core.FieldSchema) SchemaInfo {
+	if fields == nil {
+		return nil
+	}
+	ret := make(SchemaInfo, len(fields))
+	for name, field := range fields {
+		ret[name] = newFieldInfo(field)
+	}
+	return ret
+}
+
+func newFieldInfo(field *core.FieldSchema) *FieldInfo {
+	ret := &FieldInfo{
+		Type: string(field.Type),
+		Required: field.Required,
+		Fields: newSchemaInfo(field.Fields),
+	}
+	if field.Items != nil {
+		ret.Items = newFieldInfo(field.Items)
+	}
+	return ret
+}
+
+func (self *FieldInfo) field() (*core.FieldSchema, error) {
+	fType, err := core.ParseFieldType(self.Type)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := self.Fields.fields()
+	if err != nil {
+		return nil, err
+	}
+	ret := &core.FieldSchema{
+		Type: fType,
+		Required: self.Required,
+		Fields: fields,
+	}
+	if self.Items != nil {
+		ret.Items, err = self.Items.field()
+		if err != nil {
+			return nil, errors.Wrap(err, "at items")
+		}
+	}
+	return ret, nil
+}
+
+// Written either as array [source, destination, mode] or as object with options below
 type PipeInfo struct {
-	_struct     bool `codec:",toarray"`
-	Source      EndpointInfo
-	Destination EndpointInfo
-	Mode        string
+	Source      EndpointInfo `codec:"source"`
+	Destination EndpointInfo `codec:"destination"`
+	// direct, channel or routine, decided by the placement planner if omitted
+	Mode        string `codec:"mode,omitempty"`
+	Name        string `codec:"name,omitempty"`
+	// queue capacity of channel, routine and demand modes in packets
+	Buffer      int `codec:"buffer,omitempty"`
+	// block, drop-oldest or drop-newest
+	Overflow    string `codec:"overflow,omitempty"`
+	// expression on packet fields, see core.Filter
+	Filter      string `codec:"filter,omitempty"`
+	// log packets until delivered, requires name, see core.WalOptions
+	Durable     bool `codec:"durable,omitempty"`
+}
+
+// PipeInfo without methods, to decode the object form
+type pipeObject PipeInfo
+
+func (self *PipeInfo) UnmarshalJSON(data []byte) error {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		return codec.NewDecoderBytes(data, jsonHandle).Decode((*pipeObject)(self))
+	}
+	var items []string
+	if err := codec.NewDecoderBytes(data, jsonHandle).Decode(&items); err != nil {
+		return err
+	}
+	switch len(items) {
+	case 3:
+		self.Mode = items[2]
+		fallthrough
+	case 2:
+		self.Source, self.Destination = EndpointInfo(items[0]), EndpointInfo(items[1])
+		return nil
+	default:
+		return fmt.Errorf("Pipe must be [source, destination] or [source, destination, mode], but %s", trimmed)
+	}
+}
+
+// array form unless options other than mode are set
+func (self *PipeInfo) MarshalJSON() ([]byte, error) {
+	var buf []byte
+	var err error
+	if self.Name == "" && self.Buffer == 0 && self.Overflow == "" && self.Filter == "" && !self.Durable {
+		items := []string{string(self.Source), string(self.Destination)}
+		if self.Mode != "" {
+			items = append(items, self.Mode)
+		}
+		err = codec.NewEncoderBytes(&buf, jsonHandle).Encode(items)
+	} else {
+		err = codec.NewEncoderBytes(&buf, jsonHandle).Encode((*pipeObject)(self))
+	}
+	return buf, err
+}
+
+// Bridge configured by the pipe, mode is decided by the planner if omitted
+func (self *PipeInfo) bridge(flavor core.PerformanceFlavor) (*core.JointBridge, error) {
+	br := &core.JointBridge{
+		Source: core.Endpoint{Joint: self.Source.Joint(), Port: self.Source.Port()},
+		Destination: core.Endpoint{Joint: self.Destination.Joint(), Port: self.Destination.Port()},
+		Mode: core.FlavorToMode(flavor),
+		AutoMode: self.Mode == "",
+		Name: self.Name,
+		Buffer: self.Buffer,
+		Durable: self.Durable,
+	}
+	var err error
+	if self.Mode != "" {
+		if br.Mode, err = core.ParsePipeMode(self.Mode); err != nil {
+			return nil, err
+		}
+	}
+	if self.Overflow != "" {
+		if br.Overflow, err = core.ParseOverflowPolicy(self.Overflow); err != nil {
+			return nil, err
+		}
+	}
+	if self.Filter != "" {
+		if br.Filter, err = core.ParseFilter(self.Filter); err != nil {
+			return nil, err
+		}
+	}
+	return br, nil
+}
+
+// options as declared, modes and capacities decided by the planner are left out so that diffs of running graphs stay stable
+func newPipeInfo(br *core.JointBridge) *PipeInfo {
+	ret := &PipeInfo{
+		Source: NewEndpointInfo(br.Source),
+		Destination: NewEndpointInfo(br.Destination),
+		Name: br.Name,
+		Buffer: br.Buffer,
+		Durable: br.Durable,
+	}
+	if !br.AutoMode {
+		ret.Mode = br.Mode.Name()
+	}
+	if br.Overflow != core.OVERFLOW_BLOCK {
+		ret.Overflow = br.Overflow.String()
+	}
+	if br.Filter != nil {
+		ret.Filter = br.Filter.String()
+	}
+	return ret
 }
 
 type EndpointInfo string
 
+func NewEndpointInfo(ep core.Endpoint) EndpointInfo {
+	return EndpointInfo(string(ep.Joint) + ENDPOINT_SEPARATOR + string(ep.Port))
+}
+
 func (self EndpointInfo) Joint() core.JointKey {
 	return core.JointKey(self[:strings.Index(string(self), ENDPOINT_SEPARATOR)])
 }
@@ -55,45 +256,189 @@ type ComponentParamInfo struct {
 // Construct MetaGraph from Document
 
 func FromDocument(reader io.Reader, univ *core.Universe, handle codec.Handle) (*core.MetaGraph, error) {
+	return FromTemplate(reader, univ, handle, nil)
+}
+
+// Construct MetaGraph from Document, instantiating template with vars.
+// Variables declared by the document and missing in vars take their defaults.
+func FromTemplate(reader io.Reader, univ *core.Universe, handle codec.Handle, vars map[string]interface{}) (*core.MetaGraph, error) {
 	dec := codec.NewDecoder(reader, handle)
-	info := &GraphInfo{}
-	err := dec.Decode(info)
+	var tree interface{}
+	err := dec.Decode(&tree)
 	if err != nil {
-		return nil, errors.Wrap(err, "JSON Decode failed")
+		return nil, &DocumentError{Format: handle.Name(), Err: errors.Wrap(err, "Decode failed")}
+	}
+	return fromTree(tree, univ, vars, handle.Name(), nil)
+}
+
+// Construct MetaGraph from decoded document, params of joints are decoded as JSON
+func FromInfo(info *GraphInfo, univ *core.Universe) (*core.MetaGraph, error) {
+	return buildGraph(info, univ, jsonHandle, nil)
+}
+
+func buildGraph(info *GraphInfo, univ *core.Universe, handle codec.Handle, vars map[string]interface{}) (*core.MetaGraph, error) {
+	if info.Version > LATEST_VERSION {
+		return nil, &DocumentError{Path: VERSION_KEY, Err: fmt.Errorf("Document version %d is newer than supported version %d", info.Version, LATEST_VERSION)}
+	}
+	vars, err := info.resolveVars(vars)
+	if err != nil {
+		return nil, &DocumentError{Path: "vars", Err: err}
 	}
 	mGraph := core.NewMetaGraph(univ)
-	for _, pInfo := range info.Pipes {
-		mGraph.AddBridge(
-			pInfo.Source.Joint(),
-			pInfo.Source.Port(),
-			pInfo.Destination.Joint(),
-			pInfo.Destination.Port())
+	for i, pInfo := range info.Pipes {
+		if err := addPipe(mGraph, pInfo); err != nil {
+			return nil, &DocumentError{Path: fmt.Sprintf("pipes[%d]", i), Err: err}
+		}
 	}
 	for jKey, jInfo := range info.Joints {
-		var param core.ComponentParam
-		if component, ok := mGraph.Universe.Components[jInfo.Component]; !ok {
-			return nil, fmt.Errorf("Undefined component %s", jInfo.Component)
-		} else {
-			paramDecoder := codec.NewDecoderBytes(jInfo.Param, handle)
-			if len(jInfo.Param) != 0 {
-				param, err = component.DecodeParam(paramDecoder, jInfo.Param)
-				if err != nil {
-					return nil, errors.Wrapf(err, "Failed to decode compoennt param for %s at %s", jInfo.Component, jKey)
-				}
-			} else {
-				param = &core.EmptyComponentParam{jInfo.Component}
-			}
+		if _, err := addJoint(mGraph, jKey, jInfo, handle, vars); err != nil {
+			return nil, &DocumentError{Path: "joints." + string(jKey), Err: err}
 		}
-		_, err := mGraph.AddJointByComponent(jKey, param)
-		if err != nil {
-			return nil, errors.Wrapf(err, "Error during adding joint %s", jKey)
+	}
+	for i, rInfo := range info.Repeat {
+		if err := rInfo.stamp(mGraph, handle, vars); err != nil {
+			return nil, &DocumentError{Path: fmt.Sprintf("repeat[%d]", i), Err: errors.Wrap(err, "Error during stamping repeat block")}
 		}
-		//mJoint.DefineInlet(jInfo.Inlets...)
-		//mJoint.DefineOutlet(jInfo.Outlets...)
+	}
+	if err := setSchemas(mGraph, core.GRAPH, info.Schemas); err != nil {
+		return nil, &DocumentError{Path: "schemas", Err: err}
 	}
 	return mGraph, nil
 }
 
+func addPipe(mGraph *core.MetaGraph, pInfo *PipeInfo) error {
+	br, err := pInfo.bridge(mGraph.Flavor)
+	if err != nil {
+		return err
+	}
+	return mGraph.AddJointBridge(br)
+}
+
+// empty jKey --> generated by IdGen of the graph
+func addJoint(mGraph *core.MetaGraph, jKey core.JointKey, jInfo *JointInfo, handle codec.Handle, vars map[string]interface{}) (*core.MetaJoint, error) {
+	param, err := decodeParam(mGraph.Universe, jKey, jInfo, handle, vars)
+	if err != nil {
+		return nil, err
+	}
+	mJoint, err := mGraph.AddJointByComponent(jKey, param)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error during adding joint %s", jKey)
+	}
+	//mJoint.DefineInlet(jInfo.Inlets...)
+	//mJoint.DefineOutlet(jInfo.Outlets...)
+	if err := setSchemas(mGraph, mJoint.Key, jInfo.Schemas); err != nil {
+		return nil, err
+	}
+	return mJoint, nil
+}
+
+func decodeParam(univ *core.Universe, jKey core.JointKey, jInfo *JointInfo, handle codec.Handle, vars map[string]interface{}) (core.ComponentParam, error) {
+	component, ok := univ.Components[jInfo.Component]
+	if !ok {
+		return nil, fmt.Errorf("Undefined component %s", jInfo.Component)
+	}
+	var err error
+	rawParam := []byte(jInfo.Param)
+	// scanned even without vars, so that undefined variables are not left as text. $${ escapes them
+	rawParam, err = substitute(rawParam, vars)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to substitute param for %s at %s", jInfo.Component, jKey)
+	}
+	if len(rawParam) == 0 {
+		return &core.EmptyComponentParam{jInfo.Component}, nil
+	}
+	param, err := component.DecodeParam(codec.NewDecoderBytes(rawParam, handle), rawParam)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to decode compoennt param for %s at %s", jInfo.Component, jKey)
+	}
+	return param, nil
+}
+
+func setSchemas(mGraph *core.MetaGraph, joint core.JointKey, schemas map[core.PortKey]SchemaInfo) error {
+	for port, sInfo := range schemas {
+		schema, err := sInfo.Schema()
+		if err != nil {
+			return errors.Wrapf(err, "Invalid schema for %s:%s", joint, port)
+		}
+		mGraph.SetSchema(core.Endpoint{Joint: joint, Port: port}, schema)
+	}
+	return nil
+}
+
 func FromJson(reader io.Reader, univ *core.Universe) (*core.MetaGraph, error) {
 	return FromDocument(reader, univ, jsonHandle)
 }
+
+func FromJsonTemplate(reader io.Reader, univ *core.Universe, vars map[string]interface{}) (*core.MetaGraph, error) {
+	return FromTemplate(reader, univ, jsonHandle, vars)
+}
+
+// Document of the graph.
+// Template variables and repeat blocks are not kept, since the graph is already instantiated.
+func ToInfo(graph *core.MetaGraph) (*GraphInfo, error) {
+	info := &GraphInfo{
+		Version: LATEST_VERSION,
+		Joints: make(map[core.JointKey]*JointInfo, len(graph.Joints)),
+	}
+	for key, joint := range graph.Joints {
+		jInfo := &JointInfo{
+			Component: joint.Component,
+		}
+		if _, empty := joint.Param.(*core.EmptyComponentParam); joint.Param != nil && !empty {
+			var buf []byte
+			if err := codec.NewEncoderBytes(&buf, jsonHandle).Encode(joint.Param); err != nil {
+				return nil, errors.Wrapf(err, "Failed to encode param of joint %s", key)
+			}
+			jInfo.Param = json.RawMessage(buf)
+		}
+		info.Joints[key] = jInfo
+	}
+	for _, br := range graph.Pipes {
+		info.Pipes = append(info.Pipes, newPipeInfo(br))
+		if br.Source.Joint == core.GRAPH {
+			info.Inlets = appendPort(info.Inlets, br.Source.Port)
+		} else if jInfo, ok := info.Joints[br.Source.Joint]; ok {
+			jInfo.Outlets = appendPort(jInfo.Outlets, br.Source.Port)
+		}
+		if br.Destination.Joint == core.GRAPH {
+			info.Outlets = appendPort(info.Outlets, br.Destination.Port)
+		} else if jInfo, ok := info.Joints[br.Destination.Joint]; ok {
+			jInfo.Inlets = appendPort(jInfo.Inlets, br.Destination.Port)
+		}
+	}
+	for ep, schema := range graph.Schemas() {
+		if ep.Joint == core.GRAPH {
+			if info.Schemas == nil {
+				info.Schemas = make(map[core.PortKey]SchemaInfo)
+			}
+			info.Schemas[ep.Port] = NewSchemaInfo(schema)
+		} else if jInfo, ok := info.Joints[ep.Joint]; ok {
+			if jInfo.Schemas == nil {
+				jInfo.Schemas = make(map[core.PortKey]SchemaInfo)
+			}
+			jInfo.Schemas[ep.Port] = NewSchemaInfo(schema)
+		}
+	}
+	return info, nil
+}
+
+func appendPort(ports []core.PortKey, port core.PortKey) []core.PortKey {
+	for _, p := range ports {
+		if p == port {
+			return ports
+		}
+	}
+	return append(ports, port)
+}
+
+func ToDocument(writer io.Writer, graph *core.MetaGraph, handle codec.Handle) error {
+	info, err := ToInfo(graph)
+	if err != nil {
+		return err
+	}
+	return codec.NewEncoder(writer, handle).Encode(info)
+}
+
+func ToJson(writer io.Writer, graph *core.MetaGraph) error {
+	return ToDocument(writer, graph, indentJsonHandle)
+}
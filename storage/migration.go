@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/ugorji/go/codec"
+	"reflect"
+)
+
+const (
+	// version of the document shape which GraphInfo decodes.
+	// documents without version are treated as version 1.
+	LATEST_VERSION = 1
+	VERSION_KEY = "version"
+)
+
+// Upgrades a document of a version to the next one in place
+type Migration func(doc map[string]interface{}) error
+
+// Registry of migrations
+type Migrator struct {
+	Latest int
+	steps  map[int]Migration
+}
+
+var (
+	DefaultMigrator *Migrator = NewMigrator(LATEST_VERSION)
+)
+
+func NewMigrator(latest int) *Migrator {
+	return &Migrator{
+		Latest: latest,
+		steps: make(map[int]Migration),
+	}
+}
+
+// Register migration from the version to version + 1
+func (self *Migrator) Register(from int, migration Migration) {
+	self.steps[from] = migration
+}
+
+// Upgrade the document to the latest version step by step.
+// returns true if the document was modified.
+func (self *Migrator) Upgrade(doc map[string]interface{}) (bool, error) {
+	from, err := documentVersion(doc)
+	if err != nil {
+		return false, err
+	}
+	if from > self.Latest {
+		return false, fmt.Errorf("Document version %d is newer than supported version %d", from, self.Latest)
+	}
+	for version := from; version < self.Latest; version++ {
+		step, ok := self.steps[version]
+		if !ok {
+			return false, fmt.Errorf("No migration from version %d", version)
+		}
+		if err := step(doc); err != nil {
+			return false, errors.Wrapf(err, "Failed to migrate from version %d", version)
+		}
+		doc[VERSION_KEY] = version + 1
+	}
+	return from < self.Latest, nil
+}
+
+func documentVersion(doc map[string]interface{}) (int, error) {
+	v, ok := doc[VERSION_KEY]
+	if !ok || v == nil {
+		return 1, nil
+	}
+	rv := reflect.ValueOf(v)
+	switch {
+	case reflect.Int <= rv.Kind() && rv.Kind() <= reflect.Int64:
+		return int(rv.Int()), nil
+	case reflect.Uint <= rv.Kind() && rv.Kind() <= reflect.Uint64:
+		return int(rv.Uint()), nil
+	case rv.Kind() == reflect.Float32 || rv.Kind() == reflect.Float64:
+		return int(rv.Float()), nil
+	default:
+		return 0, fmt.Errorf("Invalid document version %v", v)
+	}
+}
+
+// Storage which can rewrite stored documents to the latest version in bulk
+type MigratableStorage interface {
+	// returns keys of migrated documents
+	MigrateAll(migrator *Migrator) ([]string, error)
+}
+
+// Decode a JSON document embedded in another one, such as an inline subgraph,
+// upgrading it by DefaultMigrator first as FromJson does
+func DecodeInfoJson(data []byte) (*GraphInfo, error) {
+	return decodeInfoJson(data, DefaultMigrator)
+}
+
+func decodeInfoJson(data []byte, migrator *Migrator) (*GraphInfo, error) {
+	var tree interface{}
+	if err := codec.NewDecoderBytes(data, jsonHandle).Decode(&tree); err != nil {
+		return nil, errors.Wrap(err, "Decode failed")
+	}
+	doc, ok := normalizeTree(tree).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Document must be an object")
+	}
+	if _, err := migrator.Upgrade(doc); err != nil {
+		return nil, err
+	}
+	var buf []byte
+	if err := codec.NewEncoderBytes(&buf, jsonHandle).Encode(doc); err != nil {
+		return nil, err
+	}
+	info := &GraphInfo{}
+	if err := codec.NewDecoderBytes(buf, jsonHandle).Decode(info); err != nil {
+		return nil, errors.Wrap(err, "Decode failed")
+	}
+	return info, nil
+}
+
+// Upgrade a JSON document, returns nil if it is already the latest
+func MigrateJson(data []byte, migrator *Migrator) ([]byte, error) {
+	var tree interface{}
+	if err := codec.NewDecoderBytes(data, jsonHandle).Decode(&tree); err != nil {
+		return nil, errors.Wrap(err, "Decode failed")
+	}
+	doc, ok := normalizeTree(tree).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Document must be an object")
+	}
+	changed, err := migrator.Upgrade(doc)
+	if err != nil || !changed {
+		return nil, err
+	}
+	var buf []byte
+	err = codec.NewEncoderBytes(&buf, indentJsonHandle).Encode(doc)
+	return buf, err
+}
@@ -0,0 +1,59 @@
+package storage
+
+import "testing"
+
+func TestMigrator(t *testing.T) {
+	migrator := NewMigrator(3)
+	migrator.Register(1, func(doc map[string]interface{}) error {
+		doc["edges"] = doc["pipes"]
+		delete(doc, "pipes")
+		return nil
+	})
+	migrator.Register(2, func(doc map[string]interface{}) error {
+		doc["pipes"] = doc["edges"]
+		delete(doc, "edges")
+		return nil
+	})
+	doc := map[string]interface{}{
+		"pipes": []interface{}{},
+	}
+	changed, err := migrator.Upgrade(doc)
+	if err != nil || !changed {
+		t.Fatalf("Upgrade failed: %v %v", changed, err)
+	}
+	if doc[VERSION_KEY] != 3 {
+		t.Errorf("Version not updated: %v", doc[VERSION_KEY])
+	}
+	if _, ok := doc["pipes"]; !ok {
+		t.Errorf("Migrations not applied: %v", doc)
+	}
+	changed, err = migrator.Upgrade(doc)
+	if err != nil || changed {
+		t.Errorf("Latest document must not be changed: %v %v", changed, err)
+	}
+	if _, err := migrator.Upgrade(map[string]interface{}{VERSION_KEY: 4}); err == nil {
+		t.Errorf("Newer document must be rejected")
+	}
+	if _, err := NewMigrator(2).Upgrade(map[string]interface{}{}); err == nil {
+		t.Errorf("Missing migration must be reported")
+	}
+}
+
+func TestDecodeInfoJson(t *testing.T) {
+	migrator := NewMigrator(2)
+	migrator.Register(1, func(doc map[string]interface{}) error {
+		doc["pipes"] = doc["edges"]
+		delete(doc, "edges")
+		return nil
+	})
+	info, err := decodeInfoJson([]byte(`{"edges": [[":in", ":out"]]}`), migrator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != 2 || len(info.Pipes) != 1 {
+		t.Errorf("Embedded document not migrated: %+v", info)
+	}
+	if _, err := decodeInfoJson([]byte(`{"version": 3}`), migrator); err == nil {
+		t.Errorf("Newer document must be rejected")
+	}
+}
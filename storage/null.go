@@ -22,3 +22,16 @@ func (self *NullStorage) Save(key string, graph *core.MetaGraph, univ *core.Univ
 func (self *NullStorage) Load(key string, univ *core.Universe) (*core.MetaGraph, error) {
 	return nil, fmt.Errorf("Read from NullStorage")
 }
+
+func (self *NullStorage) SaveCheckpoint(key string, cp *core.Checkpoint) error {
+	log.Warn("Writing checkpoint to NullStorage")
+	return nil
+}
+
+func (self *NullStorage) LoadCheckpoint(key string) (*core.Checkpoint, error) {
+	return nil, nil
+}
+
+func (self *NullStorage) MigrateAll(migrator *Migrator) ([]string, error) {
+	return nil, nil
+}
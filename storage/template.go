@@ -0,0 +1,290 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/kanosaki/go-pipenet/core"
+	"github.com/pkg/errors"
+	"github.com/ugorji/go/codec"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	// joint stamped by the repeat block
+	REPEAT_SELF core.JointKey = "$"
+	// joint stamped just before by the repeat block
+	REPEAT_PREV core.JointKey = "$prev"
+	DEFAULT_INDEX_VAR = "index"
+)
+
+type VarInfo struct {
+	// one of field types of schema, "any" if omitted
+	Type    string `codec:"type"`
+	// nil --> variable is required
+	Default interface{} `codec:"default"`
+}
+
+// Stamps out Count joints, keys of them are generated by IdGen of the graph.
+type RepeatInfo struct {
+	// integer or "${var}"
+	Count interface{} `codec:"count"`
+	// name of the variable holding index of each joint, "index" if omitted
+	Index string `codec:"index"`
+	Joint *JointInfo `codec:"joint"`
+	// "$" in endpoints stands for the stamped joint, "$prev" for the one just before it.
+	// Pipes with "$prev" are skipped for the first joint.
+	Pipes []*PipeInfo `codec:"pipes"`
+}
+
+// merge given variables with defaults declared by the document
+func (self *GraphInfo) resolveVars(given map[string]interface{}) (map[string]interface{}, error) {
+	ret := make(map[string]interface{}, len(self.Vars))
+	for name := range given {
+		if _, ok := self.Vars[name]; !ok {
+			return nil, fmt.Errorf("Undeclared variable %s", name)
+		}
+	}
+	for name, vInfo := range self.Vars {
+		value, ok := given[name]
+		if !ok {
+			if vInfo.Default == nil {
+				return nil, fmt.Errorf("Variable %s is required", name)
+			}
+			value = vInfo.Default
+		}
+		vType, err := core.ParseFieldType(vInfo.Type)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid type for variable %s", name)
+		}
+		ret[name], err = coerce(value, vType)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid value for variable %s", name)
+		}
+	}
+	return ret, nil
+}
+
+func coerce(value interface{}, vType core.FieldType) (interface{}, error) {
+	rv := reflect.ValueOf(value)
+	switch vType {
+	case core.TYPE_STRING:
+		if rv.Kind() == reflect.String {
+			return rv.String(), nil
+		}
+	case core.TYPE_INT:
+		switch {
+		case reflect.Int <= rv.Kind() && rv.Kind() <= reflect.Int64:
+			return rv.Int(), nil
+		case reflect.Uint <= rv.Kind() && rv.Kind() <= reflect.Uint64:
+			return int64(rv.Uint()), nil
+		case rv.Kind() == reflect.Float32 || rv.Kind() == reflect.Float64:
+			if f := rv.Float(); f == math.Trunc(f) {
+				return int64(f), nil
+			}
+		case rv.Kind() == reflect.String:
+			return strconv.ParseInt(rv.String(), 10, 64)
+		}
+	case core.TYPE_FLOAT:
+		switch {
+		case reflect.Int <= rv.Kind() && rv.Kind() <= reflect.Int64:
+			return float64(rv.Int()), nil
+		case reflect.Uint <= rv.Kind() && rv.Kind() <= reflect.Uint64:
+			return float64(rv.Uint()), nil
+		case rv.Kind() == reflect.Float32 || rv.Kind() == reflect.Float64:
+			return rv.Float(), nil
+		case rv.Kind() == reflect.String:
+			return strconv.ParseFloat(rv.String(), 64)
+		}
+	case core.TYPE_BOOL:
+		switch rv.Kind() {
+		case reflect.Bool:
+			return rv.Bool(), nil
+		case reflect.String:
+			return strconv.ParseBool(rv.String())
+		}
+	default:
+		return value, nil
+	}
+	return nil, fmt.Errorf("%v is not %s", value, vType)
+}
+
+func (self *RepeatInfo) count(vars map[string]interface{}) (int, error) {
+	count := self.Count
+	if s, ok := count.(string); ok {
+		expanded, err := substituteString(s, vars)
+		if err != nil {
+			return 0, err
+		}
+		count = expanded
+	}
+	n, err := coerce(count, core.TYPE_INT)
+	if err != nil {
+		return 0, errors.Wrap(err, "Invalid count")
+	}
+	return int(n.(int64)), nil
+}
+
+func (self *RepeatInfo) stamp(mGraph *core.MetaGraph, handle codec.Handle, vars map[string]interface{}) error {
+	if self.Joint == nil {
+		return fmt.Errorf("Repeat block requires joint")
+	}
+	count, err := self.count(vars)
+	if err != nil {
+		return err
+	}
+	indexVar := self.Index
+	if indexVar == "" {
+		indexVar = DEFAULT_INDEX_VAR
+	}
+	prev := core.GRAPH
+	for i := 0; i < count; i++ {
+		iVars := make(map[string]interface{}, len(vars) + 1)
+		for k, v := range vars {
+			iVars[k] = v
+		}
+		iVars[indexVar] = int64(i)
+		mJoint, err := addJoint(mGraph, "", self.Joint, handle, iVars)
+		if err != nil {
+			return err
+		}
+		for _, pInfo := range self.Pipes {
+			src, srcOk, err := stampEndpoint(pInfo.Source, mJoint.Key, prev, iVars)
+			if err != nil {
+				return err
+			}
+			dst, dstOk, err := stampEndpoint(pInfo.Destination, mJoint.Key, prev, iVars)
+			if err != nil {
+				return err
+			}
+			if srcOk && dstOk {
+				stamped := *pInfo
+				stamped.Source, stamped.Destination = src, dst
+				if stamped.Name, err = substituteString(pInfo.Name, iVars); err != nil {
+					return err
+				}
+				if err := addPipe(mGraph, &stamped); err != nil {
+					return err
+				}
+			}
+		}
+		prev = mJoint.Key
+	}
+	return nil
+}
+
+// returns false if the endpoint refers previous joint which does not exist
+func stampEndpoint(ep EndpointInfo, self, prev core.JointKey, vars map[string]interface{}) (EndpointInfo, bool, error) {
+	expanded, err := substituteString(string(ep), vars)
+	if err != nil {
+		return "", false, err
+	}
+	ret := EndpointInfo(expanded)
+	switch ret.Joint() {
+	case REPEAT_SELF:
+		return EndpointInfo(string(self) + ENDPOINT_SEPARATOR + string(ret.Port())), true, nil
+	case REPEAT_PREV:
+		if prev == core.GRAPH {
+			return "", false, nil
+		}
+		return EndpointInfo(string(prev) + ENDPOINT_SEPARATOR + string(ret.Port())), true, nil
+	default:
+		return ret, true, nil
+	}
+}
+
+// replace ${name} in plain text, $${ is left as ${
+func substituteString(s string, vars map[string]interface{}) (string, error) {
+	var buf bytes.Buffer
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			buf.WriteString(s)
+			return buf.String(), nil
+		}
+		if start > 0 && s[start - 1] == '$' {
+			buf.WriteString(s[:start - 1])
+			buf.WriteString("${")
+			s = s[start + 2:]
+			continue
+		}
+		end := strings.Index(s[start:], "}")
+		if end < 0 {
+			return "", fmt.Errorf("Unterminated variable in %s", s)
+		}
+		name := s[start + 2:start + end]
+		value, ok := vars[name]
+		if !ok {
+			return "", fmt.Errorf("Undefined variable %s", name)
+		}
+		buf.WriteString(s[:start])
+		buf.WriteString(fmt.Sprint(value))
+		s = s[start + end + 1:]
+	}
+}
+
+// replace ${name} in JSON text.
+// A string consisting only of ${name} is replaced by the value keeping its type,
+// ${name} inside a longer string is replaced by text of the value.
+// $${ is left as ${, so that params can hold the text without a variable.
+func substitute(data []byte, vars map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	inString, escaped := false, false
+	stringStart := 0
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case inString && escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+			stringStart = i
+		case c == '$' && bytes.HasPrefix(data[i + 1:], []byte("${")):
+			buf.WriteString("${")
+			i += 2
+			continue
+		case c == '$' && i + 1 < len(data) && data[i + 1] == '{':
+			end := bytes.IndexByte(data[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("Unterminated variable at %d", i)
+			}
+			name := string(data[i + 2:i + end])
+			value, ok := vars[name]
+			if !ok {
+				return nil, fmt.Errorf("Undefined variable %s", name)
+			}
+			next := i + end + 1
+			wholeString := inString && stringStart == i - 1 && next < len(data) && data[next] == '"'
+			switch {
+			case wholeString:
+				// replace quoted placeholder with typed value
+				buf.Truncate(buf.Len() - 1)
+				next += 1
+				inString = false
+				fallthrough
+			case !inString:
+				encoded, err := json.Marshal(value)
+				if err != nil {
+					return nil, errors.Wrapf(err, "Failed to encode variable %s", name)
+				}
+				buf.Write(encoded)
+			default:
+				encoded, err := json.Marshal(fmt.Sprint(value))
+				if err != nil {
+					return nil, errors.Wrapf(err, "Failed to encode variable %s", name)
+				}
+				// without quotes
+				buf.Write(encoded[1:len(encoded) - 1])
+			}
+			i = next - 1
+			continue
+		}
+		buf.WriteByte(c)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,42 @@
+package storage
+
+import "testing"
+
+func TestSubstitute(t *testing.T) {
+	vars := map[string]interface{}{
+		"path": "/var/log/\"app\"",
+		"threshold": int64(3),
+		"ratio": 0.5,
+		"enabled": true,
+	}
+	dataAndExpected := [][]string{
+		[]string{`{"t": "${threshold}"}`, `{"t": 3}`},
+		[]string{`{"t": ${threshold}}`, `{"t": 3}`},
+		[]string{`{"r": "${ratio}", "e": "${enabled}"}`, `{"r": 0.5, "e": true}`},
+		[]string{`{"p": "${path}"}`, `{"p": "/var/log/\"app\""}`},
+		[]string{`{"p": "${path}/${threshold}.log"}`, `{"p": "/var/log/\"app\"/3.log"}`},
+		[]string{`{"x": "\"${threshold}\""}`, `{"x": "\"3\""}`},
+		[]string{`{"x": "no vars"}`, `{"x": "no vars"}`},
+		// escaped placeholders are left as text
+		[]string{`{"x": "cost $${price}"}`, `{"x": "cost ${price}"}`},
+		[]string{`{"x": "$${threshold}"}`, `{"x": "${threshold}"}`},
+		[]string{`{"x": "$$${threshold}", "y": "$$"}`, `{"x": "$${threshold}", "y": "$$"}`},
+	}
+	for _, row := range dataAndExpected {
+		actual, err := substitute([]byte(row[0]), vars)
+		if err != nil {
+			t.Errorf("Unexpected error %v (in %s)", err, row[0])
+		} else if string(actual) != row[1] {
+			t.Errorf("Substitution not match: %s != %s (in %s)", actual, row[1], row[0])
+		}
+	}
+	if _, err := substitute([]byte(`{"x": "${undefined}"}`), vars); err == nil {
+		t.Errorf("Undefined variable must be error")
+	}
+	if actual, err := substitute([]byte(`{"x": "$${undefined}"}`), nil); err != nil || string(actual) != `{"x": "${undefined}"}` {
+		t.Errorf("Escaped placeholder without vars: %s %v", actual, err)
+	}
+	if actual, err := substituteString("$${self}/${threshold}", vars); err != nil || actual != "${self}/3" {
+		t.Errorf("Escaped placeholder in plain text: %s %v", actual, err)
+	}
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/kanosaki/go-pipenet/core"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Construct MetaGraph from TOML Document
+func FromToml(reader io.Reader, univ *core.Universe) (*core.MetaGraph, error) {
+	return FromTomlTemplate(reader, univ, nil)
+}
+
+func FromTomlTemplate(reader io.Reader, univ *core.Universe, vars map[string]interface{}) (*core.MetaGraph, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	tree := make(map[string]interface{})
+	if _, err := toml.Decode(string(data), &tree); err != nil {
+		docErr := &DocumentError{Format: "toml", Err: err}
+		if parseErr, ok := err.(toml.ParseError); ok {
+			docErr.Line = parseErr.Position.Line
+			docErr.Column = parseErr.Position.Col
+			docErr.Err = fmt.Errorf("%s", parseErr.Message)
+		}
+		return nil, docErr
+	}
+	return fromTree(tree, univ, vars, "toml", tomlPositions(data))
+}
+
+// Positions of tables and keys, found by scanning lines of the document.
+// Elements inside inline tables and arrays are not recorded.
+func tomlPositions(data []byte) map[string]position {
+	positions := make(map[string]position)
+	arrayTables := make(map[string]int)
+	record := func(keys []string, prefix string, pos position) string {
+		path := prefix
+		for _, key := range keys {
+			path = childPath(path, key)
+			if _, ok := positions[path]; !ok {
+				positions[path] = pos
+			}
+		}
+		return path
+	}
+	table := ""
+	// depth of brackets of multi-line arrays and inline tables
+	depth := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		pos := position{lineNo, len(line) - len(strings.TrimLeft(line, " \t")) + 1}
+		switch {
+		case depth > 0:
+			depth += bracketDelta(trimmed)
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+		case strings.HasPrefix(trimmed, "[["):
+			name := strings.TrimSpace(strings.Trim(trimmed[:strings.Index(trimmed, "]]")], "[]"))
+			base := record(splitTomlKey(name), "", pos)
+			table = fmt.Sprintf("%s[%d]", base, arrayTables[base])
+			arrayTables[base] += 1
+			positions[table] = pos
+		case strings.HasPrefix(trimmed, "["):
+			name := strings.TrimSpace(strings.Trim(trimmed[:strings.Index(trimmed, "]")], "[]"))
+			table = record(splitTomlKey(name), "", pos)
+		case strings.Contains(trimmed, "="):
+			eq := strings.Index(trimmed, "=")
+			record(splitTomlKey(strings.TrimSpace(trimmed[:eq])), table, pos)
+			depth += bracketDelta(trimmed[eq + 1:])
+		}
+	}
+	return positions
+}
+
+// opened minus closed brackets and braces, outside of strings and comments
+func bracketDelta(s string) int {
+	delta := 0
+	var quote rune
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return delta
+		case c == '[' || c == '{':
+			delta += 1
+		case c == ']' || c == '}':
+			delta -= 1
+		}
+	}
+	return delta
+}
+
+// split dotted key, keeping dots in quoted keys
+func splitTomlKey(key string) []string {
+	var ret []string
+	var buf bytes.Buffer
+	var quote rune
+	for _, c := range key {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			buf.WriteRune(c)
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '.':
+			ret = append(ret, strings.TrimSpace(buf.String()))
+			buf.Reset()
+		case c == ' ' || c == '\t':
+		default:
+			buf.WriteRune(c)
+		}
+	}
+	return append(ret, buf.String())
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/kanosaki/go-pipenet/core"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+)
+
+// Construct MetaGraph from YAML Document
+func FromYaml(reader io.Reader, univ *core.Universe) (*core.MetaGraph, error) {
+	return FromYamlTemplate(reader, univ, nil)
+}
+
+func FromYamlTemplate(reader io.Reader, univ *core.Universe, vars map[string]interface{}) (*core.MetaGraph, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	root := &yaml.Node{}
+	if err := yaml.Unmarshal(data, root); err != nil {
+		return nil, yamlSyntaxError(err)
+	}
+	positions := make(map[string]position)
+	tree, err := yamlToTree(root, "", positions)
+	if err != nil {
+		return nil, err
+	}
+	return fromTree(tree, univ, vars, "yaml", positions)
+}
+
+func yamlSyntaxError(err error) error {
+	docErr := &DocumentError{Format: "yaml", Err: err}
+	if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+		docErr.Line, _ = strconv.Atoi(m[1])
+		docErr.Err = fmt.Errorf("%s", m[2])
+	}
+	return docErr
+}
+
+// convert node into maps, slices and scalars, recording position of each element
+func yamlToTree(node *yaml.Node, path string, positions map[string]position) (interface{}, error) {
+	switch node.Kind {
+	case 0:
+		// empty document
+		return nil, nil
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil, nil
+		}
+		return yamlToTree(node.Content[0], path, positions)
+	case yaml.AliasNode:
+		return yamlToTree(node.Alias, path, positions)
+	case yaml.MappingNode:
+		ret := make(map[string]interface{}, len(node.Content) / 2)
+		for i := 0; i + 1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i + 1]
+			p := childPath(path, key.Value)
+			positions[p] = position{key.Line, key.Column}
+			v, err := yamlToTree(value, p, positions)
+			if err != nil {
+				return nil, err
+			}
+			ret[key.Value] = v
+		}
+		return ret, nil
+	case yaml.SequenceNode:
+		ret := make([]interface{}, 0, len(node.Content))
+		for i, item := range node.Content {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			positions[p] = position{item.Line, item.Column}
+			v, err := yamlToTree(item, p, positions)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, v)
+		}
+		return ret, nil
+	default:
+		var v interface{}
+		if err := node.Decode(&v); err != nil {
+			return nil, &DocumentError{
+				Format: "yaml",
+				Path: strings.TrimPrefix(path, "."),
+				Line: node.Line,
+				Column: node.Column,
+				Err: err,
+			}
+		}
+		return v, nil
+	}
+}